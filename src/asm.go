@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+	"quark/vm"
+)
+
+// Asm implements `quark asm file.qasm [-o out.glue]`. The output is a raw
+// blob that `quark superglue` and `quark disasm` accept directly.
+func Asm(args []string) {
+	flags := flag.NewFlagSet("asm", flag.ContinueOnError)
+	out := flags.String("o", "", "output file (default: input name with .glue)")
+	files, err := parseFlags(flags, args)
+	if err != nil {
+		os.Exit(2)
+	}
+	if len(files) != 1 {
+		RuntimeError("asm takes one file!")
+	}
+	src, err := os.ReadFile(files[0])
+	if err != nil {
+		GluonError(err.Error())
+	}
+	blob, err := vm.AssembleToBlob(files[0], string(src))
+	if err != nil {
+		GluonError(err.Error())
+	}
+	if *out == "" {
+		*out = strings.TrimSuffix(files[0], ".qasm") + ".glue"
+	}
+	err = os.WriteFile(*out, blob, 0644)
+	CheckError(err)
+	Log("Assembled " + files[0] + " => " + *out)
+}
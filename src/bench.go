@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"runtime"
+	"time"
+
+	"quark/vm"
+)
+
+// benchTime is how long `quark bench` runs each benchmark for.
+const benchTime = time.Second
+
+// Bench implements `quark bench [--run REGEXP]`: runs the interpreter
+// benchmarks in vm.Benchmarks and reports the time per instruction. The
+// same programs run under `go test -bench` in package vm.
+func Bench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	run := flags.String("run", "", "only run benchmarks whose name matches this regexp")
+	rest, err := parseFlags(flags, args)
+	if err != nil {
+		os.Exit(2)
+	}
+	if len(rest) != 0 {
+		RuntimeError("bench takes no arguments!")
+	}
+	filter, err := regexp.Compile(*run)
+	if err != nil {
+		RuntimeError("bad --run pattern: " + err.Error())
+	}
+	fmt.Printf("%-16s %8s %12s %12s %14s %12s\n", "benchmark", "runs", "ns/run", "instructions", "ns/instruction", "allocs/run")
+	for _, b := range vm.Benchmarks {
+		if !filter.MatchString(b.Name) {
+			continue
+		}
+		prog, err := b.Program()
+		if err != nil {
+			RuntimeError(b.Name + ": " + err.Error())
+		}
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		var runs, steps int64
+		start := time.Now()
+		for runs == 0 || time.Since(start) < benchTime {
+			m := vm.NewVM()
+			m.Stdout = io.Discard
+			err := m.LoadProgram(prog)
+			if err == nil {
+				err = m.Run()
+			}
+			if err != nil {
+				RuntimeError(b.Name + ": " + err.Error())
+			}
+			steps = m.Steps()
+			runs++
+		}
+		elapsed := time.Since(start)
+		runtime.ReadMemStats(&after)
+		perRun := elapsed.Nanoseconds() / runs
+		fmt.Printf("%-16s %8d %12d %12d %14.2f %12d\n", b.Name, runs, perRun, steps,
+			float64(perRun)/float64(steps), int64(after.Mallocs-before.Mallocs)/runs)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"quark/vm"
+	"time"
+)
+
+const cacheDirName = ".quark-cache"
+
+// cacheMaxAge is how long an entry no build has used is kept.
+const cacheMaxAge = 30 * 24 * time.Hour
+
+// buildCache stores compiled blobs under .quark-cache/, keyed by the input
+// checksum and the compiler version, so unchanged files are not rebuilt.
+type buildCache struct {
+	dir    string
+	hits   int
+	misses int
+}
+
+func openBuildCache(projectDir string) *buildCache {
+	dir := filepath.Join(projectDir, cacheDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		GluonWarning("Build cache disabled: " + err.Error())
+		return &buildCache{}
+	}
+	return &buildCache{dir: dir}
+}
+
+func (c *buildCache) key(kind, name string, data []byte) string {
+	h := sha256.New()
+	for _, part := range []string{vm.CompilerVersion, kind, name} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	h.Write(data)
+	return kind + "-" + hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *buildCache) get(key string) ([]byte, bool) {
+	if c.dir == "" {
+		return nil, false
+	}
+	path := filepath.Join(c.dir, key)
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		c.misses++
+		return nil, false
+	}
+	// the modification time is when the entry was last used, for prune
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	c.hits++
+	return blob, true
+}
+
+// getProgram is get for an entry holding a program blob, decoded. An entry
+// that no longer decodes, from a torn write or an older blob format, is
+// dropped and counted as a miss so the caller rebuilds it.
+func (c *buildCache) getProgram(key string) ([]byte, *vm.Program, bool) {
+	blob, ok := c.get(key)
+	if !ok {
+		return nil, nil, false
+	}
+	prog, err := vm.DecodeProgram(blob)
+	if err != nil {
+		Log("Dropping bad cache entry " + key + ": " + err.Error())
+		c.evict(key)
+		c.hits--
+		c.misses++
+		return nil, nil, false
+	}
+	return blob, prog, true
+}
+
+// compile returns the object compiled from the source file at path, from
+// the cache when src has been compiled before.
+func (c *buildCache) compile(path string, src []byte) ([]byte, *vm.Program, error) {
+	key := c.key("source", path, src)
+	if blob, prog, ok := c.getProgram(key); ok {
+		Log("Cache hit: " + path)
+		return blob, prog, nil
+	}
+	blob, err := vm.CompileSourceToBlob(path, string(src))
+	if err != nil {
+		return nil, nil, err
+	}
+	c.put(key, blob)
+	return blob, nil, nil
+}
+
+func (c *buildCache) put(key string, blob []byte) {
+	if c.dir == "" {
+		return
+	}
+	// write then rename, so an interrupted build never leaves a torn entry
+	// and concurrent builds never write to the same file
+	f, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		GluonWarning("Could not write build cache: " + err.Error())
+		return
+	}
+	_, err = f.Write(blob)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.dir, key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		GluonWarning("Could not write build cache: " + err.Error())
+	}
+}
+
+func (c *buildCache) evict(key string) {
+	if c.dir != "" {
+		os.Remove(filepath.Join(c.dir, key))
+	}
+}
+
+// prune removes the entries, and temporary files left by interrupted
+// builds, that have not been used since before.
+func (c *buildCache) prune(before time.Time) {
+	if c.dir == "" {
+		return
+	}
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() || !info.ModTime().Before(before) {
+			continue
+		}
+		os.Remove(filepath.Join(c.dir, e.Name()))
+	}
+}
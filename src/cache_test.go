@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const cacheSrc = "let x = 1;\nprint(x);\n"
+
+func TestBuildCacheHitAndMiss(t *testing.T) {
+	c := openBuildCache(t.TempDir())
+	blob, prog, err := c.compile("main.quark", []byte(cacheSrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog != nil || c.hits != 0 || c.misses != 1 {
+		t.Errorf("first build: prog %v, %d hit(s), %d miss(es), want a miss", prog, c.hits, c.misses)
+	}
+	again, prog, err := c.compile("main.quark", []byte(cacheSrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog == nil || c.hits != 1 || !bytes.Equal(again, blob) {
+		t.Errorf("second build: %d hit(s), same blob %v, want a hit", c.hits, bytes.Equal(again, blob))
+	}
+	// a changed file, or the same source under another name, is compiled
+	for _, tt := range []struct{ path, src string }{
+		{"main.quark", cacheSrc + "print(2);\n"},
+		{"other.quark", cacheSrc},
+	} {
+		misses := c.misses
+		if _, _, err := c.compile(tt.path, []byte(tt.src)); err != nil {
+			t.Fatal(err)
+		}
+		if c.misses != misses+1 {
+			t.Errorf("%s with %q was a cache hit", tt.path, tt.src)
+		}
+	}
+}
+
+// An entry that does not decode is dropped and rebuilt rather than failing
+// every build until someone deletes the cache.
+func TestBuildCacheCorruptEntry(t *testing.T) {
+	c := openBuildCache(t.TempDir())
+	blob, _, err := c.compile("main.quark", []byte(cacheSrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := c.key("source", "main.quark", []byte(cacheSrc))
+	entry := filepath.Join(c.dir, key)
+	for _, bad := range [][]byte{blob[:len(blob)/2], []byte("not a blob"), nil} {
+		if err := os.WriteFile(entry, bad, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, prog, err := c.compile("main.quark", []byte(cacheSrc))
+		if err != nil {
+			t.Fatalf("with a bad entry: %v", err)
+		}
+		if prog != nil || !bytes.Equal(got, blob) {
+			t.Errorf("a bad entry of %d bytes was used", len(bad))
+		}
+		if stored, err := os.ReadFile(entry); err != nil || !bytes.Equal(stored, blob) {
+			t.Errorf("the bad entry was not replaced: %v", err)
+		}
+	}
+}
+
+func TestBuildCachePrune(t *testing.T) {
+	c := openBuildCache(t.TempDir())
+	old := c.key("source", "old.quark", []byte(cacheSrc))
+	used := c.key("source", "used.quark", []byte(cacheSrc))
+	c.put(old, []byte("old"))
+	c.put(used, []byte("used"))
+	leftover := filepath.Join(c.dir, old+".123.tmp")
+	os.WriteFile(leftover, nil, 0644)
+	long := time.Now().Add(-2 * cacheMaxAge)
+	for _, name := range []string{old, used, filepath.Base(leftover)} {
+		os.Chtimes(filepath.Join(c.dir, name), long, long)
+	}
+	if _, ok := c.get(used); !ok {
+		t.Fatal("entry missing")
+	}
+	c.prune(time.Now().Add(-cacheMaxAge))
+	names := map[string]bool{}
+	entries, _ := os.ReadDir(c.dir)
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	if len(names) != 1 || !names[used] {
+		t.Errorf("after prune the cache holds %v, want only the entry just used", names)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"quark/vm"
+)
+
+/* ---------- Debug Adapter Protocol ---------- */
+
+// dapServer speaks the Debug Adapter Protocol
+// (https://microsoft.github.io/debug-adapter-protocol/) for `quark debug
+// --dap`. Requests are handled one at a time; the program runs in its own
+// goroutine and only pause and disconnect are served until it stops. Fibers
+// are the protocol's threads, with thread id = fiber id + 1.
+type dapServer struct {
+	r       *bufio.Reader
+	w       io.Writer
+	wmu     sync.Mutex // guards w and seq, the program's output is sent while it runs
+	seq     int
+	program string
+	seed    int64
+
+	d           *vm.Debugger
+	stopOnEntry bool
+	cancel      context.CancelFunc // pauses the running program, nil when stopped
+	done        chan dapStop
+	threads     []dapBody       // as of the last stop
+	frames      [][2]int        // frame id - 1 -> fiber, depth; reset at every stop
+	vars        [][]vm.Variable // variablesReference - 1 -> variables
+	quit        bool
+}
+
+type dapBody map[string]interface{}
+
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// dapStop is how a run of the program ended.
+type dapStop struct {
+	reason vm.StopReason
+	err    error
+}
+
+func newDAPServer(r io.Reader, w io.Writer, seed int64) *dapServer {
+	return &dapServer{r: bufio.NewReader(r), w: w, seed: seed, done: make(chan dapStop)}
+}
+
+// serve handles requests until the client disconnects or closes the
+// connection.
+func (s *dapServer) serve() {
+	reqs := make(chan *dapRequest)
+	go func() {
+		defer close(reqs)
+		for {
+			req, err := readDAP(s.r)
+			if err != nil {
+				return
+			}
+			reqs <- req
+		}
+	}()
+	for !s.quit {
+		select {
+		case req, ok := <-reqs:
+			if !ok {
+				if s.cancel != nil {
+					s.cancel()
+					<-s.done
+				}
+				return
+			}
+			s.handle(req)
+		case st := <-s.done:
+			s.cancel = nil
+			s.stopped(st)
+		}
+	}
+}
+
+// readDAP reads one message: headers, a blank line, then Content-Length
+// bytes of JSON.
+func readDAP(r *bufio.Reader) (*dapRequest, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if length >= 0 {
+				break
+			}
+			continue
+		}
+		if v, ok := strings.CutPrefix(line, "Content-Length:"); ok {
+			if length, err = strconv.Atoi(strings.TrimSpace(v)); err != nil || length < 0 {
+				return nil, fmt.Errorf("bad Content-Length %q", v)
+			}
+		}
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	var req dapRequest
+	if err := json.Unmarshal(buf, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (s *dapServer) send(msg dapBody) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	msg["seq"] = s.seq
+	b, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(b), b)
+}
+
+func (s *dapServer) respond(req *dapRequest, body dapBody, err error) {
+	msg := dapBody{"type": "response", "request_seq": req.Seq, "command": req.Command, "success": err == nil}
+	if err != nil {
+		msg["message"] = err.Error()
+	}
+	if body != nil {
+		msg["body"] = body
+	}
+	s.send(msg)
+}
+
+func (s *dapServer) event(name string, body dapBody) {
+	msg := dapBody{"type": "event", "event": name}
+	if body != nil {
+		msg["body"] = body
+	}
+	s.send(msg)
+}
+
+// dapOutput sends what the program prints as output events.
+type dapOutput struct{ s *dapServer }
+
+func (o dapOutput) Write(p []byte) (int, error) {
+	o.s.event("output", dapBody{"category": "stdout", "output": string(p)})
+	return len(p), nil
+}
+
+var errRunning = errors.New("the program is running")
+
+func (s *dapServer) handle(req *dapRequest) {
+	var args struct {
+		Program            string `json:"program"`
+		StopOnEntry        bool   `json:"stopOnEntry"`
+		ThreadID           int    `json:"threadId"`
+		FrameID            int    `json:"frameId"`
+		VariablesReference int    `json:"variablesReference"`
+		Expression         string `json:"expression"`
+		Source             struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if len(req.Arguments) > 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			s.respond(req, nil, err)
+			return
+		}
+	}
+	switch req.Command {
+	case "initialize":
+		s.respond(req, dapBody{
+			"supportsConfigurationDoneRequest": true,
+			"supportsTerminateRequest":         true,
+		}, nil)
+		return
+	case "disconnect", "terminate":
+		if s.cancel != nil {
+			s.cancel()
+			<-s.done
+			s.cancel = nil
+		}
+		s.respond(req, nil, nil)
+		if req.Command == "terminate" {
+			s.event("terminated", nil)
+		} else {
+			s.quit = true
+		}
+		return
+	case "pause":
+		if s.cancel != nil {
+			s.cancel()
+		}
+		s.respond(req, nil, nil)
+		return
+	case "threads":
+		s.respond(req, dapBody{"threads": s.threads}, nil)
+		return
+	case "launch":
+		s.respond(req, nil, s.launch(args.Program, args.StopOnEntry))
+		if s.d != nil {
+			// the client sends breakpoints and configurationDone next
+			s.event("initialized", nil)
+		}
+		return
+	}
+	if s.d == nil {
+		s.respond(req, nil, errors.New("no program launched"))
+		return
+	}
+	if s.cancel != nil {
+		s.respond(req, nil, errRunning)
+		return
+	}
+	switch req.Command {
+	case "setBreakpoints":
+		s.d.ClearBreakpoints(args.Source.Path)
+		bps := []dapBody{}
+		for _, b := range args.Breakpoints {
+			at, ok := s.d.SetBreakpoint(args.Source.Path, b.Line)
+			bp := dapBody{"verified": ok, "line": b.Line}
+			if ok {
+				bp["line"] = at.Line
+			} else {
+				bp["message"] = "no code at or after this line"
+			}
+			bps = append(bps, bp)
+		}
+		s.respond(req, dapBody{"breakpoints": bps}, nil)
+	case "setExceptionBreakpoints":
+		s.respond(req, dapBody{}, nil)
+	case "configurationDone":
+		s.respond(req, nil, nil)
+		if s.stopOnEntry {
+			s.event("stopped", dapBody{"reason": "entry", "threadId": 1, "allThreadsStopped": true})
+			return
+		}
+		s.resume(s.d.Continue)
+	case "continue":
+		s.respond(req, dapBody{"allThreadsContinued": true}, nil)
+		s.resume(s.d.Continue)
+	case "next":
+		s.respond(req, nil, nil)
+		s.resume(s.d.StepOver)
+	case "stepIn":
+		s.respond(req, nil, nil)
+		s.resume(s.d.StepIn)
+	case "stepOut":
+		s.respond(req, nil, nil)
+		s.resume(s.d.StepOut)
+	case "stackTrace":
+		s.respond(s.stackTrace(req, args.ThreadID))
+	case "scopes":
+		if args.FrameID < 1 || args.FrameID > len(s.frames) {
+			s.respond(req, nil, fmt.Errorf("no frame %d", args.FrameID))
+			return
+		}
+		fr := s.frames[args.FrameID-1]
+		locals, err := s.d.Locals(fr[0], fr[1])
+		if err != nil {
+			s.respond(req, nil, err)
+			return
+		}
+		s.respond(req, dapBody{"scopes": []dapBody{
+			{"name": "Locals", "variablesReference": s.addVars(locals), "expensive": false},
+			{"name": "Globals", "variablesReference": s.addVars(s.d.Globals()), "expensive": false},
+		}}, nil)
+	case "variables":
+		if args.VariablesReference < 1 || args.VariablesReference > len(s.vars) {
+			s.respond(req, nil, fmt.Errorf("no variables %d", args.VariablesReference))
+			return
+		}
+		vars := []dapBody{}
+		for _, v := range s.vars[args.VariablesReference-1] {
+			vars = append(vars, dapBody{"name": v.Name, "value": vm.Repr(v.Value), "type": vm.TypeOf(v.Value).String(), "variablesReference": 0})
+		}
+		s.respond(req, dapBody{"variables": vars}, nil)
+	case "evaluate":
+		fiber, depth := s.d.VM().Fiber(), 0
+		if args.FrameID >= 1 && args.FrameID <= len(s.frames) {
+			fiber, depth = s.frames[args.FrameID-1][0], s.frames[args.FrameID-1][1]
+		}
+		v, err := s.d.Lookup(fiber, depth, strings.TrimSpace(args.Expression))
+		if err != nil {
+			s.respond(req, nil, err)
+			return
+		}
+		s.respond(req, dapBody{"result": vm.Repr(v), "type": vm.TypeOf(v).String(), "variablesReference": 0}, nil)
+	default:
+		s.respond(req, nil, fmt.Errorf("unsupported request %s", req.Command))
+	}
+}
+
+// launch loads the program given on the command line, or else in the
+// launch request.
+func (s *dapServer) launch(program string, stopOnEntry bool) error {
+	if s.d != nil {
+		return errors.New("already launched")
+	}
+	if s.program != "" {
+		program = s.program
+	}
+	if program == "" {
+		return errors.New("no program to debug, set program in the launch configuration")
+	}
+	d, err := loadDebugger(program, s.seed)
+	if err != nil {
+		return err
+	}
+	m := d.VM()
+	// stdin and stdout carry the protocol
+	m.Stdout = dapOutput{s}
+	m.Stdin = strings.NewReader("")
+	s.d = d
+	s.stopOnEntry = stopOnEntry
+	s.refresh()
+	return nil
+}
+
+// resume runs the program in the background until it stops.
+func (s *dapServer) resume(run func(context.Context) (vm.StopReason, error)) {
+	if s.d.Err() != nil || s.d.VM().Halted() {
+		// the client continued after the program ended
+		s.finish()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go func() {
+		reason, err := run(ctx)
+		cancel()
+		s.done <- dapStop{reason, err}
+	}()
+}
+
+// stopped reports how a run ended.
+func (s *dapServer) stopped(st dapStop) {
+	s.refresh()
+	thread := s.d.VM().Fiber() + 1
+	switch st.reason {
+	case vm.StopHalted:
+		s.finish()
+	case vm.StopError:
+		s.event("stopped", dapBody{"reason": "exception", "description": "Runtime error", "text": st.err.Error(), "threadId": thread, "allThreadsStopped": true})
+	case vm.StopBreakpoint:
+		s.event("stopped", dapBody{"reason": "breakpoint", "threadId": thread, "allThreadsStopped": true})
+	case vm.StopPause:
+		s.event("stopped", dapBody{"reason": "pause", "threadId": thread, "allThreadsStopped": true})
+	case vm.StopStep:
+		s.event("stopped", dapBody{"reason": "step", "threadId": thread, "allThreadsStopped": true})
+	}
+}
+
+func (s *dapServer) finish() {
+	code := 0
+	if s.d.Err() != nil {
+		code = 1
+	}
+	s.event("exited", dapBody{"exitCode": code})
+	s.event("terminated", nil)
+}
+
+// refresh drops the frame and variable references of the last stop and
+// notes the fibers.
+func (s *dapServer) refresh() {
+	s.frames, s.vars = nil, nil
+	s.threads = nil
+	for _, f := range s.d.Fibers() {
+		s.threads = append(s.threads, dapBody{"id": f.ID + 1, "name": fmt.Sprintf("fiber %d", f.ID)})
+	}
+	if len(s.threads) == 0 {
+		s.threads = []dapBody{{"id": 1, "name": "fiber 0"}}
+	}
+}
+
+func (s *dapServer) addVars(vars []vm.Variable) int {
+	s.vars = append(s.vars, vars)
+	return len(s.vars)
+}
+
+func (s *dapServer) stackTrace(req *dapRequest, thread int) (*dapRequest, dapBody, error) {
+	for _, f := range s.d.Fibers() {
+		if f.ID+1 != thread {
+			continue
+		}
+		frames := []dapBody{}
+		for depth, tf := range f.Trace {
+			s.frames = append(s.frames, [2]int{f.ID, depth})
+			fr := dapBody{"id": len(s.frames), "name": tf.Func, "line": tf.Line, "column": 1}
+			if tf.File != "" {
+				path, err := filepath.Abs(tf.File)
+				if err != nil {
+					path = tf.File
+				}
+				fr["source"] = dapBody{"name": filepath.Base(tf.File), "path": path}
+			}
+			frames = append(frames, fr)
+		}
+		return req, dapBody{"stackFrames": frames, "totalFrames": len(frames)}, nil
+	}
+	return req, nil, fmt.Errorf("no thread %d", thread)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/nate-telecomm/go_ansi"
+	"quark/vm"
+)
+
+// Debug implements `quark debug [--dap] app.gluon|blob.glue`: a terminal
+// debugger, or with --dap a Debug Adapter Protocol server on stdin and
+// stdout for editors.
+func Debug(args []string) {
+	flags := flag.NewFlagSet("debug", flag.ContinueOnError)
+	dap := flags.Bool("dap", false, "serve the Debug Adapter Protocol on stdin and stdout")
+	seed := flags.Int64("seed", 0, "seed for the fiber scheduler; 0 runs fibers round robin")
+	files, err := parseFlags(flags, args)
+	if err != nil {
+		os.Exit(2)
+	}
+	if *dap {
+		// the program may also come from the launch request
+		if len(files) > 1 {
+			RuntimeError("debug takes one Gluon!")
+		}
+		s := newDAPServer(os.Stdin, os.Stdout, *seed)
+		if len(files) == 1 {
+			s.program = files[0]
+		}
+		s.serve()
+		return
+	}
+	if len(files) != 1 {
+		GluonError("No Gluon provided!")
+	}
+	d, err := loadDebugger(files[0], *seed)
+	if err != nil {
+		if vm.IsBlobError(err) {
+			GluonError(err.Error())
+		}
+		RuntimeError(err.Error())
+	}
+	// the program reads its input from the terminal too, through the
+	// same buffer so neither takes lines meant for the other
+	in := bufio.NewReader(os.Stdin)
+	d.VM().Stdin = in
+	t := &termDebugger{d: d, out: os.Stdout, sources: map[string][]string{}}
+	t.repl(in)
+}
+
+// loadDebugger loads a Gluon or blob into a new VM, without mounting the
+// Gluon, and stops before its first instruction.
+func loadDebugger(path string, seed int64) (*vm.Debugger, error) {
+	blob, err := readBlob(path)
+	if err != nil {
+		return nil, err
+	}
+	m := vm.NewVM()
+	m.Sched.Seed = seed
+	if err := m.Load(blob); err != nil {
+		return nil, err
+	}
+	return vm.NewDebugger(m), nil
+}
+
+/* ---------- Terminal front end ---------- */
+
+// termDebugger is the `quark debug` prompt.
+type termDebugger struct {
+	d       *vm.Debugger
+	out     io.Writer
+	sources map[string][]string // file -> its lines, nil if unreadable
+	fiber   int                 // the selected frame, for locals and print
+	depth   int
+}
+
+const debugHelp = `Commands:
+  break [FILE:]LINE   b   set a breakpoint, or break FUNC at a function
+  clear [FILE:]LINE       remove a breakpoint, or all of them
+  breaks                  list the breakpoints
+  continue            c   run to the next breakpoint
+  step                s   run to the next line, into calls
+  next                n   run to the next line, over calls
+  out                 o   run until the current call returns
+  where               bt  show the call stack
+  up, down                select the caller or callee frame
+  locals              l   show the selected frame's variables
+  globals             g   show the global variables
+  print NAME          p   show a variable
+  list                    show the source around the current line
+  fibers                  list the fibers
+  restart                 run the program again from the start
+  quit                q   leave the debugger
+An empty line repeats the last run command. Ctrl-C pauses a running program.`
+
+func (t *termDebugger) repl(in *bufio.Reader) {
+	fmt.Fprintln(t.out, "Stopped at the start of the program, type help for commands.")
+	t.showLocation()
+	last := ""
+	for {
+		fmt.Fprint(t.out, "(qdb) ")
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(t.out)
+			return
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			line = last
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		cmd, arg := fields[0], strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+		last = ""
+		switch cmd {
+		case "break", "b":
+			t.setBreak(arg)
+		case "clear":
+			t.clearBreak(arg)
+		case "breaks":
+			for _, b := range t.d.Breakpoints() {
+				fmt.Fprintln(t.out, b)
+			}
+		case "continue", "c":
+			t.run(t.d.Continue)
+			last = cmd
+		case "step", "s":
+			t.run(t.d.StepIn)
+			last = cmd
+		case "next", "n":
+			t.run(t.d.StepOver)
+			last = cmd
+		case "out", "o":
+			t.run(t.d.StepOut)
+			last = cmd
+		case "where", "bt":
+			t.where()
+		case "up":
+			t.selectFrame(t.depth + 1)
+		case "down":
+			t.selectFrame(t.depth - 1)
+		case "locals", "l":
+			vars, err := t.d.Locals(t.fiber, t.depth)
+			if err != nil {
+				fmt.Fprintln(t.out, err)
+			}
+			t.showVars(vars)
+		case "globals", "g":
+			t.showVars(t.d.Globals())
+		case "print", "p":
+			v, err := t.d.Lookup(t.fiber, t.depth, arg)
+			if err != nil {
+				fmt.Fprintln(t.out, err)
+				break
+			}
+			fmt.Fprintf(t.out, "%s = %s\n", arg, vm.Repr(v))
+		case "list":
+			t.list()
+		case "fibers":
+			for _, f := range t.d.Fibers() {
+				mark := " "
+				if f.Running {
+					mark = "*"
+				}
+				fmt.Fprintf(t.out, "%s fiber %d  %s", mark, f.ID, f.State)
+				if len(f.Trace) > 0 {
+					fmt.Fprintf(t.out, "  %s", f.Trace[0])
+				}
+				fmt.Fprintln(t.out)
+			}
+		case "restart":
+			if err := t.d.Restart(); err != nil {
+				fmt.Fprintln(t.out, err)
+				break
+			}
+			t.fiber, t.depth = 0, 0
+			fmt.Fprintln(t.out, "Restarted.")
+			t.showLocation()
+		case "quit", "q":
+			return
+		case "help", "h":
+			fmt.Fprintln(t.out, debugHelp)
+		default:
+			fmt.Fprintf(t.out, "unknown command %q, type help for commands\n", cmd)
+		}
+	}
+}
+
+// run resumes the program, pausing it on Ctrl-C, and reports where it
+// stopped.
+func (t *termDebugger) run(f func(context.Context) (vm.StopReason, error)) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	reason, err := f(ctx)
+	stop()
+	t.fiber, t.depth = t.d.VM().Fiber(), 0
+	switch reason {
+	case vm.StopHalted:
+		fmt.Fprintln(t.out, "The program finished. Use restart to run it again.")
+		return
+	case vm.StopError:
+		fmt.Fprintln(t.out, ansi.Red+"The program failed:"+ansi.End)
+		fmt.Fprintln(t.out, err)
+		return
+	case vm.StopBreakpoint:
+		fmt.Fprint(t.out, "Breakpoint, ")
+	case vm.StopPause:
+		fmt.Fprint(t.out, "Paused, ")
+	}
+	t.showLocation()
+}
+
+// parseLine reads [FILE:]LINE, with the current file by default, or the
+// name of a function for the line it starts on.
+func (t *termDebugger) parseLine(arg string) (string, int, error) {
+	prog := t.d.VM().Program()
+	for i := range prog.Funcs {
+		if co := &prog.Funcs[i]; co.Kind == vm.CodeFunc && co.Name == arg {
+			if file, line, ok := prog.LineAt(co.Entry); ok {
+				return file, line, nil
+			}
+		}
+	}
+	file := t.d.Location().File
+	if i := strings.LastIndex(arg, ":"); i >= 0 {
+		file, arg = arg[:i], arg[i+1:]
+	}
+	line, err := strconv.Atoi(arg)
+	if err != nil || line < 1 {
+		return "", 0, fmt.Errorf("bad line %q, want [FILE:]LINE", arg)
+	}
+	if file == "" {
+		files := t.d.Files()
+		if len(files) != 1 {
+			return "", 0, fmt.Errorf("which file? want FILE:LINE")
+		}
+		file = files[0]
+	}
+	return file, line, nil
+}
+
+func (t *termDebugger) setBreak(arg string) {
+	file, line, err := t.parseLine(arg)
+	if err != nil {
+		fmt.Fprintln(t.out, err)
+		return
+	}
+	at, ok := t.d.SetBreakpoint(file, line)
+	if !ok {
+		fmt.Fprintf(t.out, "no code at or after %s:%d\n", file, line)
+		return
+	}
+	fmt.Fprintf(t.out, "Breakpoint set at %s\n", at)
+}
+
+func (t *termDebugger) clearBreak(arg string) {
+	if arg == "" {
+		t.d.ClearBreakpoints("")
+		fmt.Fprintln(t.out, "All breakpoints cleared.")
+		return
+	}
+	file, line, err := t.parseLine(arg)
+	if err != nil {
+		fmt.Fprintln(t.out, err)
+		return
+	}
+	if !t.d.ClearBreakpoint(file, line) {
+		fmt.Fprintf(t.out, "no breakpoint at %s:%d\n", file, line)
+	}
+}
+
+// stack is the selected fiber's call stack.
+func (t *termDebugger) stack() []vm.TraceFrame {
+	for _, f := range t.d.Fibers() {
+		if f.ID == t.fiber {
+			return f.Trace
+		}
+	}
+	return nil
+}
+
+func (t *termDebugger) where() {
+	for i, f := range t.stack() {
+		mark := " "
+		if i == t.depth {
+			mark = ">"
+		}
+		fmt.Fprintf(t.out, "%s #%d %s\n", mark, i, f)
+	}
+}
+
+func (t *termDebugger) selectFrame(depth int) {
+	stack := t.stack()
+	if depth < 0 || depth >= len(stack) {
+		fmt.Fprintln(t.out, "no frame there")
+		return
+	}
+	t.depth = depth
+	fmt.Fprintf(t.out, "#%d %s\n", depth, stack[depth])
+	t.showSource(stack[depth], 0)
+}
+
+func (t *termDebugger) showVars(vars []vm.Variable) {
+	if len(vars) == 0 {
+		fmt.Fprintln(t.out, "(none)")
+	}
+	for _, v := range vars {
+		fmt.Fprintf(t.out, "%s = %s\n", v.Name, vm.Repr(v.Value))
+	}
+}
+
+// showLocation prints where the running fiber is and its source line.
+func (t *termDebugger) showLocation() {
+	loc := t.d.Location()
+	if id := t.d.VM().Fiber(); id != 0 {
+		fmt.Fprintf(t.out, "fiber %d ", id)
+	}
+	fmt.Fprintln(t.out, loc)
+	t.showSource(loc, 0)
+}
+
+func (t *termDebugger) list() {
+	stack := t.stack()
+	if t.depth >= len(stack) || stack[t.depth].File == "" {
+		fmt.Fprintln(t.out, "no source line here")
+		return
+	}
+	t.showSource(stack[t.depth], 5)
+}
+
+// showSource prints the lines around f's, marking it and any breakpoints.
+func (t *termDebugger) showSource(f vm.TraceFrame, around int) {
+	if f.File == "" {
+		return
+	}
+	src, ok := t.sources[f.File]
+	if !ok {
+		if data, err := os.ReadFile(f.File); err == nil {
+			src = strings.Split(string(data), "\n")
+		}
+		t.sources[f.File] = src
+	}
+	breaks := map[int]bool{}
+	for _, b := range t.d.Breakpoints() {
+		if b.File == f.File {
+			breaks[b.Line] = true
+		}
+	}
+	for n := max(f.Line-around, 1); n <= f.Line+around && n <= len(src); n++ {
+		mark := "  "
+		if n == f.Line {
+			mark = "=>"
+		}
+		if breaks[n] {
+			mark = "*" + mark[1:]
+		}
+		fmt.Fprintf(t.out, "%5d %s %s\n", n, mark, src[n-1])
+	}
+}
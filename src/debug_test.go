@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"quark/vm"
+)
+
+const debugSrc = `let a = 1;
+func f(x) {
+    let y = x + 1;
+    return y;
+}
+let b = f(a);
+print(b);
+`
+
+// writeBlob links src, as main.quark, into a blob file to debug.
+func writeBlob(t *testing.T, src string) string {
+	t.Helper()
+	obj, err := vm.CompileSourceToBlob("main.quark", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := vm.DecodeProgram(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe, err := vm.Link([]vm.Object{{Name: "main.quark", Prog: p}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := vm.EncodeProgram(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "main.glue")
+	if err := os.WriteFile(path, blob, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func runDebugger(t *testing.T, input string) string {
+	t.Helper()
+	d, err := loadDebugger(writeBlob(t, debugSrc), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	d.VM().Stdout = &out
+	td := &termDebugger{d: d, out: &out, sources: map[string][]string{}}
+	td.repl(bufio.NewReader(strings.NewReader(input)))
+	return out.String()
+}
+
+func TestDebugBreakAndContinue(t *testing.T) {
+	got := runDebugger(t, "break 1\nbreak f\nc\nc\nprint x\nc\n")
+	for _, want := range []string{
+		"Breakpoint set at main.quark:1",
+		"Breakpoint set at main.quark:3",
+		"Breakpoint, at <main> (main.quark:1)",
+		"Breakpoint, at f (main.quark:3)",
+		"x = 1",
+		"2\nThe program finished.",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("no %q in the session:\n%s", want, got)
+		}
+	}
+}
+
+// Continuing from a breakpoint on the first line leaves it, and an empty
+// line repeats the command.
+func TestDebugBreakFirstLine(t *testing.T) {
+	got := runDebugger(t, "break 1\nc\n\n")
+	if n := strings.Count(got, "Breakpoint, at <main> (main.quark:1)"); n != 1 {
+		t.Errorf("stopped at line 1 %d times:\n%s", n, got)
+	}
+	if !strings.Contains(got, "The program finished.") {
+		t.Errorf("the program did not finish:\n%s", got)
+	}
+}
+
+func TestDebugStep(t *testing.T) {
+	got := runDebugger(t, "n\ns\nn\nwhere\np y\no\nn\np b\n")
+	for _, want := range []string{
+		"at <main> (main.quark:6)",
+		"at f (main.quark:3)",
+		"at f (main.quark:4)",
+		"> #0 at f (main.quark:4)\n  #1 at <main> (main.quark:6)",
+		"y = 2",
+		"at <main> (main.quark:7)",
+		"b = 2",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("no %q in the session:\n%s", want, got)
+		}
+	}
+}
+
+// dapClient drives a dapServer over pipes.
+type dapClient struct {
+	t    *testing.T
+	w    io.Writer
+	msgs chan map[string]interface{}
+	seq  int
+}
+
+func startDAP(t *testing.T) *dapClient {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	s := newDAPServer(inR, outW, 0)
+	go func() {
+		s.serve()
+		outW.Close()
+	}()
+	c := &dapClient{t: t, w: inW, msgs: make(chan map[string]interface{}, 100)}
+	go func() {
+		defer close(c.msgs)
+		r := bufio.NewReader(outR)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			v, ok := strings.CutPrefix(strings.TrimSpace(line), "Content-Length:")
+			if !ok {
+				continue
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(v))
+			r.ReadString('\n')
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			var msg map[string]interface{}
+			if err := json.Unmarshal(buf, &msg); err != nil {
+				t.Error(err)
+				return
+			}
+			c.msgs <- msg
+		}
+	}()
+	t.Cleanup(func() { inW.Close() })
+	return c
+}
+
+// request sends a request and returns the body of its response, failing
+// the test if it was not successful.
+func (c *dapClient) request(command string, args interface{}) map[string]interface{} {
+	c.t.Helper()
+	c.seq++
+	b, _ := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(b), b)
+	msg := c.wait("response")
+	if msg["command"] != command || msg["success"] != true {
+		c.t.Fatalf("%s: got %v", command, msg)
+	}
+	body, _ := msg["body"].(map[string]interface{})
+	return body
+}
+
+// wait returns the next response or event called name, skipping output
+// and other events.
+func (c *dapClient) wait(name string) map[string]interface{} {
+	c.t.Helper()
+	for {
+		select {
+		case msg, ok := <-c.msgs:
+			if !ok {
+				c.t.Fatalf("the server closed before %s", name)
+			}
+			if msg["type"] == name || msg["event"] == name {
+				return msg
+			}
+		case <-time.After(5 * time.Second):
+			c.t.Fatalf("no %s", name)
+		}
+	}
+}
+
+// stoppedAt waits for a stopped event and returns its reason and line.
+func (c *dapClient) stoppedAt() (string, int) {
+	c.t.Helper()
+	body := c.wait("stopped")["body"].(map[string]interface{})
+	frames := c.request("stackTrace", map[string]interface{}{"threadId": body["threadId"]})["stackFrames"].([]interface{})
+	return body["reason"].(string), int(frames[0].(map[string]interface{})["line"].(float64))
+}
+
+func TestDAPBreakpoints(t *testing.T) {
+	c := startDAP(t)
+	c.request("initialize", nil)
+	c.request("launch", map[string]interface{}{"program": writeBlob(t, debugSrc)})
+	c.wait("initialized")
+	bps := c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": "/work/main.quark"},
+		"breakpoints": []map[string]int{{"line": 1}, {"line": 2}, {"line": 7}},
+	})["breakpoints"].([]interface{})
+	lines := []int{}
+	for _, bp := range bps {
+		bp := bp.(map[string]interface{})
+		if bp["verified"] != true {
+			t.Errorf("breakpoint %v not verified", bp)
+		}
+		lines = append(lines, int(bp["line"].(float64)))
+	}
+	if fmt.Sprint(lines) != "[1 3 7]" {
+		t.Errorf("breakpoints at lines %v, want [1 3 7]", lines)
+	}
+
+	c.request("configurationDone", nil)
+	for _, want := range []int{1, 3, 7} {
+		if reason, line := c.stoppedAt(); reason != "breakpoint" || line != want {
+			t.Fatalf("stopped for %s at line %d, want a breakpoint at %d", reason, line, want)
+		}
+		c.request("continue", map[string]interface{}{"threadId": 1})
+	}
+	out := c.wait("output")["body"].(map[string]interface{})["output"]
+	if out != "2\n" {
+		t.Errorf("output %q", out)
+	}
+	if code := c.wait("exited")["body"].(map[string]interface{})["exitCode"]; code != 0.0 {
+		t.Errorf("exit code %v", code)
+	}
+	c.request("disconnect", nil)
+}
+
+func TestDAPStep(t *testing.T) {
+	c := startDAP(t)
+	c.request("initialize", nil)
+	c.request("launch", map[string]interface{}{"program": writeBlob(t, debugSrc), "stopOnEntry": true})
+	c.wait("initialized")
+	c.request("configurationDone", nil)
+	if reason, line := c.stoppedAt(); reason != "entry" || line != 1 {
+		t.Fatalf("stopped for %s at line %d, want entry at 1", reason, line)
+	}
+	for _, step := range []struct {
+		command string
+		line    int
+	}{{"next", 6}, {"stepIn", 3}, {"next", 4}, {"stepOut", 6}} {
+		c.request(step.command, map[string]interface{}{"threadId": 1})
+		if reason, line := c.stoppedAt(); reason != "step" || line != step.line {
+			t.Fatalf("%s stopped for %s at line %d, want a step to %d", step.command, reason, line, step.line)
+		}
+	}
+	if got := c.request("evaluate", map[string]interface{}{"expression": "a"}); got["result"] != "1" {
+		t.Errorf("evaluating a: %v", got)
+	}
+	c.request("disconnect", nil)
+}
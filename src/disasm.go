@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"quark/vm"
+)
+
+// readBlob loads bytecode from a gluon, compiles a .quark file to an object
+// blob, or reads a raw blob such as source.glue.
+func readBlob(path string) ([]byte, error) {
+	switch {
+	case strings.HasSuffix(path, ".gluon"):
+		return ReadGluonBlob(path)
+	case strings.HasSuffix(path, ".quark"):
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return vm.CompileSourceToBlob(path, string(src))
+	}
+	return os.ReadFile(path)
+}
+
+// Disasm implements `quark disasm file.gluon|file.quark`.
+func Disasm(args []string) {
+	if len(args) != 1 {
+		RuntimeError("disasm takes one file!")
+	}
+	blob, err := readBlob(args[0])
+	if err != nil {
+		GluonError(err.Error())
+	}
+	fmt.Printf("; %s\n", args[0])
+	if err := vm.DisassembleBlob(os.Stdout, blob); err != nil {
+		GluonError(err.Error())
+	}
+}
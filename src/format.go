@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"quark/parser"
+)
+
+// FormatSources implements `quark fmt [-w] [--check] [-d] [path ...]`.
+// Directories are searched for .quark files; with no paths the current
+// directory is used. Without flags the formatted source goes to stdout.
+func FormatSources(args []string) {
+	flags := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	write := flags.Bool("w", false, "write the result back to the source file")
+	check := flags.Bool("check", false, "list files that are not formatted and exit with status 1")
+	diff := flags.Bool("d", false, "print a diff instead of the formatted source")
+	paths, err := parseFlags(flags, args)
+	if err != nil {
+		os.Exit(2)
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	var files []string
+	for _, path := range paths {
+		found, err := quarkFiles(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		files = append(files, found...)
+	}
+
+	status := 0
+	for _, path := range files {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 2
+			continue
+		}
+		res, err := parser.Format(path, src)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 2
+			continue
+		}
+		changed := !bytes.Equal(src, res)
+		if *check {
+			if changed {
+				fmt.Println(path)
+				if status == 0 {
+					status = 1
+				}
+			}
+			continue
+		}
+		if *diff && changed {
+			os.Stdout.Write(unifiedDiff(path+".orig", path, src, res))
+		}
+		if *write && changed {
+			info, err := os.Stat(path)
+			CheckError(err)
+			err = os.WriteFile(path, res, info.Mode().Perm())
+			CheckError(err)
+		}
+		if !*write && !*diff {
+			os.Stdout.Write(res)
+		}
+	}
+	if status != 0 {
+		os.Exit(status)
+	}
+}
+
+// quarkFiles expands path into the .quark files it names. Dependencies in
+// pkgs/, gluon mounts and hidden directories are skipped.
+func quarkFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if p != path && (name == "pkgs" || name == "quark--gluon--mount" || strings.HasPrefix(name, ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(name, ".quark") {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files, err
+}
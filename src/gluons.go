@@ -1,6 +1,9 @@
 package main
 
 import (
+	"archive/zip"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 )
@@ -42,3 +45,24 @@ func LoadGluon(path string) {
 	err = os.Chdir(workingDir)
 	CheckError(err)
 }
+
+// ReadGluonBlob returns the bytecode inside a gluon without mounting it.
+func ReadGluonBlob(path string) ([]byte, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if filepath.Base(f.Name) != "source.glue" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	return nil, fmt.Errorf("%s has no source.glue", path)
+}
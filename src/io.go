@@ -25,6 +25,24 @@ func RuntimeError(msg string) {
 	fmt.Println(ansi.Red + "--------------------------" + ansi.End)
 	Exit(1)
 }
+
+// LimitError reports a program stopped by an execution limit and exits
+// with status.
+func LimitError(msg string, status int) {
+	fmt.Println(ansi.Red + "------[LimitError]------" + ansi.End)
+	fmt.Println(msg)
+	fmt.Println(ansi.Red + "--------------------------" + ansi.End)
+	Exit(status)
+}
+
+// ArithmeticError reports an integer operation with no result, such as a
+// division by zero, and exits.
+func ArithmeticError(msg string) {
+	fmt.Println(ansi.Red + "------[ArithmeticError]------" + ansi.End)
+	fmt.Println(msg)
+	fmt.Println(ansi.Red + "--------------------------" + ansi.End)
+	Exit(1)
+}
 func RuntimeWarning(msg string) {
 	fmt.Println(ansi.Yellow + "------[RuntimeWarning]------" + ansi.End)
 	fmt.Println(msg)
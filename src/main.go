@@ -1,12 +1,9 @@
 package main
 
 import (
-	"strings"
-	"path/filepath"
 	"os"
 	"github.com/nate-telecomm/go_ansi"
 	"encoding/json"
-	"quark/vm"
 )
 
 func Init() {
@@ -48,20 +45,20 @@ func main() {
 			PackageError("No package name provided!")
 		}
 		SetupProj(osArgs[1])
+	} else if osArgs[0] == "fmt" {
+		FormatSources(osArgs[1:])
+	} else if osArgs[0] == "disasm" {
+		Disasm(osArgs[1:])
+	} else if osArgs[0] == "asm" {
+		Asm(osArgs[1:])
+	} else if osArgs[0] == "bench" {
+		Bench(osArgs[1:])
+	} else if osArgs[0] == "repl" {
+		Repl(osArgs[1:])
+	} else if osArgs[0] == "debug" {
+		Debug(osArgs[1:])
 	} else if osArgs[0] == "superglue" {
-		if len(osArgs) != 2 {
-			GluonError("No Gluon provided!")
-		}
-		if !strings.HasSuffix(osArgs[1], ".gluon") {
-			GluonWarning("This file does not have the .gluon extension, it might not be a Gluon")
-		}
-		LoadGluon(osArgs[1])
-		weREALLYneedtocleanup = true
-		data, err := os.ReadFile(filepath.Join("quark--gluon--mount", "source.glue"))
-		CheckError(err)
-		if err = vm.RunBytecode(data); err != nil {
-      RuntimeError(err.Error())
-    }
+		weREALLYneedtocleanup = Superglue(osArgs[1:])
 	} else {
 		Init()
 		switch osArgs[0] {
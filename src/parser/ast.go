@@ -0,0 +1,268 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+)
+
+/* ---------- Positions ---------- */
+
+// Pos is a byte offset into a source file plus one, so that the zero value
+// (NoPos) means "no position". Use File.Position to turn it into a line and
+// column.
+type Pos int
+
+const NoPos Pos = 0
+
+func (p Pos) IsValid() bool { return p != NoPos }
+
+// Position is a human readable source location.
+type Position struct {
+	Filename string
+	Offset   int // byte offset, starting at 0
+	Line     int // starting at 1
+	Column   int // byte count, starting at 1
+}
+
+func (p Position) IsValid() bool { return p.Line > 0 }
+
+func (p Position) String() string {
+	s := p.Filename
+	if p.IsValid() {
+		if s != "" {
+			s += ":"
+		}
+		s += fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	if s == "" {
+		s = "-"
+	}
+	return s
+}
+
+/* ---------- Nodes ---------- */
+
+// Node is implemented by every AST node. Pos is the position of the first
+// character belonging to the node and End the position just after it.
+type Node interface {
+	Pos() Pos
+	End() Pos
+}
+
+type Expr interface {
+	Node
+	exprNode()
+}
+
+type Stmt interface {
+	Node
+	stmtNode()
+}
+
+type (
+	NumberLit struct {
+		ValuePos Pos
+		Raw      string // source spelling
+		Value    int64
+	}
+	StringLit struct {
+		ValuePos Pos
+		Raw      string // source spelling, including quotes
+		Value    string // unescaped
+	}
+	Ident struct {
+		NamePos Pos
+		Name    string
+	}
+	BinaryExpr struct {
+		X     Expr
+		OpPos Pos
+		Op    TokenKind // TokPlus, TokMinus, ...
+		Y     Expr
+	}
+	UnaryExpr struct {
+		OpPos Pos
+		Op    TokenKind // TokTilde
+		X     Expr
+	}
+	ParenExpr struct {
+		Lparen Pos
+		X      Expr
+		Rparen Pos
+	}
+	CallExpr struct {
+		Fun    *Ident
+		Lparen Pos
+		Args   []Expr
+		Rparen Pos
+	}
+)
+
+func (x *NumberLit) Pos() Pos  { return x.ValuePos }
+func (x *StringLit) Pos() Pos  { return x.ValuePos }
+func (x *Ident) Pos() Pos      { return x.NamePos }
+func (x *BinaryExpr) Pos() Pos { return x.X.Pos() }
+func (x *UnaryExpr) Pos() Pos  { return x.OpPos }
+func (x *ParenExpr) Pos() Pos  { return x.Lparen }
+func (x *CallExpr) Pos() Pos   { return x.Fun.Pos() }
+
+func (x *NumberLit) End() Pos  { return x.ValuePos + Pos(len(x.Raw)) }
+func (x *StringLit) End() Pos  { return x.ValuePos + Pos(len(x.Raw)) }
+func (x *Ident) End() Pos      { return x.NamePos + Pos(len(x.Name)) }
+func (x *BinaryExpr) End() Pos { return x.Y.End() }
+func (x *UnaryExpr) End() Pos  { return x.X.End() }
+func (x *ParenExpr) End() Pos  { return x.Rparen + 1 }
+func (x *CallExpr) End() Pos   { return x.Rparen + 1 }
+
+func (*NumberLit) exprNode()  {}
+func (*StringLit) exprNode()  {}
+func (*Ident) exprNode()      {}
+func (*BinaryExpr) exprNode() {}
+func (*UnaryExpr) exprNode()  {}
+func (*ParenExpr) exprNode()  {}
+func (*CallExpr) exprNode()   {}
+
+// Semi is NoPos in statements whose terminating semicolon was omitted.
+type (
+	LetStmt struct {
+		Let   Pos
+		Name  *Ident
+		Value Expr
+		Semi  Pos
+	}
+	ExprStmt struct {
+		X    Expr
+		Semi Pos
+	}
+	ReturnStmt struct {
+		Return Pos
+		Result Expr // nil for a bare return
+		Semi   Pos
+	}
+	// SpawnStmt starts Call in a new fiber.
+	SpawnStmt struct {
+		Spawn Pos
+		Call  *CallExpr
+		Semi  Pos
+	}
+	BlockStmt struct {
+		Lbrace Pos
+		List   []Stmt
+		Rbrace Pos
+	}
+	// FuncDecl is a function declaration. It is a statement so that it
+	// can sit among the top level statements of a file.
+	FuncDecl struct {
+		Func   Pos
+		Name   *Ident
+		Lparen Pos
+		Params []*Ident
+		Rparen Pos
+		Body   *BlockStmt
+	}
+)
+
+func (s *LetStmt) Pos() Pos    { return s.Let }
+func (s *ExprStmt) Pos() Pos   { return s.X.Pos() }
+func (s *ReturnStmt) Pos() Pos { return s.Return }
+func (s *SpawnStmt) Pos() Pos  { return s.Spawn }
+func (s *BlockStmt) Pos() Pos  { return s.Lbrace }
+func (s *FuncDecl) Pos() Pos   { return s.Func }
+
+func (s *LetStmt) End() Pos {
+	if s.Semi.IsValid() {
+		return s.Semi + 1
+	}
+	return s.Value.End()
+}
+func (s *ExprStmt) End() Pos {
+	if s.Semi.IsValid() {
+		return s.Semi + 1
+	}
+	return s.X.End()
+}
+
+func (s *ReturnStmt) End() Pos {
+	switch {
+	case s.Semi.IsValid():
+		return s.Semi + 1
+	case s.Result != nil:
+		return s.Result.End()
+	}
+	return s.Return + Pos(len("return"))
+}
+func (s *SpawnStmt) End() Pos {
+	if s.Semi.IsValid() {
+		return s.Semi + 1
+	}
+	return s.Call.End()
+}
+func (s *BlockStmt) End() Pos { return s.Rbrace + 1 }
+func (s *FuncDecl) End() Pos  { return s.Body.End() }
+
+func (*LetStmt) stmtNode()    {}
+func (*ExprStmt) stmtNode()   {}
+func (*ReturnStmt) stmtNode() {}
+func (*SpawnStmt) stmtNode()  {}
+func (*BlockStmt) stmtNode()  {}
+func (*FuncDecl) stmtNode()   {}
+
+/* ---------- Comments ---------- */
+
+// Comment is a // line comment or a /* block */ comment. Text includes the
+// comment markers but not the newline ending a line comment.
+type Comment struct {
+	Slash Pos
+	Text  string
+}
+
+func (c *Comment) Pos() Pos { return c.Slash }
+func (c *Comment) End() Pos { return c.Slash + Pos(len(c.Text)) }
+
+/* ---------- Files ---------- */
+
+// File is a parsed .quark source file.
+type File struct {
+	Name     string
+	Stmts    []Stmt
+	Comments []*Comment // all comments in the file, in source order
+
+	src   string
+	lines []int // offset of the first byte of each line
+}
+
+func newFile(name, src string) *File {
+	f := &File{Name: name, src: src, lines: []int{0}}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			f.lines = append(f.lines, i+1)
+		}
+	}
+	return f
+}
+
+func (f *File) Pos() Pos {
+	if len(f.Stmts) > 0 {
+		return f.Stmts[0].Pos()
+	}
+	return NoPos
+}
+func (f *File) End() Pos {
+	if len(f.Stmts) > 0 {
+		return f.Stmts[len(f.Stmts)-1].End()
+	}
+	return NoPos
+}
+
+// Source returns the text the file was parsed from.
+func (f *File) Source() string { return f.src }
+
+// Position resolves p to a filename, line and column.
+func (f *File) Position(p Pos) Position {
+	if !p.IsValid() {
+		return Position{Filename: f.Name}
+	}
+	off := int(p) - 1
+	i := sort.Search(len(f.lines), func(i int) bool { return f.lines[i] > off }) - 1
+	return Position{Filename: f.Name, Offset: off, Line: i + 1, Column: off - f.lines[i] + 1}
+}
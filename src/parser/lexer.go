@@ -0,0 +1,286 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+/* ---------- Tokens ---------- */
+
+type TokenKind int
+
+const (
+	TokEOF TokenKind = iota
+	TokIdent
+	TokNumber
+	TokString
+	TokLet
+	TokPrint
+	TokAssign // =
+	TokSemi   // ;
+	TokLParen // (
+	TokRParen // )
+	TokPlus
+	TokMinus
+	TokStar
+	TokSlash
+	TokUnknown
+	TokComma // ,
+	TokFunc
+	TokReturn
+	TokLBrace // {
+	TokRBrace // }
+	TokSpawn
+	TokPercent // %
+	TokAmp     // &
+	TokPipe    // |
+	TokCaret   // ^
+	TokTilde   // ~
+	TokShl     // <<
+	TokShr     // >>
+	TokUshr    // >>>
+)
+
+var tokenNames = map[TokenKind]string{
+	TokEOF:     "EOF",
+	TokIdent:   "identifier",
+	TokNumber:  "number",
+	TokString:  "string",
+	TokLet:     "let",
+	TokPrint:   "print",
+	TokAssign:  "=",
+	TokSemi:    ";",
+	TokLParen:  "(",
+	TokRParen:  ")",
+	TokPlus:    "+",
+	TokMinus:   "-",
+	TokStar:    "*",
+	TokSlash:   "/",
+	TokUnknown: "unknown",
+	TokComma:   ",",
+	TokFunc:    "func",
+	TokReturn:  "return",
+	TokLBrace:  "{",
+	TokRBrace:  "}",
+	TokSpawn:   "spawn",
+	TokPercent: "%",
+	TokAmp:     "&",
+	TokPipe:    "|",
+	TokCaret:   "^",
+	TokTilde:   "~",
+	TokShl:     "<<",
+	TokShr:     ">>",
+	TokUshr:    ">>>",
+}
+
+var keywords = map[string]TokenKind{
+	"let":    TokLet,
+	"print":  TokPrint,
+	"func":   TokFunc,
+	"return": TokReturn,
+	"spawn":  TokSpawn,
+}
+
+// IsKeyword reports whether name is lexed as a keyword rather than an
+// identifier.
+func IsKeyword(name string) bool {
+	_, ok := keywords[name]
+	return ok
+}
+
+func (k TokenKind) String() string {
+	if s, ok := tokenNames[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("token(%d)", int(k))
+}
+
+// Token is a single lexeme. Value holds the decoded text (string literals
+// are unescaped); the raw source spelling is src[Pos-1:End-1].
+type Token struct {
+	Kind  TokenKind
+	Value string
+	Pos   Pos
+	End   Pos
+}
+
+/* ---------- Lexer ---------- */
+
+type Lexer struct {
+	input    string
+	pos      int
+	comments []*Comment
+}
+
+func NewLexer(s string) *Lexer { return &Lexer{input: s} }
+
+func (l *Lexer) next() rune {
+	if l.pos >= len(l.input) {
+		return 0
+	}
+	r := rune(l.input[l.pos])
+	l.pos++
+	return r
+}
+func (l *Lexer) peek() rune {
+	if l.pos >= len(l.input) {
+		return 0
+	}
+	return rune(l.input[l.pos])
+}
+
+func (l *Lexer) peekAt(n int) rune {
+	if l.pos+n >= len(l.input) {
+		return 0
+	}
+	return rune(l.input[l.pos+n])
+}
+
+// skipSpace skips whitespace and comments. Comments are kept so tools such
+// as the formatter can put them back.
+func (l *Lexer) skipSpace() {
+	for {
+		for unicode.IsSpace(l.peek()) {
+			l.next()
+		}
+		if l.peek() != '/' {
+			return
+		}
+		start := l.pos
+		switch l.peekAt(1) {
+		case '/':
+			for l.peek() != '\n' && l.peek() != 0 {
+				l.next()
+			}
+		case '*':
+			l.pos += 2
+			for !(l.peek() == '*' && l.peekAt(1) == '/') {
+				if l.peek() == 0 {
+					// unterminated, let NextToken report it
+					l.pos = start
+					return
+				}
+				l.next()
+			}
+			l.pos += 2
+		default:
+			return
+		}
+		l.comments = append(l.comments, &Comment{Slash: Pos(start + 1), Text: l.input[start:l.pos]})
+	}
+}
+
+// Comments returns the comments skipped so far, in source order.
+func (l *Lexer) Comments() []*Comment { return l.comments }
+
+func (l *Lexer) readWhile(pred func(rune) bool) string {
+	var b strings.Builder
+	for pred(l.peek()) && l.peek() != 0 {
+		b.WriteRune(l.next())
+	}
+	return b.String()
+}
+
+func (l *Lexer) token(kind TokenKind, value string, start int) Token {
+	return Token{Kind: kind, Value: value, Pos: Pos(start + 1), End: Pos(l.pos + 1)}
+}
+
+func (l *Lexer) NextToken() Token {
+	l.skipSpace()
+	start := l.pos
+	ch := l.peek()
+	if ch == 0 {
+		return l.token(TokEOF, "", start)
+	}
+	if unicode.IsLetter(ch) || ch == '_' {
+		s := l.readWhile(func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' })
+		if kind, ok := keywords[s]; ok {
+			return l.token(kind, s, start)
+		}
+		return l.token(TokIdent, s, start)
+	}
+	// numbers
+	if unicode.IsDigit(ch) {
+		num := l.readWhile(func(r rune) bool { return unicode.IsDigit(r) })
+		return l.token(TokNumber, num, start)
+	}
+	// strings : "..."
+	if ch == '"' {
+		l.next()
+		var b strings.Builder
+		for {
+			c := l.next()
+			if c == 0 {
+				return l.token(TokUnknown, l.input[start:l.pos], start)
+			}
+			if c == '"' {
+				break
+			}
+			if c == '\\' {
+				n := l.next()
+				if n == 'n' {
+					b.WriteByte('\n')
+				} else {
+					b.WriteRune(n)
+				}
+			} else {
+				b.WriteRune(c)
+			}
+		}
+		return l.token(TokString, b.String(), start)
+	}
+	switch l.next() {
+	case '=':
+		return l.token(TokAssign, "", start)
+	case ';':
+		return l.token(TokSemi, "", start)
+	case '(':
+		return l.token(TokLParen, "", start)
+	case ')':
+		return l.token(TokRParen, "", start)
+	case ',':
+		return l.token(TokComma, "", start)
+	case '{':
+		return l.token(TokLBrace, "", start)
+	case '}':
+		return l.token(TokRBrace, "", start)
+	case '+':
+		return l.token(TokPlus, "", start)
+	case '-':
+		return l.token(TokMinus, "", start)
+	case '*':
+		return l.token(TokStar, "", start)
+	case '/':
+		if l.peek() == '*' {
+			l.pos = len(l.input)
+			return l.token(TokUnknown, l.input[start:l.pos], start)
+		}
+		return l.token(TokSlash, "", start)
+	case '%':
+		return l.token(TokPercent, "", start)
+	case '&':
+		return l.token(TokAmp, "", start)
+	case '|':
+		return l.token(TokPipe, "", start)
+	case '^':
+		return l.token(TokCaret, "", start)
+	case '~':
+		return l.token(TokTilde, "", start)
+	case '<':
+		if l.peek() == '<' {
+			l.next()
+			return l.token(TokShl, "", start)
+		}
+	case '>':
+		if l.peek() == '>' {
+			l.next()
+			if l.peek() == '>' {
+				l.next()
+				return l.token(TokUshr, "", start)
+			}
+			return l.token(TokShr, "", start)
+		}
+	}
+	return l.token(TokUnknown, l.input[start:l.pos], start)
+}
@@ -0,0 +1,348 @@
+// Package parser is the Quark front end: it turns .quark source into a typed
+// syntax tree that the compiler in quark/vm, and any other tool, can consume.
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Error is a syntax error at a known source position.
+type Error struct {
+	Pos Position
+	Msg string
+}
+
+func (e *Error) Error() string { return e.Pos.String() + ": " + e.Msg }
+
+type Parser struct {
+	file *File
+	lex  *Lexer
+	cur  Token
+	peek Token
+}
+
+func NewParser(filename, src string) *Parser {
+	p := &Parser{file: newFile(filename, src), lex: NewLexer(src)}
+	p.cur = p.lex.NextToken()
+	p.peek = p.lex.NextToken()
+	return p
+}
+
+// Parse parses a whole source file. filename is only used for positions and
+// error messages.
+func Parse(filename, src string) (*File, error) {
+	return NewParser(filename, src).ParseFile()
+}
+
+// ParseExpr parses a single expression, e.g. for tools that evaluate snippets.
+func ParseExpr(src string) (Expr, error) {
+	p := NewParser("", src)
+	e, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if p.cur.Kind != TokEOF {
+		return nil, p.errorf(p.cur.Pos, "unexpected %v after expression", p.cur.Kind)
+	}
+	return e, nil
+}
+
+func (p *Parser) advance() {
+	p.cur = p.peek
+	p.peek = p.lex.NextToken()
+}
+
+func (p *Parser) errorf(pos Pos, format string, args ...interface{}) error {
+	return &Error{Pos: p.file.Position(pos), Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *Parser) expect(kind TokenKind) (Pos, error) {
+	pos := p.cur.Pos
+	if p.cur.Kind != kind {
+		return pos, p.errorf(pos, "expected %v, got %v", kind, p.describe(p.cur))
+	}
+	p.advance()
+	return pos, nil
+}
+
+func (p *Parser) describe(t Token) string {
+	switch t.Kind {
+	case TokIdent, TokNumber:
+		return fmt.Sprintf("%v %s", t.Kind, t.Value)
+	case TokUnknown:
+		return fmt.Sprintf("%q", t.Value)
+	}
+	return t.Kind.String()
+}
+
+// optionalSemi consumes a trailing ; if there is one.
+func (p *Parser) optionalSemi() Pos {
+	if p.cur.Kind == TokSemi {
+		pos := p.cur.Pos
+		p.advance()
+		return pos
+	}
+	return NoPos
+}
+
+func (p *Parser) ParseFile() (*File, error) {
+	for p.cur.Kind != TokEOF {
+		st, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		p.file.Stmts = append(p.file.Stmts, st)
+	}
+	p.file.Comments = p.lex.Comments()
+	return p.file, nil
+}
+
+func (p *Parser) parseStatement() (Stmt, error) {
+	switch p.cur.Kind {
+	case TokFunc:
+		return p.parseFuncDecl()
+	case TokReturn:
+		ret := &ReturnStmt{Return: p.cur.Pos}
+		p.advance()
+		if p.cur.Kind != TokSemi && p.cur.Kind != TokRBrace && p.cur.Kind != TokEOF {
+			expr, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			ret.Result = expr
+		}
+		ret.Semi = p.optionalSemi()
+		return ret, nil
+	case TokSpawn:
+		spawn := &SpawnStmt{Spawn: p.cur.Pos}
+		p.advance()
+		expr, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		call, ok := expr.(*CallExpr)
+		if !ok {
+			return nil, p.errorf(expr.Pos(), "expected function call after spawn")
+		}
+		spawn.Call = call
+		spawn.Semi = p.optionalSemi()
+		return spawn, nil
+	case TokLBrace:
+		block, err := p.parseBlock()
+		if err != nil {
+			return nil, err
+		}
+		return block, nil
+	}
+	if p.cur.Kind == TokLet {
+		let := p.cur.Pos
+		p.advance()
+		if p.cur.Kind != TokIdent {
+			return nil, p.errorf(p.cur.Pos, "expected identifier after let, got %v", p.describe(p.cur))
+		}
+		name := &Ident{NamePos: p.cur.Pos, Name: p.cur.Value}
+		p.advance()
+		if p.cur.Kind != TokAssign {
+			return nil, p.errorf(p.cur.Pos, "expected = after identifier, got %v", p.describe(p.cur))
+		}
+		p.advance()
+		expr, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		return &LetStmt{Let: let, Name: name, Value: expr, Semi: p.optionalSemi()}, nil
+	}
+	// expression statement
+	expr, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	return &ExprStmt{X: expr, Semi: p.optionalSemi()}, nil
+}
+
+func (p *Parser) parseFuncDecl() (Stmt, error) {
+	fn := &FuncDecl{Func: p.cur.Pos}
+	p.advance()
+	if p.cur.Kind != TokIdent {
+		return nil, p.errorf(p.cur.Pos, "expected function name after func, got %v", p.describe(p.cur))
+	}
+	fn.Name = &Ident{NamePos: p.cur.Pos, Name: p.cur.Value}
+	p.advance()
+	lparen, err := p.expect(TokLParen)
+	if err != nil {
+		return nil, err
+	}
+	fn.Lparen = lparen
+	for p.cur.Kind != TokRParen {
+		if p.cur.Kind != TokIdent {
+			return nil, p.errorf(p.cur.Pos, "expected parameter name, got %v", p.describe(p.cur))
+		}
+		fn.Params = append(fn.Params, &Ident{NamePos: p.cur.Pos, Name: p.cur.Value})
+		p.advance()
+		if p.cur.Kind != TokComma {
+			break
+		}
+		p.advance()
+	}
+	if fn.Rparen, err = p.expect(TokRParen); err != nil {
+		return nil, err
+	}
+	if p.cur.Kind != TokLBrace {
+		return nil, p.errorf(p.cur.Pos, "expected { after function parameters, got %v", p.describe(p.cur))
+	}
+	if fn.Body, err = p.parseBlock(); err != nil {
+		return nil, err
+	}
+	return fn, nil
+}
+
+func (p *Parser) parseBlock() (*BlockStmt, error) {
+	block := &BlockStmt{Lbrace: p.cur.Pos}
+	p.advance()
+	for p.cur.Kind != TokRBrace {
+		if p.cur.Kind == TokEOF {
+			return nil, p.errorf(block.Lbrace, "unclosed {")
+		}
+		st, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		block.List = append(block.List, st)
+	}
+	block.Rbrace = p.cur.Pos
+	p.advance()
+	return block, nil
+}
+
+func (p *Parser) parseExpression() (Expr, error) {
+	return p.parseBinary(0)
+}
+
+// Binary operators bind as in Java: multiplicative, additive, shifts,
+// then &, ^ and | last.
+var precedence = map[TokenKind]int{
+	TokPipe:    4,
+	TokCaret:   5,
+	TokAmp:     6,
+	TokShl:     8,
+	TokShr:     8,
+	TokUshr:    8,
+	TokPlus:    10,
+	TokMinus:   10,
+	TokStar:    20,
+	TokSlash:   20,
+	TokPercent: 20,
+}
+
+// Precedence reports the binding power of a binary operator, or 0 if kind is
+// not a binary operator.
+func Precedence(kind TokenKind) int { return precedence[kind] }
+
+func (p *Parser) parseBinary(minPrec int) (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.cur.Kind
+		prec, ok := precedence[op]
+		if !ok || prec < minPrec {
+			break
+		}
+		opPos := p.cur.Pos
+		p.advance()
+		right, err := p.parseBinary(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{X: left, OpPos: opPos, Op: op, Y: right}
+	}
+	return left, nil
+}
+
+// parseUnary parses a primary expression with any prefix operators, which
+// bind tighter than every binary operator.
+func (p *Parser) parseUnary() (Expr, error) {
+	if p.cur.Kind != TokTilde {
+		return p.parsePrimary()
+	}
+	opPos, op := p.cur.Pos, p.cur.Kind
+	p.advance()
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return &UnaryExpr{OpPos: opPos, Op: op, X: x}, nil
+}
+
+func (p *Parser) raw(t Token) string {
+	return p.file.src[t.Pos-1 : t.End-1]
+}
+
+func (p *Parser) parsePrimary() (Expr, error) {
+	switch p.cur.Kind {
+	case TokNumber:
+		n, err := strconv.ParseInt(p.cur.Value, 10, 64)
+		if err != nil {
+			return nil, p.errorf(p.cur.Pos, "number %s out of range", p.cur.Value)
+		}
+		v := &NumberLit{ValuePos: p.cur.Pos, Raw: p.raw(p.cur), Value: n}
+		p.advance()
+		return v, nil
+	case TokString:
+		v := &StringLit{ValuePos: p.cur.Pos, Raw: p.raw(p.cur), Value: p.cur.Value}
+		p.advance()
+		return v, nil
+	case TokIdent, TokPrint:
+		name := &Ident{NamePos: p.cur.Pos, Name: p.cur.Value}
+		p.advance()
+		if p.cur.Kind == TokLParen {
+			return p.parseCall(name)
+		}
+		return name, nil
+	case TokLParen:
+		lparen := p.cur.Pos
+		p.advance()
+		e, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		rparen, err := p.expect(TokRParen)
+		if err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Lparen: lparen, X: e, Rparen: rparen}, nil
+	case TokUnknown:
+		if strings.HasPrefix(p.cur.Value, "\"") {
+			return nil, p.errorf(p.cur.Pos, "unterminated string literal")
+		}
+		if strings.HasPrefix(p.cur.Value, "/*") {
+			return nil, p.errorf(p.cur.Pos, "unterminated comment")
+		}
+	}
+	return nil, p.errorf(p.cur.Pos, "unexpected %v", p.describe(p.cur))
+}
+
+func (p *Parser) parseCall(fun *Ident) (Expr, error) {
+	call := &CallExpr{Fun: fun, Lparen: p.cur.Pos}
+	p.advance()
+	for p.cur.Kind != TokRParen {
+		arg, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+		if p.cur.Kind != TokComma {
+			break
+		}
+		p.advance()
+	}
+	rparen, err := p.expect(TokRParen)
+	if err != nil {
+		return nil, err
+	}
+	call.Rparen = rparen
+	return call, nil
+}
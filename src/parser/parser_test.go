@@ -0,0 +1,149 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// sexpr renders e with explicit grouping, so tests can check how the
+// parser bound the operators.
+func sexpr(e Expr) string {
+	switch e := e.(type) {
+	case *NumberLit:
+		return e.Raw
+	case *StringLit:
+		return e.Raw
+	case *Ident:
+		return e.Name
+	case *BinaryExpr:
+		return fmt.Sprintf("(%v %s %s)", e.Op, sexpr(e.X), sexpr(e.Y))
+	case *UnaryExpr:
+		return fmt.Sprintf("(%v %s)", e.Op, sexpr(e.X))
+	case *ParenExpr:
+		return sexpr(e.X)
+	case *CallExpr:
+		args := make([]string, len(e.Args))
+		for i, a := range e.Args {
+			args[i] = sexpr(a)
+		}
+		return fmt.Sprintf("%s(%s)", e.Fun.Name, strings.Join(args, ", "))
+	}
+	return fmt.Sprintf("<%T>", e)
+}
+
+func TestParseExprPrecedence(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"1 + 2 * 3", "(+ 1 (* 2 3))"},
+		{"1 - 2 - 3", "(- (- 1 2) 3)"},
+		{"(1 + 2) * 3", "(* (+ 1 2) 3)"},
+		{"a / b * c % d", "(% (* (/ a b) c) d)"},
+		{"1 << 2 + 3", "(<< 1 (+ 2 3))"},
+		{"a | b ^ c & d", "(| a (^ b (& c d)))"},
+		{"~a + ~~b", "(+ (~ a) (~ (~ b)))"},
+		{"f(1, g(x) + 2)", "f(1, (+ g(x) 2))"},
+		{"print(\"hi\")", "print(\"hi\")"},
+	}
+	for _, tt := range tests {
+		e, err := ParseExpr(tt.src)
+		if err != nil {
+			t.Errorf("ParseExpr(%q): %v", tt.src, err)
+			continue
+		}
+		if got := sexpr(e); got != tt.want {
+			t.Errorf("ParseExpr(%q) = %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	src := "let x = 1;\nfunc add(a, b) {\n    return a + b;\n}\nspawn add(x, 2)\nprint(x);\n"
+	f, err := Parse("t.quark", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Stmts) != 4 {
+		t.Fatalf("got %d statements, want 4", len(f.Stmts))
+	}
+	let, ok := f.Stmts[0].(*LetStmt)
+	if !ok || let.Name.Name != "x" || sexpr(let.Value) != "1" {
+		t.Errorf("statement 1 = %#v, want let x = 1", f.Stmts[0])
+	}
+	fn, ok := f.Stmts[1].(*FuncDecl)
+	if !ok {
+		t.Fatalf("statement 2 is %T, want *FuncDecl", f.Stmts[1])
+	}
+	if fn.Name.Name != "add" || len(fn.Params) != 2 || len(fn.Body.List) != 1 {
+		t.Errorf("func = %s with %d params and %d statements", fn.Name.Name, len(fn.Params), len(fn.Body.List))
+	}
+	if ret, ok := fn.Body.List[0].(*ReturnStmt); !ok || sexpr(ret.Result) != "(+ a b)" {
+		t.Errorf("body = %#v, want return a + b", fn.Body.List[0])
+	}
+	spawn, ok := f.Stmts[2].(*SpawnStmt)
+	if !ok || sexpr(spawn.Call) != "add(x, 2)" {
+		t.Errorf("statement 3 = %#v, want spawn add(x, 2)", f.Stmts[2])
+	}
+	if spawn.Semi.IsValid() {
+		t.Errorf("spawn statement has a semicolon at %v, it was left out", f.Position(spawn.Semi))
+	}
+	if _, ok := f.Stmts[3].(*ExprStmt); !ok {
+		t.Errorf("statement 4 is %T, want *ExprStmt", f.Stmts[3])
+	}
+}
+
+func TestParsePositions(t *testing.T) {
+	src := "let x = 1;\nfunc f(a) {\n    return a * 2;\n}\n"
+	f, err := Parse("t.quark", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := f.Stmts[1].(*FuncDecl).Body.List[0].(*ReturnStmt)
+	mul := ret.Result.(*BinaryExpr)
+	tests := []struct {
+		name string
+		pos  Pos
+		want string
+	}{
+		{"let", f.Stmts[0].Pos(), "t.quark:1:1"},
+		{"func", f.Stmts[1].Pos(), "t.quark:2:1"},
+		{"return", ret.Pos(), "t.quark:3:5"},
+		{"operator", mul.OpPos, "t.quark:3:14"},
+		{"after func", f.Stmts[1].End(), "t.quark:4:2"},
+	}
+	for _, tt := range tests {
+		if got := f.Position(tt.pos).String(); got != tt.want {
+			t.Errorf("%s at %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	if got := src[f.Stmts[0].Pos()-1 : f.Stmts[0].End()-1]; got != "let x = 1;" {
+		t.Errorf("let statement spans %q", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"let = 1;", "t.quark:1:5: expected identifier"},
+		{"let x = ;", "t.quark:1:9: unexpected ;"},
+		{"print(1", "t.quark:1:8: expected )"},
+		{"let s = \"open", "t.quark:1:9: unterminated string literal"},
+		{"let x = 1 /* open", "t.quark:1:11: unterminated comment"},
+		{"func f( {}", "t.quark:1:9:"},
+	}
+	for _, tt := range tests {
+		_, err := Parse("t.quark", tt.src)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", tt.src)
+			continue
+		}
+		if _, ok := err.(*Error); !ok {
+			t.Errorf("Parse(%q) error is %T, want *Error", tt.src, err)
+		}
+		if !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) = %q, want it to start with %q", tt.src, err, tt.want)
+		}
+	}
+}
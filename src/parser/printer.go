@@ -0,0 +1,336 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// indentUnit is used for block bodies and for continuation lines inside a
+// statement.
+const indentUnit = "    "
+
+type printer struct {
+	buf      bytes.Buffer
+	file     *File      // nil when printing a node without its file
+	comments []*Comment // comments not printed yet
+	lastLine int        // source line of the last thing printed
+	indent   int        // block nesting depth
+}
+
+// Fprint writes node back out as Quark source in canonical form: one
+// statement per line, each terminated by a semicolon except declarations
+// ending in a block, block bodies indented by four spaces, single spaces
+// around binary operators and after commas. When node is a *File its comments are
+// kept and runs of blank lines are collapsed to one.
+func Fprint(w io.Writer, node Node) error {
+	p := &printer{}
+	if f, ok := node.(*File); ok {
+		p.file = f
+		p.comments = f.Comments
+	}
+	if err := p.node(node); err != nil {
+		return err
+	}
+	_, err := w.Write(p.buf.Bytes())
+	return err
+}
+
+// Print is like Fprint but returns the source as a string.
+func Print(node Node) (string, error) {
+	var b bytes.Buffer
+	if err := Fprint(&b, node); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Format parses src and prints it back in canonical form.
+func Format(filename string, src []byte) ([]byte, error) {
+	f, err := Parse(filename, string(src))
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := Fprint(&b, f); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (p *printer) line(pos Pos) int {
+	if p.file == nil {
+		return 0
+	}
+	return p.file.Position(pos).Line
+}
+
+// separate starts a new top level item at pos, keeping at most one of the
+// blank lines that preceded it in the source.
+func (p *printer) separate(pos Pos) {
+	if p.lastLine > 0 && p.line(pos)-p.lastLine > 1 {
+		p.buf.WriteByte('\n')
+	}
+}
+
+// leadingComments prints, each on its own line, the pending comments that
+// start before pos.
+func (p *printer) leadingComments(pos Pos) {
+	for len(p.comments) > 0 && (!pos.IsValid() || p.comments[0].Pos() < pos) {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+		p.separate(c.Pos())
+		p.writeIndent()
+		p.buf.WriteString(c.Text)
+		p.buf.WriteByte('\n')
+		p.lastLine = p.line(c.End() - 1)
+	}
+}
+
+// trailingComments appends the pending comments that start inside the node
+// ending at end, or on the same line, to the current output line.
+func (p *printer) trailingComments(end Pos) {
+	endLine := p.line(end - 1)
+	for len(p.comments) > 0 {
+		c := p.comments[0]
+		if c.Pos() >= end && p.line(c.Pos()) != endLine {
+			break
+		}
+		p.comments = p.comments[1:]
+		p.buf.WriteByte(' ')
+		p.buf.WriteString(c.Text)
+		endLine = p.line(c.End() - 1)
+		if strings.HasPrefix(c.Text, "//") {
+			// nothing else fits on this line
+			break
+		}
+	}
+	p.lastLine = endLine
+}
+
+// inlineComments prints the pending comments that start before pos while in
+// the middle of an expression.
+func (p *printer) inlineComments(pos Pos) {
+	for len(p.comments) > 0 && p.comments[0].Pos() < pos {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+		p.buf.WriteString(c.Text)
+		if strings.HasPrefix(c.Text, "//") {
+			p.buf.WriteByte('\n')
+			p.writeIndent()
+			p.buf.WriteString(indentUnit)
+		} else {
+			p.buf.WriteByte(' ')
+		}
+	}
+}
+
+// closingComments prints the pending comments that start before pos, where
+// a closing bracket or a comma is about to be printed.
+func (p *printer) closingComments(pos Pos) {
+	for len(p.comments) > 0 && p.comments[0].Pos() < pos {
+		c := p.comments[0]
+		p.comments = p.comments[1:]
+		if b := p.buf.Bytes(); len(b) > 0 && b[len(b)-1] != '(' && b[len(b)-1] != ' ' {
+			p.buf.WriteByte(' ')
+		}
+		p.buf.WriteString(c.Text)
+		if strings.HasPrefix(c.Text, "//") {
+			p.buf.WriteByte('\n')
+			p.writeIndent()
+			p.buf.WriteString(indentUnit)
+		}
+	}
+}
+
+// commaAfter finds the comma between two arguments, skipping any comments
+// between them. The AST does not record it.
+func (p *printer) commaAfter(end, next Pos) Pos {
+	if p.file == nil {
+		return next
+	}
+	src := p.file.src
+	for i := int(end) - 1; i < int(next)-1; i++ {
+		skip := -1
+		switch {
+		case src[i] == ',':
+			return Pos(i + 1)
+		case strings.HasPrefix(src[i:], "//"):
+			skip = strings.IndexByte(src[i:], '\n')
+		case strings.HasPrefix(src[i:], "/*"):
+			if skip = strings.Index(src[i:], "*/"); skip >= 0 {
+				skip++
+			}
+		default:
+			continue
+		}
+		if skip < 0 {
+			break
+		}
+		i += skip
+	}
+	return next
+}
+
+func (p *printer) writeIndent() {
+	for i := 0; i < p.indent; i++ {
+		p.buf.WriteString(indentUnit)
+	}
+}
+
+// stmtList prints statements one per line at the current indentation, with
+// their comments.
+func (p *printer) stmtList(list []Stmt) error {
+	for _, s := range list {
+		p.leadingComments(s.Pos())
+		p.separate(s.Pos())
+		p.writeIndent()
+		if err := p.stmt(s); err != nil {
+			return err
+		}
+		p.trailingComments(s.End())
+		p.buf.WriteByte('\n')
+	}
+	return nil
+}
+
+func (p *printer) node(node Node) error {
+	switch n := node.(type) {
+	case *File:
+		if err := p.stmtList(n.Stmts); err != nil {
+			return err
+		}
+		p.leadingComments(NoPos)
+		return nil
+	case Stmt:
+		return p.stmt(n)
+	case Expr:
+		return p.expr(n)
+	}
+	return fmt.Errorf("parser.Fprint: unsupported node type %T", node)
+}
+
+func (p *printer) stmt(s Stmt) error {
+	switch s := s.(type) {
+	case *LetStmt:
+		p.buf.WriteString("let ")
+		p.inlineComments(s.Name.Pos())
+		p.buf.WriteString(s.Name.Name)
+		p.buf.WriteString(" = ")
+		if err := p.expr(s.Value); err != nil {
+			return err
+		}
+	case *ExprStmt:
+		if err := p.expr(s.X); err != nil {
+			return err
+		}
+	case *ReturnStmt:
+		p.buf.WriteString("return")
+		if s.Result != nil {
+			p.buf.WriteByte(' ')
+			if err := p.expr(s.Result); err != nil {
+				return err
+			}
+		}
+	case *SpawnStmt:
+		p.buf.WriteString("spawn ")
+		if err := p.expr(s.Call); err != nil {
+			return err
+		}
+	case *BlockStmt:
+		return p.block(s)
+	case *FuncDecl:
+		p.buf.WriteString("func ")
+		p.inlineComments(s.Name.Pos())
+		p.buf.WriteString(s.Name.Name)
+		p.buf.WriteByte('(')
+		for i, param := range s.Params {
+			if i > 0 {
+				p.buf.WriteString(", ")
+			}
+			p.inlineComments(param.Pos())
+			p.buf.WriteString(param.Name)
+		}
+		p.buf.WriteString(") ")
+		p.inlineComments(s.Body.Pos())
+		return p.block(s.Body)
+	default:
+		return fmt.Errorf("parser.Fprint: unsupported statement type %T", s)
+	}
+	p.buf.WriteByte(';')
+	return nil
+}
+
+// block prints b with its body indented one level. The closing brace is
+// left on the current line so trailing comments can follow it.
+func (p *printer) block(b *BlockStmt) error {
+	if len(b.List) == 0 && (len(p.comments) == 0 || p.comments[0].Pos() > b.Rbrace) {
+		p.buf.WriteString("{}")
+		return nil
+	}
+	p.buf.WriteByte('{')
+	p.trailingComments(b.Lbrace + 1)
+	p.buf.WriteByte('\n')
+	p.indent++
+	if err := p.stmtList(b.List); err != nil {
+		return err
+	}
+	p.leadingComments(b.Rbrace)
+	p.indent--
+	p.writeIndent()
+	p.buf.WriteByte('}')
+	return nil
+}
+
+func (p *printer) expr(e Expr) error {
+	switch e := e.(type) {
+	case *NumberLit:
+		p.inlineComments(e.Pos())
+		p.buf.WriteString(e.Raw)
+	case *StringLit:
+		p.inlineComments(e.Pos())
+		p.buf.WriteString(e.Raw)
+	case *Ident:
+		p.inlineComments(e.Pos())
+		p.buf.WriteString(e.Name)
+	case *BinaryExpr:
+		if err := p.expr(e.X); err != nil {
+			return err
+		}
+		p.buf.WriteByte(' ')
+		p.inlineComments(e.OpPos)
+		fmt.Fprintf(&p.buf, "%v ", e.Op)
+		return p.expr(e.Y)
+	case *UnaryExpr:
+		p.inlineComments(e.Pos())
+		fmt.Fprintf(&p.buf, "%v", e.Op)
+		return p.expr(e.X)
+	case *ParenExpr:
+		p.inlineComments(e.Pos())
+		p.buf.WriteByte('(')
+		if err := p.expr(e.X); err != nil {
+			return err
+		}
+		p.closingComments(e.Rparen)
+		p.buf.WriteByte(')')
+	case *CallExpr:
+		p.inlineComments(e.Pos())
+		p.buf.WriteString(e.Fun.Name)
+		p.buf.WriteByte('(')
+		for i, a := range e.Args {
+			if i > 0 {
+				p.closingComments(p.commaAfter(e.Args[i-1].End(), a.Pos()))
+				p.buf.WriteString(", ")
+			}
+			if err := p.expr(a); err != nil {
+				return err
+			}
+		}
+		p.closingComments(e.Rparen)
+		p.buf.WriteByte(')')
+	default:
+		return fmt.Errorf("parser.Fprint: unsupported expression type %T", e)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+const messySrc = `// header comment
+
+let   x=1 ;   // trailing x
+
+
+/* block
+   comment */
+func add( a,b ){
+  // inside
+  return a+b;   // sum
+}
+let y = add(x, /* two */ 2);
+let z = x /* c */ * y // d
+    + 1;
+spawn   add(y,z)
+print(z)
+`
+
+const canonicalSrc = `// header comment
+
+let x = 1; // trailing x
+
+/* block
+   comment */
+func add(a, b) {
+    // inside
+    return a + b; // sum
+}
+let y = add(x, /* two */ 2);
+let z = x /* c */ * y // d
+    + 1;
+spawn add(y, z);
+print(z);
+`
+
+func format(t *testing.T, src string) string {
+	t.Helper()
+	out, err := Format("t.quark", []byte(src))
+	if err != nil {
+		t.Fatalf("Format: %v\n%s", err, src)
+	}
+	return string(out)
+}
+
+func TestFormat(t *testing.T) {
+	if got := format(t, messySrc); got != canonicalSrc {
+		t.Errorf("Format gave\n%s\nwant\n%s", got, canonicalSrc)
+	}
+}
+
+func TestFormatIdempotent(t *testing.T) {
+	srcs := []string{
+		messySrc,
+		canonicalSrc,
+		"let a = (1 + 2) * ~3 / 4 % 5;\n",
+		"func f() {\n}\n",
+		"func f(n) { return; }\nf(1)\n",
+		"/* only a comment */\n",
+		"let s = \"a\\\"b\"; /* after */ // and again\n",
+		"let v = a << 1 | b >> 2 & c >>> 3 ^ d;\n",
+	}
+	for _, src := range srcs {
+		once := format(t, src)
+		if twice := format(t, once); twice != once {
+			t.Errorf("formatting %q again changed it:\n%s\nthen\n%s", src, once, twice)
+		}
+	}
+}
+
+// Comments must come out next to the code they were written next to, in
+// their original order.
+func TestFormatKeepsComments(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"let x = a /* c */ + b;", "let x = a /* c */ + b;\n"},
+		{"let x = a + /* c */ b;", "let x = a + /* c */ b;\n"},
+		{"let x = /* c */ a + b;", "let x = /* c */ a + b;\n"},
+		{"let x = a // c\n+ b;", "let x = a // c\n    + b;\n"},
+		{"f(/* none */);", "f(/* none */);\n"},
+		{"f(a /* c */, /* d */ b /* e */);", "f(a /* c */, /* d */ b /* e */);\n"},
+		{"let q = (1 + 2 /* in */);", "let q = (1 + 2 /* in */);\n"},
+		{"let x = 1; /* c */", "let x = 1; /* c */\n"},
+		{"// above\nlet x = 1;", "// above\nlet x = 1;\n"},
+		{"func f() {\n    return 1;\n    // last\n}", "func f() {\n    return 1;\n    // last\n}\n"},
+	}
+	for _, tt := range tests {
+		got := format(t, tt.src)
+		if got != tt.want {
+			t.Errorf("Format(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+		if strings.Count(got, "/*")+strings.Count(got, "//") != strings.Count(tt.src, "/*")+strings.Count(tt.src, "//") {
+			t.Errorf("Format(%q) = %q lost or duplicated a comment", tt.src, got)
+		}
+	}
+}
+
+func TestFormatSyntaxError(t *testing.T) {
+	if _, err := Format("t.quark", []byte("let = 1;")); err == nil {
+		t.Error("Format of bad source succeeded")
+	}
+}
@@ -0,0 +1,77 @@
+package parser
+
+import "fmt"
+
+// A Visitor's Visit method is invoked for each node encountered by Walk.
+// If the result visitor w is not nil, Walk visits each of the children of
+// node with w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order.
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+	switch n := node.(type) {
+	case *File:
+		for _, s := range n.Stmts {
+			Walk(v, s)
+		}
+	case *LetStmt:
+		Walk(v, n.Name)
+		Walk(v, n.Value)
+	case *ExprStmt:
+		Walk(v, n.X)
+	case *ReturnStmt:
+		if n.Result != nil {
+			Walk(v, n.Result)
+		}
+	case *SpawnStmt:
+		Walk(v, n.Call)
+	case *BlockStmt:
+		for _, s := range n.List {
+			Walk(v, s)
+		}
+	case *FuncDecl:
+		Walk(v, n.Name)
+		for _, p := range n.Params {
+			Walk(v, p)
+		}
+		Walk(v, n.Body)
+	case *BinaryExpr:
+		Walk(v, n.X)
+		Walk(v, n.Y)
+	case *UnaryExpr:
+		Walk(v, n.X)
+	case *ParenExpr:
+		Walk(v, n.X)
+	case *CallExpr:
+		Walk(v, n.Fun)
+		for _, a := range n.Args {
+			Walk(v, a)
+		}
+	case *NumberLit, *StringLit, *Ident:
+		// leaves
+	default:
+		panic(fmt.Sprintf("parser.Walk: unexpected node type %T", n))
+	}
+	v.Visit(nil)
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order, calling f for each node and
+// descending into its children while f returns true. After the children are
+// done f is called with nil.
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/nate-telecomm/go_ansi"
+	"golang.org/x/term"
+	"quark/parser"
+	"quark/vm"
+)
+
+// Repl implements `quark repl`: an interactive session in which each input
+// is compiled and run as soon as it is complete, see vm.Session.
+func Repl(args []string) {
+	flags := flag.NewFlagSet("repl", flag.ContinueOnError)
+	seed := flags.Int64("seed", 0, "seed for the fiber scheduler; 0 runs fibers round robin")
+	rest, err := parseFlags(flags, args)
+	if err != nil {
+		os.Exit(2)
+	}
+	if len(rest) != 0 {
+		RuntimeError("repl takes no arguments!")
+	}
+	m := vm.NewVM()
+	m.Sched.Seed = *seed
+	r := &repl{s: vm.NewSession(m), out: os.Stdout, color: term.IsTerminal(int(os.Stdout.Fd()))}
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		r.in = &termLines{fd: fd, t: term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}, "")}
+		fmt.Fprintln(r.out, "Quark "+vm.CompilerVersion+", type :help for help.")
+	} else {
+		// the program reads its input from the same buffer, so neither
+		// takes lines meant for the other
+		in := bufio.NewReader(os.Stdin)
+		m.Stdin = in
+		r.in = plainLines{in}
+	}
+	r.loop()
+}
+
+// lineReader reads the REPL's input a line at a time.
+type lineReader interface {
+	readLine(prompt string) (string, error)
+}
+
+// termLines edits lines in the terminal, with the history on the arrow
+// keys. The terminal is only raw while a line is read, so the program
+// runs with its usual input, output and Ctrl-C.
+type termLines struct {
+	fd int
+	t  *term.Terminal
+}
+
+func (l *termLines) readLine(prompt string) (string, error) {
+	old, err := term.MakeRaw(l.fd)
+	if err != nil {
+		return "", err
+	}
+	defer term.Restore(l.fd, old)
+	l.t.SetPrompt(prompt)
+	return l.t.ReadLine()
+}
+
+// plainLines reads piped input, without prompts.
+type plainLines struct {
+	r *bufio.Reader
+}
+
+func (l plainLines) readLine(string) (string, error) {
+	line, err := l.r.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+type repl struct {
+	s       *vm.Session
+	in      lineReader
+	out     io.Writer
+	color   bool     // out is a terminal, so errors are shown in red
+	history []string // inputs run, for :history
+}
+
+const replHelp = `Enter statements or expressions; the value of an expression is printed.
+Input continues on the next line while a bracket or string is open or
+after an operator; an empty line ends it anyway. The final ; may be left out.
+Commands:
+  :load FILE   run a .quark file, or a .gluon or .glue program, in the session
+  :history     list the inputs run so far
+  :help        show this help
+  :quit        leave the REPL (or Ctrl-D)
+Ctrl-C stops a running program.`
+
+func (r *repl) loop() {
+	pending := ""
+	for {
+		prompt := "quark> "
+		if pending != "" {
+			prompt = "  ...> "
+		}
+		line, err := r.in.readLine(prompt)
+		if err != nil {
+			return
+		}
+		if pending == "" && strings.HasPrefix(strings.TrimSpace(line), ":") {
+			if !r.command(strings.TrimSpace(line)) {
+				return
+			}
+			continue
+		}
+		src := pending + line + "\n"
+		if strings.TrimSpace(line) != "" && needsMore(src) {
+			pending = src
+			continue
+		}
+		pending = ""
+		if strings.TrimSpace(src) == "" {
+			continue
+		}
+		r.history = append(r.history, strings.TrimRight(src, "\n"))
+		r.eval(fmt.Sprintf("<repl %d>", len(r.history)), src)
+	}
+}
+
+// command runs a :command and reports whether to carry on.
+func (r *repl) command(line string) bool {
+	cmd, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch cmd {
+	case ":load", ":l":
+		if arg == "" {
+			fmt.Fprintln(r.out, "usage: :load FILE")
+			return true
+		}
+		r.load(arg)
+	case ":history":
+		for i, h := range r.history {
+			fmt.Fprintf(r.out, "%4d  %s\n", i+1, strings.ReplaceAll(h, "\n", "\n      "))
+		}
+	case ":help", ":h":
+		fmt.Fprintln(r.out, replHelp)
+	case ":quit", ":q":
+		return false
+	default:
+		fmt.Fprintf(r.out, "unknown command %s, type :help for the commands\n", cmd)
+	}
+	return true
+}
+
+// needsMore reports whether src stops inside brackets, a string or a
+// comment, or after an operator, so the input goes on on the next line.
+func needsMore(src string) bool {
+	lex := parser.NewLexer(src)
+	depth := 0
+	last := parser.TokEOF
+	for {
+		t := lex.NextToken()
+		switch t.Kind {
+		case parser.TokEOF:
+			return depth > 0 || continues(last)
+		case parser.TokLParen, parser.TokLBrace:
+			depth++
+		case parser.TokRParen, parser.TokRBrace:
+			depth--
+		case parser.TokUnknown:
+			if strings.HasPrefix(t.Value, `"`) || strings.HasPrefix(t.Value, "/*") {
+				return true
+			}
+		}
+		last = t.Kind
+	}
+}
+
+// continues reports whether a line ending in k cannot be complete.
+func continues(k parser.TokenKind) bool {
+	switch k {
+	case parser.TokAssign, parser.TokComma, parser.TokPlus, parser.TokMinus, parser.TokStar, parser.TokSlash,
+		parser.TokPercent, parser.TokAmp, parser.TokPipe, parser.TokCaret, parser.TokTilde,
+		parser.TokShl, parser.TokShr, parser.TokUshr:
+		return true
+	}
+	return false
+}
+
+func (r *repl) eval(name, src string) {
+	f, err := parser.Parse(name, src)
+	if t := strings.TrimSpace(src); err != nil && !strings.HasSuffix(t, ";") && !strings.HasSuffix(t, "}") {
+		// the final ; is optional here
+		if g, err2 := parser.Parse(name, t+";"); err2 == nil {
+			f, err = g, nil
+		}
+	}
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	v, ok, err := r.s.Eval(ctx, f)
+	stop()
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	// null is what print and friends return, not worth showing
+	if ok && v != nil {
+		fmt.Fprintln(r.out, vm.Repr(v))
+	}
+}
+
+// load runs a source file or a compiled program in the session.
+func (r *repl) load(path string) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if strings.HasSuffix(path, ".quark") {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			r.fail(err)
+			return
+		}
+		f, err := parser.Parse(path, string(src))
+		if err == nil {
+			_, _, err = r.s.Eval(ctx, f)
+		}
+		if err != nil {
+			r.fail(err)
+		}
+		return
+	}
+	blob, err := readBlob(path)
+	if err != nil {
+		r.fail(err)
+		return
+	}
+	p, err := vm.DecodeProgram(blob)
+	if err == nil {
+		err = r.s.Load(ctx, path, p)
+	}
+	if err != nil {
+		r.fail(err)
+	}
+}
+
+// fail shows an error and the REPL carries on.
+func (r *repl) fail(err error) {
+	kind := "Error"
+	var arith *vm.ArithmeticError
+	var re *vm.RuntimeError
+	switch {
+	case vm.IsLimitError(err):
+		kind = "LimitError"
+	case errors.As(err, &arith):
+		kind = "ArithmeticError"
+	case errors.As(err, &re):
+		kind = "RuntimeError"
+	case vm.IsBlobError(err):
+		kind = "GluonError"
+	}
+	label := "[" + kind + "]"
+	if r.color {
+		label = ansi.Red + label + ansi.End
+	}
+	fmt.Fprintln(r.out, label+" "+err.Error())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"quark/vm"
+)
+
+func TestNeedsMore(t *testing.T) {
+	tests := []struct {
+		src  string
+		more bool
+	}{
+		{"print(1);", false},
+		{"1 + 2", false},
+		{"let x = 1", false},
+		{"", false},
+		{"// just a comment", false},
+		{"/* closed */ 1", false},
+		{`"a string"`, false},
+		{`"a \" quote"`, false},
+		{"f(x)", false},
+		{"func f() {}", false},
+		{"x)", false}, // unbalanced the other way is a syntax error, not more input
+
+		{"print(1,", true},
+		{"f(", true},
+		{"func f() {", true},
+		{"func f() {\n    print((1", true},
+		{`"open`, true},
+		{`"escaped \"`, true},
+		{"/* open", true},
+		{"let x =", true},
+		{"1 +", true},
+		{"1 -", true},
+		{"1 *", true},
+		{"1 /", true},
+		{"1 %", true},
+		{"1 <<", true},
+		{"1 >>>", true},
+		{"1 &", true},
+		{"1 | // trailing comment", true},
+		{"~", true},
+	}
+	for _, tt := range tests {
+		if got := needsMore(tt.src + "\n"); got != tt.more {
+			t.Errorf("needsMore(%q) = %v, want %v", tt.src, got, tt.more)
+		}
+	}
+}
+
+// runRepl feeds input to a REPL session as if piped and returns what it
+// printed.
+func runRepl(input string, color bool) string {
+	var out bytes.Buffer
+	m := vm.NewVM()
+	m.Stdout = &out
+	r := &repl{s: vm.NewSession(m), in: plainLines{bufio.NewReader(strings.NewReader(input))}, out: &out, color: color}
+	r.loop()
+	return out.String()
+}
+
+// Input that needsMore carries on over lines and runs as one entry; an
+// empty line ends it anyway.
+func TestReplContinuation(t *testing.T) {
+	got := runRepl("let x = (1 +\n2)\nlet s = \"a\nb\"\nx %\n2\nx *\n\n:history\n", false)
+	want := "1\n" +
+		"[Error] <repl 4>:3:1: unexpected EOF\n" +
+		"   1  let x = (1 +\n      2)\n   2  let s = \"a\n      b\"\n   3  x %\n      2\n   4  x *\n"
+	if got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
+
+func TestReplErrorColour(t *testing.T) {
+	for _, color := range []bool{false, true} {
+		got := runRepl("1 / 0\n", color)
+		if !strings.Contains(got, "[ArithmeticError]") {
+			t.Errorf("color %v: output %q has no ArithmeticError", color, got)
+		}
+		if strings.Contains(got, "\x1b[") != color {
+			t.Errorf("color %v: output %q", color, got)
+		}
+	}
+}
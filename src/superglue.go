@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"quark/vm"
+)
+
+// Exit statuses of `quark superglue` when the program is stopped by a
+// limit rather than failing on its own.
+const (
+	ExitStepLimit     = 3
+	ExitTimeout       = 4
+	ExitStackOverflow = 5
+	ExitOutOfMemory   = 6
+	ExitInterrupted   = 130
+)
+
+// Superglue implements `quark superglue [flags] app.gluon|blob.glue` and
+// `quark superglue [flags] --resume snapshot.qsnap`. It reports whether a
+// Gluon was mounted and needs cleaning up.
+func Superglue(args []string) bool {
+	flags := flag.NewFlagSet("superglue", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", 0, "stop the program after this long, e.g. 5s (default: no limit)")
+	maxSteps := flags.Int64("max-steps", 0, "stop the program after this many instructions (default: no limit)")
+	maxDepth := flags.Int("max-depth", vm.DefaultMaxStackDepth, "maximum call depth")
+	seed := flags.Int64("seed", 0, "seed for the fiber scheduler; 0 runs fibers round robin")
+	profile := flags.String("profile", "", "write a pprof profile of the run to this file and print a summary")
+	stdin := flags.String("stdin", "", "read the program's input from this file (default: standard input)")
+	stdout := flags.String("stdout", "", "write the program's output to this file (default: standard output)")
+	snapshot := flags.String("snapshot", "", "when the program is interrupted or stopped by --timeout or --max-steps, save its state to this file")
+	resume := flags.String("resume", "", "carry on from a snapshot instead of starting a Gluon; its scheduler seed replaces --seed")
+	var maxMemory byteSize
+	flags.Var(&maxMemory, "max-memory", "memory the program may use, e.g. 64M (default: no limit)")
+	files, err := parseFlags(flags, args)
+	if err != nil {
+		os.Exit(2)
+	}
+	if *resume != "" {
+		if len(files) != 0 {
+			GluonError("--resume runs the program in the snapshot, don't give a Gluon too!")
+		}
+	} else if len(files) != 1 {
+		GluonError("No Gluon provided!")
+	}
+	mounted := false
+	var data []byte
+	if *resume != "" {
+		data, err = os.ReadFile(*resume)
+		if err != nil {
+			GluonError(err.Error())
+		}
+	} else if strings.HasSuffix(files[0], ".glue") {
+		// a bare blob, e.g. from `quark asm`
+		data, err = os.ReadFile(files[0])
+		if err != nil {
+			GluonError(err.Error())
+		}
+	} else {
+		if !strings.HasSuffix(files[0], ".gluon") {
+			GluonWarning("This file does not have the .gluon extension, it might not be a Gluon")
+		}
+		LoadGluon(files[0])
+		mounted = true
+		data, err = os.ReadFile(filepath.Join("quark--gluon--mount", "source.glue"))
+		CheckError(err)
+	}
+
+	m := vm.NewVM()
+	m.Limits = vm.Limits{MaxSteps: *maxSteps, Timeout: *timeout, MaxStackDepth: *maxDepth, MaxMemory: int64(maxMemory)}
+	m.Sched.Seed = *seed
+	if *profile != "" {
+		m.Profile = vm.NewProfile()
+	}
+	if *resume != "" {
+		err = m.LoadSnapshot(data)
+	} else {
+		err = m.Load(data)
+	}
+	if err != nil {
+		if vm.IsBlobError(err) {
+			GluonError(err.Error())
+		}
+		RuntimeError(err.Error())
+	}
+	closeIO := redirectIO(m, *stdin, *stdout)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err = m.RunContext(ctx)
+	closeIO()
+	if m.Profile != nil {
+		writeProfile(m, *profile)
+	}
+	if err != nil {
+		if *snapshot != "" && resumable(err) {
+			saveSnapshot(m, *snapshot)
+		}
+		if status, ok := limitStatus(err); ok {
+			LimitError(err.Error(), status)
+		}
+		var arith *vm.ArithmeticError
+		if errors.As(err, &arith) {
+			ArithmeticError(err.Error())
+		}
+		RuntimeError(err.Error())
+	}
+	return mounted
+}
+
+// limitStatus is the exit status for a program stopped by a limit, and
+// false for any other error.
+func limitStatus(err error) (int, bool) {
+	switch {
+	case errors.Is(err, vm.ErrStepLimit):
+		return ExitStepLimit, true
+	case errors.Is(err, vm.ErrTimeout):
+		return ExitTimeout, true
+	case errors.Is(err, vm.ErrStackOverflow):
+		return ExitStackOverflow, true
+	case errors.Is(err, vm.ErrOutOfMemory):
+		return ExitOutOfMemory, true
+	case errors.Is(err, vm.ErrCanceled):
+		return ExitInterrupted, true
+	}
+	return 0, false
+}
+
+// resumable reports whether err stopped the program between instructions,
+// so a snapshot of it can carry on.
+func resumable(err error) bool {
+	return errors.Is(err, vm.ErrStepLimit) || errors.Is(err, vm.ErrTimeout) || errors.Is(err, vm.ErrCanceled)
+}
+
+// saveSnapshot writes the stopped program's state for --resume.
+func saveSnapshot(m *vm.VM, path string) {
+	data, err := m.Snapshot()
+	if err == nil {
+		err = os.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		RuntimeWarning("cannot save snapshot: " + err.Error())
+		return
+	}
+	Log("Saved snapshot to " + path + ", resume it with `quark superglue --resume " + path + "`")
+}
+
+// redirectIO points the program's input and output at the named files,
+// where given. The returned function flushes and closes them.
+func redirectIO(m *vm.VM, stdin, stdout string) func() {
+	var in, out *os.File
+	var err error
+	if stdin != "" {
+		if in, err = os.Open(stdin); err != nil {
+			RuntimeError("cannot read input: " + err.Error())
+		}
+		m.Stdin = in
+	}
+	var bw *bufio.Writer
+	if stdout != "" {
+		if out, err = os.Create(stdout); err != nil {
+			RuntimeError("cannot write output: " + err.Error())
+		}
+		bw = bufio.NewWriter(out)
+		m.Stdout = bw
+	}
+	return func() {
+		if in != nil {
+			in.Close()
+		}
+		if out != nil {
+			err := bw.Flush()
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				RuntimeWarning("cannot write output: " + err.Error())
+			}
+		}
+	}
+}
+
+// writeProfile saves the run's profile for `go tool pprof` and prints a
+// summary of it.
+func writeProfile(m *vm.VM, path string) {
+	m.Profile.Stop()
+	f, err := os.Create(path)
+	if err != nil {
+		RuntimeWarning("cannot write profile: " + err.Error())
+		return
+	}
+	err = m.Profile.WritePprof(f, m.Program())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		RuntimeWarning("cannot write profile: " + err.Error())
+		return
+	}
+	m.Profile.WriteSummary(os.Stderr, m.Program(), 10)
+	Log("Profile written to " + path)
+}
+
+// byteSize is a flag value in bytes, with an optional K, M or G suffix
+// (powers of 1024).
+type byteSize int64
+
+func (b *byteSize) String() string { return strconv.FormatInt(int64(*b), 10) }
+
+func (b *byteSize) Set(s string) error {
+	shift := 0
+	num := strings.TrimSuffix(strings.ToUpper(s), "B")
+	switch {
+	case strings.HasSuffix(num, "K"):
+		shift = 10
+	case strings.HasSuffix(num, "M"):
+		shift = 20
+	case strings.HasSuffix(num, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		num = num[:len(num)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return fmt.Errorf("bad size %q", s)
+	}
+	*b = byteSize(n << shift)
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"quark/vm"
+)
+
+func TestLimitStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{vm.ErrStepLimit, ExitStepLimit},
+		{vm.ErrTimeout, ExitTimeout},
+		{vm.ErrStackOverflow, ExitStackOverflow},
+		{vm.ErrOutOfMemory, ExitOutOfMemory},
+		{vm.ErrCanceled, ExitInterrupted},
+	}
+	for _, tt := range tests {
+		// as Run returns them, wrapped with a stack trace
+		err := &vm.RuntimeError{Err: fmt.Errorf("%w after 10 instructions", tt.err)}
+		if status, ok := limitStatus(err); !ok || status != tt.status {
+			t.Errorf("limitStatus(%v) = %d, %v, want %d", tt.err, status, ok, tt.status)
+		}
+	}
+	for _, err := range []error{vm.ErrDeadlock, &vm.ArithmeticError{Msg: "division by zero"}, errors.New("other")} {
+		if status, ok := limitStatus(err); ok {
+			t.Errorf("limitStatus(%v) = %d, want no limit", err, status)
+		}
+	}
+}
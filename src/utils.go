@@ -9,6 +9,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"path/filepath"
+	"flag"
 )
 
 func RandStr(length int) (string, error) {
@@ -61,7 +62,7 @@ func copyDir(source, target string) error {
 			if err != nil { return err }
 		}
 	} else {
-		return fmt.Errorf("no such directory " + source)
+		return fmt.Errorf("no such directory %s", source)
 	}
 	return nil
 }
@@ -71,3 +72,20 @@ func Checksum(data []byte) string {
 	encoded := base64.StdEncoding.EncodeToString(sha[:])
 	return encoded
 }
+
+// parseFlags parses args with fs, allowing flags to appear before or after
+// the positional arguments, and returns the positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
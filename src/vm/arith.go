@@ -0,0 +1,48 @@
+package vm
+
+/* ---------- Integer arithmetic ---------- */
+
+// ArithmeticError is an integer operation with no result, such as a
+// division by zero.
+type ArithmeticError struct {
+	Op  string // mnemonic of the failing instruction
+	Msg string
+}
+
+func (e *ArithmeticError) Error() string { return e.Msg }
+
+// intDiv is DIV and MOD on two ints. DIV only comes here to fail, for a
+// zero divisor, since it is otherwise a true division done in float64. The
+// remainder has the sign of the dividend, as in Go and Java.
+func intDiv(op byte, a, b int64) (int64, error) {
+	if b == 0 {
+		if op == OpMod {
+			return 0, &ArithmeticError{Op: OpName(op), Msg: "integer modulo by zero"}
+		}
+		return 0, &ArithmeticError{Op: OpName(op), Msg: "integer division by zero"}
+	}
+	if op == OpMod {
+		return a % b, nil
+	}
+	return a / b, nil
+}
+
+// bitwise is BIT_AND, BIT_OR, BIT_XOR and the shifts. As in Java, only the
+// low six bits of a shift count are used, so shifting by 64 is shifting by
+// 0 and a negative count never panics.
+func bitwise(op byte, a, b int64) int64 {
+	n := uint64(b) & 63
+	switch op {
+	case OpBitAnd:
+		return a & b
+	case OpBitOr:
+		return a | b
+	case OpBitXor:
+		return a ^ b
+	case OpShl:
+		return a << n
+	case OpShr:
+		return a >> n
+	}
+	return int64(uint64(a) >> n)
+}
@@ -0,0 +1,92 @@
+package vm
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+// evalSrc runs print(expr) and returns what it printed, or the error.
+func evalSrc(t *testing.T, expr string) (string, error) {
+	t.Helper()
+	p, err := Link([]Object{compileObject(t, "t.quark", "print("+expr+");\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	m := NewVM()
+	m.Stdout = &out
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatal(err)
+	}
+	err = m.Run()
+	return strings.TrimSuffix(out.String(), "\n"), err
+}
+
+func TestOperators(t *testing.T) {
+	tests := []struct{ expr, want string }{
+		{"7 / 2", "3.5"},
+		{"6 / 3", "2"},
+		{"(0 - 7) / 2", "-3.5"},
+		{"7 / 2 / 0", "+Inf"},
+		{"7 % 3", "1"},
+		{"(0 - 7) % 3", "-1"},
+		{"7 % (0 - 3)", "1"},
+		{"12 & 10", "8"},
+		{"12 | 10", "14"},
+		{"12 ^ 10", "6"},
+		{"~5", "-6"},
+		{"~(0 - 1)", "0"},
+		{"1 << 3", "8"},
+		{"1 << 63", "-9223372036854775808"},
+		{"(0 - 16) >> 2", "-4"},
+		{"(0 - 16) >>> 60", "15"},
+		{"1 << 2 + 1", "8"},
+		{"1 | 6 & 3", "3"},
+		// only the low six bits of the count are used
+		{"1 << 64", "1"},
+		{"1 << 65", "2"},
+		{"1 << (0 - 1)", "-9223372036854775808"},
+		{"(0 - 1) >>> 64", "-1"},
+	}
+	for _, tt := range tests {
+		got, err := evalSrc(t, tt.expr)
+		if err != nil || got != tt.want {
+			t.Errorf("%s = %s, %v, want %s", tt.expr, got, err, tt.want)
+		}
+	}
+}
+
+func TestOperatorErrors(t *testing.T) {
+	tests := []struct {
+		expr, want string
+		arith      bool
+	}{
+		{"1 / 0", "integer division by zero", true},
+		{"(0 - 1) / 0", "integer division by zero", true},
+		{"1 % 0", "integer modulo by zero", true},
+		{"\"a\" & 1", "unsupported operand types for BIT_AND: string and int", false},
+		{"1 << \"a\"", "unsupported operand types for SHL: int and string", false},
+		{"~\"a\"", "unsupported operand type for BIT_NOT: string", false},
+		{"\"a\" / 2", "unsupported operand types for DIV: string and int", false},
+	}
+	for _, tt := range tests {
+		_, err := evalSrc(t, tt.expr)
+		var ae *ArithmeticError
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) || errors.As(err, &ae) != tt.arith {
+			t.Errorf("%s: got %v, want %q (arithmetic error %v)", tt.expr, err, tt.want, tt.arith)
+		}
+	}
+}
+
+func TestIntDiv(t *testing.T) {
+	if v, err := intDiv(OpMod, math.MinInt64, -1); err != nil || v != 0 {
+		t.Errorf("MinInt64 %% -1 = %d, %v", v, err)
+	}
+	_, err := intDiv(OpDiv, 1, 0)
+	var ae *ArithmeticError
+	if !errors.As(err, &ae) || ae.Op != "DIV" {
+		t.Errorf("1 / 0: got %v, want an ArithmeticError from DIV", err)
+	}
+}
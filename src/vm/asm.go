@@ -0,0 +1,541 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/* ---------- Assembler ---------- */
+
+// Assembly syntax, one item per line, ; starts a comment:
+//
+//	.flags executable    flags for the blob; without .flags it is executable
+//	.globals 2           global slots; by default one past the highest used
+//	.builtin print       imports a builtin; CALL_BUILTIN operands index the imports
+//	.const               following lines are constants, in pool order
+//	    greeting: "hi"   a constant may be named for use as an operand
+//	    4
+//	.code                following lines are instructions
+//	.module main.quark   starts a module initialiser code object
+//	0003:                address markers (as printed by the disassembler) are skipped
+//	loop:                labels name the address of the next instruction
+//	    LOAD_CONST greeting
+//	    JUMP loop
+//	    .byte 255        raw byte
+//	    WIDE JUMP far    forces u32 operands; added anyway when one needs it
+//	.func add 2 3        starts a function with 2 parameters and 3 locals
+//	.local 0 x           names local slot 0 of the current code object
+//	.global 0 total      names global slot 0
+//	.line main.quark 12  the following code comes from line 12 of main.quark
+//
+// Mnemonics are the opcode names from the Op* constants (see OpByName).
+// Operands are integers, labels for jump targets, constant names, function
+// names for CALL, or builtin names for CALL_BUILTIN (imported on first use
+// if no .builtin line did). Code before the first .module or .func belongs
+// to an implicit "<main>" initialiser. Each code object's max stack and
+// constant list are computed from its code.
+//
+// The disassembler's listing of a linked program assembles back to the same
+// blob, names and line table included. An object's symbol and relocation
+// tables are not written in the listing, and neither are prototype
+// constants, so those do not round trip.
+
+// AsmError is an assembly error on a given line.
+type AsmError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *AsmError) Error() string { return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg) }
+
+type asmFixup struct {
+	at    int // offset of the operand in code
+	wide  bool
+	kind  OperandKind
+	label string // label, or function name for OperandFunc
+	line  int
+}
+
+type assembler struct {
+	file      string
+	line      int
+	prog      Program
+	globals   int // from .globals, or -1
+	labels    map[string]int
+	constName map[string]int
+	fixups    []asmFixup
+}
+
+// Assemble translates assembly source into a program.
+func Assemble(filename string, src string) (*Program, error) {
+	a := &assembler{
+		file:      filename,
+		prog:      Program{Flags: FlagExecutable, Code: []byte{}},
+		globals:   -1,
+		labels:    map[string]int{},
+		constName: map[string]int{},
+	}
+	section := ""
+	for i, raw := range strings.Split(src, "\n") {
+		a.line = i + 1
+		fields, err := splitAsmLine(raw)
+		if err != nil {
+			return nil, a.errorf("%v", err)
+		}
+		// address markers and labels
+		for len(fields) > 0 && strings.HasSuffix(fields[0], ":") && !strings.ContainsAny(fields[0][:1], "\"'") {
+			name := strings.TrimSuffix(fields[0], ":")
+			fields = fields[1:]
+			if isDigits(name) {
+				continue
+			}
+			if !isIdent(name) {
+				return nil, a.errorf("bad label %q", name)
+			}
+			if section == ".const" {
+				if _, dup := a.constName[name]; dup {
+					return nil, a.errorf("constant %s defined twice", name)
+				}
+				a.constName[name] = len(a.prog.Consts)
+				continue
+			}
+			if _, dup := a.labels[name]; dup {
+				return nil, a.errorf("label %s defined twice", name)
+			}
+			a.labels[name] = len(a.prog.Code)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case ".flags":
+			a.prog.Flags = 0
+			for _, f := range fields[1:] {
+				switch f {
+				case "executable":
+					a.prog.Flags |= FlagExecutable
+				default:
+					return nil, a.errorf("unknown flag %s", f)
+				}
+			}
+			continue
+		case ".globals":
+			n, err := strconv.ParseUint(strings.Join(fields[1:], " "), 10, 32)
+			if err != nil {
+				return nil, a.errorf("bad .globals %s", strings.Join(fields[1:], " "))
+			}
+			a.globals = int(n)
+			continue
+		case ".builtin":
+			if len(fields) != 2 || !isIdent(fields[1]) {
+				return nil, a.errorf("expected .builtin NAME")
+			}
+			if _, dup := a.builtinIndex(fields[1]); dup {
+				return nil, a.errorf("builtin %s imported twice", fields[1])
+			}
+			continue
+		case ".global":
+			if err := a.nameDirective(fields, &a.prog.GlobalNames, -1); err != nil {
+				return nil, err
+			}
+			continue
+		case ".local":
+			if section != ".code" || len(a.prog.Funcs) == 0 {
+				return nil, a.errorf(".local outside a code object")
+			}
+			co := &a.prog.Funcs[len(a.prog.Funcs)-1]
+			if err := a.nameDirective(fields, &co.Locals, co.NumLocals); err != nil {
+				return nil, err
+			}
+			continue
+		case ".const", ".code":
+			section = fields[0]
+			continue
+		case ".line":
+			if section != ".code" {
+				return nil, a.errorf(".line outside .code")
+			}
+			if err := a.lineDirective(fields); err != nil {
+				return nil, err
+			}
+			continue
+		case ".module", ".func":
+			if section != ".code" {
+				return nil, a.errorf("%s outside .code", fields[0])
+			}
+			if err := a.codeObject(fields); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		switch section {
+		case ".const":
+			c, err := ParseConst(fields[0])
+			if err == nil && len(fields) != 1 {
+				err = fmt.Errorf("expected one constant per line")
+			}
+			if err != nil {
+				return nil, a.errorf("%v", err)
+			}
+			a.prog.Consts = append(a.prog.Consts, c)
+		case ".code":
+			if err := a.instr(fields); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, a.errorf("expected .const or .code before %s", fields[0])
+		}
+	}
+	a.endCodeObject()
+	if len(a.prog.Funcs) == 0 {
+		a.prog.Funcs = []CodeObject{{Name: "<main>", Kind: CodeModule}}
+	}
+	funcs := map[string]int{}
+	for i, co := range a.prog.Funcs {
+		if _, dup := funcs[co.Name]; dup {
+			funcs[co.Name] = -1
+		} else {
+			funcs[co.Name] = i
+		}
+	}
+	for _, f := range a.fixups {
+		a.line = f.line
+		var addr int
+		var ok bool
+		if f.kind == OperandFunc {
+			addr, ok = funcs[f.label]
+			if !ok {
+				return nil, a.errorf("undefined function %s", f.label)
+			}
+			if addr < 0 {
+				return nil, a.errorf("more than one code object is called %s, call it by index", f.label)
+			}
+		} else if addr, ok = a.labels[f.label]; !ok {
+			return nil, a.errorf("undefined label %s", f.label)
+		}
+		if f.wide {
+			binary.LittleEndian.PutUint32(a.prog.Code[f.at:], uint32(addr))
+			continue
+		}
+		if addr > math.MaxUint16 {
+			return nil, a.errorf("%s is %d, out of u16 range, use WIDE", f.label, addr)
+		}
+		binary.LittleEndian.PutUint16(a.prog.Code[f.at:], uint16(addr))
+	}
+	if a.globals >= 0 {
+		a.prog.Globals = a.globals
+	} else {
+		a.prog.Globals = max(globalsUsed(a.prog.Code), len(a.prog.GlobalNames))
+	}
+	if len(a.prog.GlobalNames) > a.prog.Globals {
+		return nil, a.errorf("global %d is named but there are %d globals", len(a.prog.GlobalNames)-1, a.prog.Globals)
+	}
+	fillCodeInfo(&a.prog)
+	return &a.prog, nil
+}
+
+// builtinIndex returns the import index of a builtin, importing it if
+// needed, and whether it was already imported.
+func (a *assembler) builtinIndex(name string) (int, bool) {
+	for i, b := range a.prog.Builtins {
+		if b == name {
+			return i, true
+		}
+	}
+	a.prog.Builtins = append(a.prog.Builtins, name)
+	return len(a.prog.Builtins) - 1, false
+}
+
+// codeObject handles .module NAME and .func NAME ARITY LOCALS.
+func (a *assembler) codeObject(fields []string) error {
+	if fields[0] == ".module" && len(fields) != 2 {
+		return a.errorf("expected .module NAME")
+	}
+	if fields[0] == ".func" && len(fields) != 4 {
+		return a.errorf("expected .func NAME ARITY LOCALS")
+	}
+	name := fields[1]
+	if strings.HasPrefix(name, "\"") {
+		var err error
+		if name, err = strconv.Unquote(name); err != nil {
+			return a.errorf("bad name %s", fields[1])
+		}
+	}
+	a.endCodeObject()
+	co := CodeObject{Name: name, Kind: CodeModule, Entry: len(a.prog.Code)}
+	if fields[0] == ".func" {
+		arity, err1 := strconv.ParseUint(fields[2], 10, 8)
+		nlocals, err2 := strconv.ParseUint(fields[3], 10, 32)
+		if err1 != nil || err2 != nil || arity > nlocals {
+			return a.errorf("bad arity or local count for %s", name)
+		}
+		co.Kind, co.Arity, co.NumLocals = CodeFunc, int(arity), int(nlocals)
+	}
+	a.prog.Funcs = append(a.prog.Funcs, co)
+	return nil
+}
+
+// nameDirective handles .global SLOT NAME and .local SLOT NAME, naming
+// slot in names. limit is the number of slots, or -1 if not known yet.
+func (a *assembler) nameDirective(fields []string, names *[]string, limit int) error {
+	if len(fields) != 3 {
+		return a.errorf("expected %s SLOT NAME", fields[0])
+	}
+	slot, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil || limit >= 0 && int(slot) >= limit {
+		return a.errorf("bad slot %s", fields[1])
+	}
+	name := fields[2]
+	if strings.HasPrefix(name, "\"") {
+		if name, err = strconv.Unquote(name); err != nil {
+			return a.errorf("bad name %s", fields[2])
+		}
+	}
+	for len(*names) <= int(slot) {
+		*names = append(*names, "")
+	}
+	(*names)[slot] = name
+	return nil
+}
+
+// lineDirective handles .line FILE LINE.
+func (a *assembler) lineDirective(fields []string) error {
+	if len(fields) != 3 {
+		return a.errorf("expected .line FILE LINE")
+	}
+	file := fields[1]
+	if strings.HasPrefix(file, "\"") {
+		var err error
+		if file, err = strconv.Unquote(file); err != nil {
+			return a.errorf("bad file name %s", fields[1])
+		}
+	}
+	line, err := strconv.ParseUint(fields[2], 10, 31)
+	if err != nil {
+		return a.errorf("bad line %s", fields[2])
+	}
+	a.prog.Lines = appendLine(a.prog.Lines, len(a.prog.Code), file, int(line))
+	return nil
+}
+
+// endCodeObject ends the current code object at the current address.
+func (a *assembler) endCodeObject() {
+	if n := len(a.prog.Funcs); n > 0 {
+		co := &a.prog.Funcs[n-1]
+		co.Size = len(a.prog.Code) - co.Entry
+	}
+}
+
+// globalsUsed is one past the highest global slot code touches.
+func globalsUsed(code []byte) int {
+	n := 0
+	for addr := 0; addr < len(code); {
+		in, err := DecodeInstr(code, addr)
+		if err != nil {
+			break
+		}
+		for i, k := range opInfo[in.Op].Operands {
+			if k == OperandGlobal {
+				n = max(n, in.Args[i]+1)
+			}
+		}
+		addr += in.Size
+	}
+	return n
+}
+
+// AssembleToBlob assembles src and encodes the result.
+func AssembleToBlob(filename string, src string) ([]byte, error) {
+	p, err := Assemble(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeProgram(p)
+}
+
+func (a *assembler) errorf(format string, args ...interface{}) error {
+	return &AsmError{File: a.file, Line: a.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (a *assembler) instr(fields []string) error {
+	if len(a.prog.Funcs) == 0 {
+		a.prog.Funcs = []CodeObject{{Name: "<main>", Kind: CodeModule}}
+	}
+	if fields[0] == ".byte" {
+		for _, f := range fields[1:] {
+			n, err := strconv.ParseUint(f, 0, 8)
+			if err != nil {
+				return a.errorf("bad byte %s", f)
+			}
+			a.prog.Code = append(a.prog.Code, byte(n))
+		}
+		return nil
+	}
+	wide := strings.EqualFold(fields[0], "wide")
+	if wide {
+		fields = fields[1:]
+		if len(fields) == 0 {
+			return a.errorf("WIDE needs an instruction")
+		}
+	}
+	op, ok := OpByName(fields[0])
+	if !ok || op == OpWide {
+		return a.errorf("unknown instruction %s", fields[0])
+	}
+	info := opInfo[op]
+	operands := fields[1:]
+	if len(operands) != len(info.Operands) {
+		return a.errorf("%s takes %d operand(s), got %d", info.Name, len(info.Operands), len(operands))
+	}
+	args := make([]int, len(operands))
+	labelArgs := map[int]string{} // operand number -> label
+	for i, k := range info.Operands {
+		s := operands[i]
+		n, err := strconv.ParseInt(s, 0, 64)
+		switch {
+		case err == nil:
+			args[i] = int(n)
+		case (k == OperandAddr || k == OperandFunc) && isIdent(s):
+			labelArgs[i] = s
+		case k == OperandBuiltin && isIdent(s):
+			args[i], _ = a.builtinIndex(s)
+		case k == OperandConst && isIdent(s):
+			idx, ok := a.constName[s]
+			if !ok {
+				return a.errorf("undefined constant %s", s)
+			}
+			args[i] = idx
+		default:
+			return a.errorf("bad operand %s for %s", s, info.Name)
+		}
+	}
+	var code []byte
+	var err error
+	if wide {
+		code, err = EncodeWideInstr(a.prog.Code, op, args...)
+	} else {
+		code, err = EncodeInstr(a.prog.Code, op, args...)
+	}
+	if err != nil {
+		return a.errorf("%v", err)
+	}
+	in, err := DecodeInstr(code, len(a.prog.Code))
+	if err != nil {
+		return a.errorf("%v", err)
+	}
+	offs := in.OperandOffsets()
+	for i, label := range labelArgs {
+		a.fixups = append(a.fixups, asmFixup{at: offs[i], wide: in.Wide, kind: info.Operands[i], label: label, line: a.line})
+	}
+	a.prog.Code = code
+	return nil
+}
+
+// splitAsmLine splits a line into whitespace or comma separated fields,
+// dropping ; comments and keeping quoted literals whole.
+func splitAsmLine(line string) ([]string, error) {
+	var fields []string
+	i := 0
+	for i < len(line) {
+		c := line[i]
+		switch {
+		case c == ';':
+			return fields, nil
+		case c == ' ' || c == '\t' || c == ',' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(line) && line[j] != c {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unterminated literal")
+			}
+			fields = append(fields, line[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(line) && !strings.ContainsRune(" \t,;\r", rune(line[j])) {
+				j++
+			}
+			fields = append(fields, line[i:j])
+			i = j
+		}
+	}
+	return fields, nil
+}
+
+// ParseConst parses a constant written in assembler literal syntax, the
+// inverse of FormatConst.
+func ParseConst(s string) (interface{}, error) {
+	switch s {
+	case "null":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "nan":
+		return math.NaN(), nil
+	case "+inf", "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	}
+	switch s[0] {
+	case '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad string literal %s", s)
+		}
+		return v, nil
+	case '\'':
+		v, err := strconv.Unquote(s)
+		if err != nil || len([]rune(v)) != 1 {
+			return nil, fmt.Errorf("bad char literal %s", s)
+		}
+		return Char([]rune(v)[0]), nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	if strings.HasPrefix(s, "func") || strings.HasPrefix(s, "class") {
+		return nil, fmt.Errorf("prototype constants cannot be written in assembly")
+	}
+	return nil, fmt.Errorf("bad constant %s", s)
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isIdent(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if !(unicode.IsLetter(r) || r == '_' || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package vm
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+// A linked program's listing assembles back to the same blob, names and
+// line table included.
+func TestDisasmAsmRoundTrip(t *testing.T) {
+	srcs := []string{
+		"print(1);\n",
+		`let x = 1;
+let s = "str";
+func f(a, b) { let c = a % b; return c * x; }
+func g() { return f(9, 4); }
+spawn g();
+print(f(7, 3), s, x, g());
+`,
+	}
+	for _, src := range srcs {
+		p, err := Link([]Object{compileObject(t, "t.quark", src)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob, err := EncodeProgram(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listing := disassemble(t, p)
+		again, err := AssembleToBlob("t.qasm", listing)
+		if err != nil {
+			t.Fatalf("assembling the listing of %q: %v\n%s", src, err, listing)
+		}
+		if !bytes.Equal(again, blob) {
+			q, _ := DecodeProgram(again)
+			t.Errorf("the listing of %q reassembles to a different blob:\n%s\nreassembled:\n%s", src, listing, disassemble(t, q))
+		}
+	}
+}
+
+func TestAssembleNames(t *testing.T) {
+	p := assemble(t, `
+.globals 3
+.global 0 total
+.global 2 "odd name"
+.code
+    HALT
+.func f 1 2
+.local 0 n
+.local 1 acc
+    LOAD_LOCAL 0
+    RETURN
+`)
+	if got := p.GlobalNames; len(got) != 3 || got[0] != "total" || got[1] != "" || got[2] != "odd name" {
+		t.Errorf("global names %q", got)
+	}
+	if got := p.Funcs[1].Locals; len(got) != 2 || got[0] != "n" || got[1] != "acc" {
+		t.Errorf("locals of f %q", got)
+	}
+	wantLines(t, disassemble(t, p), `.global 2 "odd name"`, ".local 1 acc")
+}
+
+// The assembler writes what it is given, unverified, so hand written
+// bytecode can exercise the verifier; only the syntax is checked here.
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"unknown instruction", ".code\n    FROB\n", "t.qasm:2: unknown instruction FROB"},
+		{"operand count", ".code\n    LOAD_CONST\n", "LOAD_CONST takes 1 operand(s), got 0"},
+		{"undefined label", ".code\n    JUMP nowhere\n", "undefined label nowhere"},
+		{"label twice", ".code\na:\na:\n    HALT\n", "label a defined twice"},
+		{"undefined constant", ".code\n    LOAD_CONST c\n", "undefined constant c"},
+		{"undefined function", ".code\n    CALL f 0\n", "undefined function f"},
+		{"far label without WIDE", ".code\n    JUMP far\n    .byte " + strings.Repeat("0 ", 70000) + "\nfar:\n    HALT\n", "out of u16 range, use WIDE"},
+		{"code before a section", "    HALT\n", "expected .const or .code before HALT"},
+		{"bad constant", ".const\n    1x\n", "bad constant 1x"},
+		{"prototype constant", ".const\n    func\n", "prototype constants cannot be written in assembly"},
+		{"unterminated string", ".const\n    \"abc\n", "unterminated literal"},
+		{"bad flag", ".flags fast\n", "unknown flag fast"},
+		{"bad .func", ".code\n.func f 3 2\n", "bad arity or local count for f"},
+		{"local outside a code object", ".local 0 x\n", ".local outside a code object"},
+		{"local past the frame", ".code\n.func f 0 1\n.local 1 x\n    RETURN\n", "bad slot 1"},
+		{"named global past .globals", ".globals 1\n.global 1 x\n.code\n    HALT\n", "global 1 is named but there are 1 globals"},
+	}
+	for _, tt := range tests {
+		_, err := Assemble("t.qasm", tt.src)
+		if err == nil {
+			t.Errorf("%s: assembled", tt.name)
+			continue
+		}
+		if _, ok := err.(*AsmError); !ok || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an AsmError containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// ParseConst reads back everything FormatConst writes, except prototypes.
+func TestParseConstRoundTrip(t *testing.T) {
+	for _, c := range []interface{}{nil, true, false, int64(0), int64(math.MinInt64), 0.5, 3.0, -1e-300,
+		math.Inf(1), math.Inf(-1), "", "tab\there \"q\"", Char('x'), Char('\n')} {
+		got, err := ParseConst(FormatConst(c))
+		if err != nil {
+			t.Errorf("ParseConst(%s): %v", FormatConst(c), err)
+			continue
+		}
+		if !sameConst(got, c) {
+			t.Errorf("ParseConst(%s) = %#v, want %#v", FormatConst(c), got, c)
+		}
+	}
+	if got, err := ParseConst("nan"); err != nil || !math.IsNaN(got.(float64)) {
+		t.Errorf("ParseConst(nan) = %v, %v", got, err)
+	}
+}
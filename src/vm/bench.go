@@ -0,0 +1,148 @@
+package vm
+
+/* ---------- Benchmark programs ---------- */
+
+// Benchmark is a program for measuring the interpreter, see `quark bench`
+// and BenchmarkInterpreter. They are written in assembly because the
+// language has no loops yet.
+type Benchmark struct {
+	Name string
+	Desc string
+	Asm  string
+}
+
+// Program assembles the benchmark.
+func (b Benchmark) Program() (*Program, error) {
+	return Assemble(b.Name+".qasm", b.Asm)
+}
+
+// Benchmarks are the standard interpreter benchmarks.
+var Benchmarks = []Benchmark{
+	{"arith-globals", "integer arithmetic loop on globals", `
+.const
+    n: 100000
+    zero: 0
+    one: 1
+    three: 3
+.code
+    LOAD_CONST n
+    STORE_GLOBAL 0
+    LOAD_CONST zero
+    STORE_GLOBAL 1
+loop:
+    LOAD_GLOBAL 0
+    JUMP_IF_FALSE done
+    LOAD_GLOBAL 1
+    LOAD_GLOBAL 0
+    LOAD_CONST three
+    MUL
+    ADD
+    LOAD_CONST one
+    SUB
+    STORE_GLOBAL 1
+    LOAD_GLOBAL 0
+    LOAD_CONST one
+    SUB
+    STORE_GLOBAL 0
+    JUMP loop
+done:
+    HALT
+`},
+	{"arith-locals", "integer arithmetic loop on locals", `
+.const
+    n: 100000
+    zero: 0
+    one: 1
+    three: 3
+.code
+    LOAD_CONST n
+    CALL sum 1
+    STORE_GLOBAL 0
+    HALT
+.func sum 1 2
+    LOAD_CONST zero
+    STORE_LOCAL 1
+loop:
+    LOAD_LOCAL 0
+    JUMP_IF_FALSE done
+    LOAD_LOCAL 1
+    LOAD_LOCAL 0
+    LOAD_CONST three
+    MUL
+    ADD
+    LOAD_CONST one
+    SUB
+    STORE_LOCAL 1
+    LOAD_LOCAL 0
+    LOAD_CONST one
+    SUB
+    STORE_LOCAL 0
+    JUMP loop
+done:
+    LOAD_LOCAL 1
+    RETURN
+`},
+	{"float-locals", "float arithmetic loop on locals", `
+.const
+    n: 100000
+    zero: 0.0
+    one: 1
+    half: 0.5
+.code
+    LOAD_CONST n
+    CALL sum 1
+    STORE_GLOBAL 0
+    HALT
+.func sum 1 2
+    LOAD_CONST zero
+    STORE_LOCAL 1
+loop:
+    LOAD_LOCAL 0
+    JUMP_IF_FALSE done
+    LOAD_LOCAL 1
+    LOAD_LOCAL 0
+    LOAD_CONST half
+    MUL
+    ADD
+    STORE_LOCAL 1
+    LOAD_LOCAL 0
+    LOAD_CONST one
+    SUB
+    STORE_LOCAL 0
+    JUMP loop
+done:
+    LOAD_LOCAL 1
+    RETURN
+`},
+	{"calls", "loop calling a two argument function", `
+.const
+    n: 100000
+    one: 1
+.code
+    LOAD_CONST n
+    CALL loop 1
+    STORE_GLOBAL 0
+    HALT
+.func add 2 2
+    LOAD_LOCAL 0
+    LOAD_LOCAL 1
+    ADD
+    RETURN
+.func loop 1 1
+again:
+    LOAD_LOCAL 0
+    JUMP_IF_FALSE done
+    LOAD_LOCAL 0
+    LOAD_CONST one
+    CALL add 2
+    LOAD_CONST one
+    SUB
+    LOAD_CONST one
+    SUB
+    STORE_LOCAL 0
+    JUMP again
+done:
+    LOAD_LOCAL 0
+    RETURN
+`},
+}
@@ -0,0 +1,33 @@
+package vm
+
+import (
+	"io"
+	"testing"
+)
+
+// BenchmarkInterpreter runs each of the standard benchmark programs, see
+// Benchmarks; `quark bench` runs the same ones from the command line.
+func BenchmarkInterpreter(b *testing.B) {
+	for _, bench := range Benchmarks {
+		prog, err := bench.Program()
+		if err != nil {
+			b.Fatalf("%s: %v", bench.Name, err)
+		}
+		b.Run(bench.Name, func(b *testing.B) {
+			b.ReportAllocs()
+			var steps int64
+			for i := 0; i < b.N; i++ {
+				m := NewVM()
+				m.Stdout = io.Discard
+				if err := m.LoadProgram(prog); err != nil {
+					b.Fatal(err)
+				}
+				if err := m.Run(); err != nil {
+					b.Fatal(err)
+				}
+				steps = m.Steps()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(int64(b.N)*steps), "ns/instruction")
+		})
+	}
+}
@@ -0,0 +1,413 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+/* ---------- Blob container ---------- */
+
+// A blob is a small container of sections. All integers are little endian.
+//
+//	magic    [4]byte  0x7f 'Q' 'R' 'K'
+//	version  u16      FormatVersion
+//	flags    u16      Flag* bits
+//	nsect    u16      number of section table entries
+//	reserved u16
+//	table    nsect * { id u16, reserved u16, offset u32, length u32, crc32 u32 }
+//	payload  section data, offsets are from the start of the blob
+//
+// Readers skip sections they do not know, so new optional sections can be
+// added without a version bump. Anything that changes the meaning of
+// existing sections must bump FormatVersion.
+
+var Magic = [4]byte{0x7f, 'Q', 'R', 'K'}
+
+const FormatVersion uint16 = 5
+
+const (
+	// FlagExecutable marks a linked program that ends in OpHalt and can be
+	// run directly. Blobs without it are per-file objects for the linker.
+	FlagExecutable uint16 = 1 << iota
+
+	knownFlags = FlagExecutable
+)
+
+type SectionID uint16
+
+const (
+	SectionConsts SectionID = 1 + iota
+	SectionCode
+	SectionSymbols  // objects only
+	SectionRelocs   // objects only
+	SectionFuncs    // code object table
+	SectionBuiltins // builtin import table
+	SectionLines    // address -> source line table, optional
+	SectionNames    // variable name table, optional
+)
+
+const (
+	headerSize = 12
+	entrySize  = 16
+)
+
+var (
+	ErrNotBytecode = errors.New("not a Quark bytecode blob")
+	ErrVersion     = errors.New("unsupported bytecode version")
+	ErrCorrupt     = errors.New("corrupt bytecode blob")
+)
+
+type section struct {
+	id   SectionID
+	data []byte
+}
+
+func encodeContainer(flags uint16, sections []section) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.Write(Magic[:])
+	binary.Write(buf, binary.LittleEndian, FormatVersion)
+	binary.Write(buf, binary.LittleEndian, flags)
+	binary.Write(buf, binary.LittleEndian, uint16(len(sections)))
+	binary.Write(buf, binary.LittleEndian, uint16(0))
+	offset := uint32(headerSize + entrySize*len(sections))
+	for _, s := range sections {
+		binary.Write(buf, binary.LittleEndian, uint16(s.id))
+		binary.Write(buf, binary.LittleEndian, uint16(0))
+		binary.Write(buf, binary.LittleEndian, offset)
+		binary.Write(buf, binary.LittleEndian, uint32(len(s.data)))
+		binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(s.data))
+		offset += uint32(len(s.data))
+	}
+	for _, s := range sections {
+		buf.Write(s.data)
+	}
+	return buf.Bytes()
+}
+
+func decodeContainer(blob []byte) (uint16, map[SectionID][]byte, error) {
+	if len(blob) < len(Magic) || !bytes.Equal(blob[:len(Magic)], Magic[:]) {
+		return 0, nil, fmt.Errorf("%w: bad magic number (blobs from before the versioned format must be rebuilt)", ErrNotBytecode)
+	}
+	if len(blob) < headerSize {
+		return 0, nil, fmt.Errorf("%w: truncated header", ErrCorrupt)
+	}
+	version := binary.LittleEndian.Uint16(blob[4:6])
+	if version != FormatVersion {
+		return 0, nil, fmt.Errorf("%w: blob is format version %d, this VM reads version %d; rebuild it with `quark glue`",
+			ErrVersion, version, FormatVersion)
+	}
+	flags := binary.LittleEndian.Uint16(blob[6:8])
+	if flags&^knownFlags != 0 {
+		return 0, nil, fmt.Errorf("%w: unknown flags %#04x", ErrVersion, flags&^knownFlags)
+	}
+	n := int(binary.LittleEndian.Uint16(blob[8:10]))
+	if len(blob) < headerSize+n*entrySize {
+		return 0, nil, fmt.Errorf("%w: truncated section table", ErrCorrupt)
+	}
+	sections := make(map[SectionID][]byte, n)
+	for i := 0; i < n; i++ {
+		e := blob[headerSize+i*entrySize:]
+		id := SectionID(binary.LittleEndian.Uint16(e[0:2]))
+		off := uint64(binary.LittleEndian.Uint32(e[4:8]))
+		ln := uint64(binary.LittleEndian.Uint32(e[8:12]))
+		sum := binary.LittleEndian.Uint32(e[12:16])
+		if off+ln > uint64(len(blob)) {
+			return 0, nil, fmt.Errorf("%w: section %d out of bounds", ErrCorrupt, id)
+		}
+		data := blob[off : off+ln]
+		if crc32.ChecksumIEEE(data) != sum {
+			return 0, nil, fmt.Errorf("%w: checksum mismatch in section %d", ErrCorrupt, id)
+		}
+		if _, dup := sections[id]; dup {
+			return 0, nil, fmt.Errorf("%w: duplicate section %d", ErrCorrupt, id)
+		}
+		sections[id] = data
+	}
+	return flags, sections, nil
+}
+
+// IsBlobError reports whether err means a blob could not be read at all, as
+// opposed to failing while it ran.
+func IsBlobError(err error) bool {
+	return errors.Is(err, ErrNotBytecode) || errors.Is(err, ErrVersion) || errors.Is(err, ErrCorrupt) || isVerifyError(err)
+}
+
+/* ---------- Programs ---------- */
+
+// Program is the decoded contents of a blob. Objects also carry the symbol
+// and relocation tables the linker needs.
+type Program struct {
+	Flags       uint16
+	Code        []byte
+	Consts      []interface{}
+	Globals     int          // number of global slots
+	Funcs       []CodeObject // Funcs[0] is where execution starts
+	Builtins    []string     // names of the builtins CALL_BUILTIN operands index
+	Lines       []LineInfo   // ascending by Addr; nil if there is no debug info
+	GlobalNames []string     // by global slot, from the name table
+	Symbols     []Symbol
+	Relocs      []Reloc
+}
+
+func (p *Program) Executable() bool { return p.Flags&FlagExecutable != 0 }
+
+// FuncAt returns the code object containing addr, or nil.
+func (p *Program) FuncAt(addr int) *CodeObject {
+	for i := range p.Funcs {
+		if co := &p.Funcs[i]; addr >= co.Entry && addr < co.Entry+co.Size {
+			return co
+		}
+	}
+	return nil
+}
+
+/* ---------- Code objects ---------- */
+
+type CodeKind byte
+
+const (
+	CodeModule CodeKind = iota // top level statements of a file
+	CodeFunc
+	CodeMethod
+)
+
+var codeKindNames = [...]string{CodeModule: "module", CodeFunc: "func", CodeMethod: "method"}
+
+func (k CodeKind) String() string {
+	if int(k) < len(codeKindNames) {
+		return codeKindNames[k]
+	}
+	return fmt.Sprintf("kind(%d)", int(k))
+}
+
+// CodeObject is one function, method or module initialiser: a range of the
+// code section plus what the VM needs to give it a frame.
+type CodeObject struct {
+	Name      string
+	Kind      CodeKind
+	Entry     int      // address of the first instruction
+	Size      int      // bytes of code
+	Arity     int      // parameters, which are the first locals
+	NumLocals int      // frame slots
+	MaxStack  int      // deepest operand stack
+	Consts    []int    // constant pool indices the code loads, ascending
+	Locals    []string // local names by slot, from the name table
+}
+
+// Code object section: uvarint globals, uvarint count, then per object:
+// name, kind byte, then uvarint entry, size, arity, locals, max stack and
+// constant count followed by that many uvarint constant indices.
+func encodeFuncs(globals int, funcs []CodeObject) []byte {
+	b := binary.AppendUvarint(nil, uint64(globals))
+	b = binary.AppendUvarint(b, uint64(len(funcs)))
+	for _, co := range funcs {
+		b = appendString(b, co.Name)
+		b = append(b, byte(co.Kind))
+		for _, n := range []int{co.Entry, co.Size, co.Arity, co.NumLocals, co.MaxStack, len(co.Consts)} {
+			b = binary.AppendUvarint(b, uint64(n))
+		}
+		for _, c := range co.Consts {
+			b = binary.AppendUvarint(b, uint64(c))
+		}
+	}
+	return b
+}
+
+func decodeFuncs(data []byte, codeLen, nconsts int) (int, []CodeObject, error) {
+	r := &byteReader{what: "code object table", data: data}
+	globals, err := r.uvarint()
+	if err != nil {
+		return 0, nil, err
+	}
+	if globals > math.MaxUint32 {
+		return 0, nil, r.errorf("%d globals", globals)
+	}
+	n, err := r.count()
+	if err != nil {
+		return 0, nil, err
+	}
+	funcs := make([]CodeObject, 0, n)
+	for i := 0; i < n; i++ {
+		var co CodeObject
+		if co.Name, err = r.string(); err != nil {
+			return 0, nil, err
+		}
+		kind, err := r.byte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if CodeKind(kind) > CodeMethod {
+			return 0, nil, r.errorf("unknown code object kind %d", kind)
+		}
+		co.Kind = CodeKind(kind)
+		var fields [6]int
+		for j := range fields {
+			v, err := r.uvarint()
+			if err != nil {
+				return 0, nil, err
+			}
+			if v > math.MaxUint32 {
+				return 0, nil, r.errorf("%s: value %d out of range", co.Name, v)
+			}
+			fields[j] = int(v)
+		}
+		co.Entry, co.Size, co.Arity, co.NumLocals, co.MaxStack = fields[0], fields[1], fields[2], fields[3], fields[4]
+		if co.Entry+co.Size > codeLen {
+			return 0, nil, r.errorf("%s: code %d..%d past the end of the code section", co.Name, co.Entry, co.Entry+co.Size)
+		}
+		if co.Arity > 255 || co.Arity > co.NumLocals {
+			return 0, nil, r.errorf("%s: arity %d with %d locals", co.Name, co.Arity, co.NumLocals)
+		}
+		if fields[5] > len(data)-r.pos {
+			return 0, nil, r.errorf("length %d past end", fields[5])
+		}
+		for j := 0; j < fields[5]; j++ {
+			c, err := r.uvarint()
+			if err != nil {
+				return 0, nil, err
+			}
+			if c >= uint64(nconsts) {
+				return 0, nil, r.errorf("%s: constant index %d out of range", co.Name, c)
+			}
+			co.Consts = append(co.Consts, int(c))
+		}
+		funcs = append(funcs, co)
+	}
+	return int(globals), funcs, r.done()
+}
+
+// Builtin import table: uvarint count, then the names. CALL_BUILTIN
+// operands index it, so at most 256 entries.
+func encodeBuiltins(names []string) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(names)))
+	for _, name := range names {
+		b = appendString(b, name)
+	}
+	return b
+}
+
+func decodeBuiltins(data []byte) ([]string, error) {
+	r := &byteReader{what: "builtin table", data: data}
+	n, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	if n > 256 {
+		return nil, r.errorf("%d builtins, the limit is 256", n)
+	}
+	names := make([]string, 0, n)
+	seen := map[string]bool{}
+	for i := 0; i < n; i++ {
+		name, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		if seen[name] {
+			return nil, r.errorf("builtin %s imported twice", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, r.done()
+}
+
+func EncodeProgram(p *Program) ([]byte, error) {
+	pool, err := encodeConsts(p.Consts)
+	if err != nil {
+		return nil, err
+	}
+	sections := []section{
+		{SectionConsts, pool},
+		{SectionCode, p.Code},
+		{SectionFuncs, encodeFuncs(p.Globals, p.Funcs)},
+	}
+	if len(p.Builtins) > 0 {
+		sections = append(sections, section{SectionBuiltins, encodeBuiltins(p.Builtins)})
+	}
+	if len(p.Lines) > 0 {
+		sections = append(sections, section{SectionLines, encodeLines(p.Lines)})
+	}
+	if p.hasNames() {
+		sections = append(sections, section{SectionNames, encodeNames(p)})
+	}
+	if len(p.Symbols) > 0 {
+		sections = append(sections, section{SectionSymbols, encodeSymbols(p.Symbols)})
+	}
+	if len(p.Relocs) > 0 {
+		sections = append(sections, section{SectionRelocs, encodeRelocs(p.Relocs)})
+	}
+	return encodeContainer(p.Flags, sections), nil
+}
+
+func DecodeProgram(blob []byte) (*Program, error) {
+	flags, sections, err := decodeContainer(blob)
+	if err != nil {
+		return nil, err
+	}
+	pool, ok := sections[SectionConsts]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing constant section", ErrCorrupt)
+	}
+	code, ok := sections[SectionCode]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing code section", ErrCorrupt)
+	}
+	consts, err := decodeConsts(pool)
+	if err != nil {
+		return nil, err
+	}
+	p := &Program{Flags: flags, Code: code, Consts: consts}
+	data, ok := sections[SectionFuncs]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing code object table", ErrCorrupt)
+	}
+	if p.Globals, p.Funcs, err = decodeFuncs(data, len(code), len(consts)); err != nil {
+		return nil, err
+	}
+	if data, ok := sections[SectionBuiltins]; ok {
+		if p.Builtins, err = decodeBuiltins(data); err != nil {
+			return nil, err
+		}
+	}
+	if data, ok := sections[SectionLines]; ok {
+		if p.Lines, err = decodeLines(data, len(code)); err != nil {
+			return nil, err
+		}
+	}
+	if data, ok := sections[SectionNames]; ok {
+		if err := decodeNames(data, p); err != nil {
+			return nil, err
+		}
+	}
+	if data, ok := sections[SectionSymbols]; ok {
+		if p.Symbols, err = decodeSymbols(data, p); err != nil {
+			return nil, err
+		}
+	}
+	if data, ok := sections[SectionRelocs]; ok {
+		if p.Relocs, err = decodeRelocs(data, len(p.Symbols)); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// SerializeBytecode encodes an unlinked object blob whose code is all one
+// module initialiser.
+func SerializeBytecode(code []byte, consts []interface{}) ([]byte, error) {
+	p := &Program{Code: code, Consts: consts, Funcs: []CodeObject{{Name: "<main>", Kind: CodeModule, Size: len(code)}}}
+	fillCodeInfo(p)
+	return EncodeProgram(p)
+}
+
+func DeserializeBytecode(blob []byte) ([]byte, []interface{}, error) {
+	p, err := DecodeProgram(blob)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.Code, p.Consts, nil
+}
@@ -0,0 +1,216 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testBlob is a small valid object blob: one module printing a constant.
+func testBlob(t *testing.T) []byte {
+	t.Helper()
+	var code []byte
+	for _, in := range [][]int{{int(OpLoadConst), 0}, {int(OpPop)}, {int(OpHalt)}} {
+		var err error
+		if code, err = EncodeInstr(code, byte(in[0]), in[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blob, err := SerializeBytecode(code, []interface{}{"hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+func TestSerializeBytecodeRoundTrip(t *testing.T) {
+	blob := testBlob(t)
+	if !bytes.HasPrefix(blob, Magic[:]) {
+		t.Fatalf("blob starts % x, want the magic number", blob[:4])
+	}
+	if v := binary.LittleEndian.Uint16(blob[4:6]); v != FormatVersion {
+		t.Errorf("blob is version %d, want %d", v, FormatVersion)
+	}
+	code, consts, err := DeserializeBytecode(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 5 || code[0] != OpLoadConst || code[4] != OpHalt {
+		t.Errorf("code % x", code)
+	}
+	if len(consts) != 1 || consts[0] != "hi" {
+		t.Errorf("constants %v", consts)
+	}
+}
+
+func TestContainerRoundTrip(t *testing.T) {
+	sections := []section{{SectionCode, []byte{1, 2, 3}}, {SectionConsts, nil}, {99, []byte("later")}}
+	flags, got, err := decodeContainer(encodeContainer(FlagExecutable, sections))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags != FlagExecutable || len(got) != len(sections) {
+		t.Fatalf("flags %#x and %d sections", flags, len(got))
+	}
+	for _, s := range sections {
+		if !bytes.Equal(got[s.id], s.data) {
+			t.Errorf("section %d is % x, want % x", s.id, got[s.id], s.data)
+		}
+	}
+}
+
+// Sections a reader does not know are skipped, so optional ones can be
+// added without a version bump.
+func TestDecodeSkipsUnknownSections(t *testing.T) {
+	flags, known, err := decodeContainer(testBlob(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sections []section
+	for id, data := range known {
+		sections = append(sections, section{id, data})
+	}
+	sections = append(sections, section{200, []byte("from the future")})
+	if _, err := DecodeProgram(encodeContainer(flags, sections)); err != nil {
+		t.Errorf("a blob with an unknown section: %v", err)
+	}
+}
+
+func TestDecodeRejectsBadBlobs(t *testing.T) {
+	good := testBlob(t)
+	edit := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte(nil), good...))
+	}
+	_, sections, err := decodeContainer(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		blob []byte
+		want error
+	}{
+		{"empty", nil, ErrNotBytecode},
+		{"old length prefixed format", []byte{2, 0, 0, 0, '[', ']', OpHalt}, ErrNotBytecode},
+		{"truncated header", good[:8], ErrCorrupt},
+		{"newer version", edit(func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[4:], FormatVersion+1)
+			return b
+		}), ErrVersion},
+		{"older version", edit(func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[4:], FormatVersion-1)
+			return b
+		}), ErrVersion},
+		{"unknown flag", edit(func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[6:], 0x8000)
+			return b
+		}), ErrVersion},
+		{"truncated section table", edit(func(b []byte) []byte {
+			binary.LittleEndian.PutUint16(b[8:], 1000)
+			return b
+		}), ErrCorrupt},
+		{"truncated payload", good[:len(good)-1], ErrCorrupt},
+		{"flipped payload byte", edit(func(b []byte) []byte {
+			b[len(b)-1] ^= 1
+			return b
+		}), ErrCorrupt},
+		{"duplicate section", encodeContainer(0, []section{
+			{SectionConsts, sections[SectionConsts]},
+			{SectionCode, sections[SectionCode]},
+			{SectionFuncs, sections[SectionFuncs]},
+			{SectionCode, sections[SectionCode]},
+		}), ErrCorrupt},
+		{"no code section", encodeContainer(0, []section{
+			{SectionConsts, sections[SectionConsts]},
+			{SectionFuncs, sections[SectionFuncs]},
+		}), ErrCorrupt},
+		{"no constant section", encodeContainer(0, []section{
+			{SectionCode, sections[SectionCode]},
+			{SectionFuncs, sections[SectionFuncs]},
+		}), ErrCorrupt},
+	}
+	for _, tt := range tests {
+		_, err := DecodeProgram(tt.blob)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+		if err != nil && !IsBlobError(err) {
+			t.Errorf("%s: IsBlobError(%v) is false", tt.name, err)
+		}
+	}
+}
+
+func TestCodeObjectTable(t *testing.T) {
+	p, err := Link([]Object{compileObject(t, "t.quark", `let k = 10;
+func scale(a, b) { let c = a * b; return c + k + 1; }
+print(scale(2, 3));
+`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Funcs) != 2 {
+		t.Fatalf("%d code objects, want <main> and scale", len(p.Funcs))
+	}
+	main, f := p.Funcs[0], p.Funcs[1]
+	if main.Name != "<main>" || main.Kind != CodeModule || main.Entry != 0 {
+		t.Errorf("first code object %+v", main)
+	}
+	if f.Name != "scale" || f.Kind != CodeFunc || f.Arity != 2 || f.NumLocals != 3 || f.MaxStack != 2 {
+		t.Errorf("scale is %+v, want a func of 2 parameters, 3 locals and a stack of 2", f)
+	}
+	if f.Entry != main.Entry+main.Size || f.Entry+f.Size != len(p.Code) {
+		t.Errorf("code objects cover %d..%d and %d..%d of %d bytes", main.Entry, main.Entry+main.Size, f.Entry, f.Entry+f.Size, len(p.Code))
+	}
+	if len(f.Consts) != 1 || p.Consts[f.Consts[0]] != int64(1) {
+		t.Errorf("scale loads constants %v, want just 1", f.Consts)
+	}
+	if got := p.FuncAt(f.Entry + 1); got == nil || got.Name != "scale" {
+		t.Errorf("FuncAt inside scale = %v", got)
+	}
+	if got := p.FuncAt(len(p.Code)); got != nil {
+		t.Errorf("FuncAt past the code = %v", got)
+	}
+
+	blob, err := EncodeProgram(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := DecodeProgram(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range p.Funcs {
+		a, b := p.Funcs[i], q.Funcs[i]
+		if a.Name != b.Name || a.Kind != b.Kind || a.Entry != b.Entry || a.Size != b.Size || a.Arity != b.Arity ||
+			a.NumLocals != b.NumLocals || a.MaxStack != b.MaxStack || len(a.Consts) != len(b.Consts) {
+			t.Errorf("code object %d decoded as %+v, want %+v", i, b, a)
+		}
+	}
+}
+
+func TestDecodeFuncsRejects(t *testing.T) {
+	ok := CodeObject{Name: "f", Kind: CodeFunc, Entry: 0, Size: 4, Arity: 1, NumLocals: 2, MaxStack: 1, Consts: []int{0}}
+	tests := []struct {
+		name string
+		edit func(co *CodeObject)
+		want string
+	}{
+		{"code past the end", func(co *CodeObject) { co.Size = 5 }, "past the end of the code section"},
+		{"more parameters than locals", func(co *CodeObject) { co.Arity = 3 }, "arity 3 with 2 locals"},
+		{"constant out of range", func(co *CodeObject) { co.Consts = []int{0, 2} }, "constant index 2 out of range"},
+		{"unknown kind", func(co *CodeObject) { co.Kind = 9 }, "unknown code object kind 9"},
+	}
+	if _, funcs, err := decodeFuncs(encodeFuncs(1, []CodeObject{ok}), 4, 2); err != nil || len(funcs) != 1 {
+		t.Fatalf("a good table: %v", err)
+	}
+	for _, tt := range tests {
+		co := ok
+		tt.edit(&co)
+		_, _, err := decodeFuncs(encodeFuncs(1, []CodeObject{co}), 4, 2)
+		if !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want ErrCorrupt containing %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"quark/parser"
+)
+
+/* ---------- Value types ---------- */
+
+// Type is the runtime type of a Value, used to describe builtin parameters.
+type Type byte
+
+const (
+	TypeAny Type = iota // accepts every value
+	TypeNull
+	TypeBool
+	TypeInt
+	TypeFloat
+	TypeString
+	TypeChar
+	TypeChan
+)
+
+var typeNames = [...]string{
+	TypeAny:    "any",
+	TypeNull:   "null",
+	TypeBool:   "bool",
+	TypeInt:    "int",
+	TypeFloat:  "float",
+	TypeString: "string",
+	TypeChar:   "char",
+	TypeChan:   "chan",
+}
+
+func (t Type) String() string {
+	if int(t) < len(typeNames) {
+		return typeNames[t]
+	}
+	return fmt.Sprintf("type(%d)", int(t))
+}
+
+// typeByName finds a type by the name String gives it.
+func typeByName(name string) (Type, bool) {
+	for t, n := range typeNames {
+		if n == name {
+			return Type(t), true
+		}
+	}
+	return 0, false
+}
+
+// TypeOf returns the type of v, or TypeAny for values with no Quark type.
+func TypeOf(v Value) Type {
+	switch v.(type) {
+	case nil:
+		return TypeNull
+	case bool:
+		return TypeBool
+	case int64:
+		return TypeInt
+	case float64:
+		return TypeFloat
+	case string:
+		return TypeString
+	case Char:
+		return TypeChar
+	case *Channel:
+		return TypeChan
+	}
+	return TypeAny
+}
+
+/* ---------- Builtins ---------- */
+
+// BuiltinFunc implements a builtin. args have already been checked against
+// the builtin's parameter types; a returned error stops the program.
+type BuiltinFunc func(m *VM, args []Value) (Value, error)
+
+// Builtin is a Go function callable from Quark.
+type Builtin struct {
+	Name     string
+	Params   []Type
+	Variadic bool // the last of Params may be repeated zero or more times
+	Fn       BuiltinFunc
+}
+
+// Accepts reports whether the builtin can be called with argc arguments.
+func (b *Builtin) Accepts(argc int) bool {
+	if b.Variadic {
+		return argc >= len(b.Params)-1
+	}
+	return argc == len(b.Params)
+}
+
+// Signature describes the parameters, e.g. "print(any...)".
+func (b *Builtin) Signature() string {
+	params := make([]string, len(b.Params))
+	for i, t := range b.Params {
+		params[i] = t.String()
+	}
+	if b.Variadic && len(params) > 0 {
+		params[len(params)-1] += "..."
+	}
+	return b.Name + "(" + strings.Join(params, ", ") + ")"
+}
+
+// check validates args against the parameter types.
+func (b *Builtin) check(args []Value) error {
+	if !b.Accepts(len(args)) {
+		return fmt.Errorf("%s called with %d argument(s)", b.Signature(), len(args))
+	}
+	for i, a := range args {
+		want := b.Params[min(i, len(b.Params)-1)]
+		if got := TypeOf(a); want != TypeAny && got != want {
+			return fmt.Errorf("%s: argument %d must be %v, got %v", b.Name, i+1, want, got)
+		}
+	}
+	return nil
+}
+
+var (
+	builtinMu sync.RWMutex
+	builtins  = map[string]*Builtin{}
+)
+
+// RegisterBuiltin makes fn callable from Quark code as name, with one
+// argument per entry in params. Builtins are resolved by name when a
+// program is compiled and again when it is loaded, so register them before
+// doing either.
+func RegisterBuiltin(name string, fn BuiltinFunc, params ...Type) error {
+	return register(&Builtin{Name: name, Params: params, Fn: fn})
+}
+
+// RegisterVariadicBuiltin is RegisterBuiltin for a builtin whose last
+// parameter may be repeated zero or more times.
+func RegisterVariadicBuiltin(name string, fn BuiltinFunc, params ...Type) error {
+	if len(params) == 0 {
+		return fmt.Errorf("builtin %s: variadic builtins need at least one parameter", name)
+	}
+	return register(&Builtin{Name: name, Params: params, Variadic: true, Fn: fn})
+}
+
+func register(b *Builtin) error {
+	if !isIdent(b.Name) {
+		return fmt.Errorf("builtin name %q is not an identifier", b.Name)
+	}
+	if parser.IsKeyword(b.Name) {
+		return fmt.Errorf("builtin name %s is a keyword", b.Name)
+	}
+	if b.Fn == nil {
+		return fmt.Errorf("builtin %s: nil function", b.Name)
+	}
+	if len(b.Params) > 255 {
+		return fmt.Errorf("builtin %s: %d parameters, the limit is 255", b.Name, len(b.Params))
+	}
+	return addBuiltin(b)
+}
+
+func addBuiltin(b *Builtin) error {
+	builtinMu.Lock()
+	defer builtinMu.Unlock()
+	if _, dup := builtins[b.Name]; dup {
+		return fmt.Errorf("builtin %s is already registered", b.Name)
+	}
+	builtins[b.Name] = b
+	return nil
+}
+
+// LookupBuiltin finds a registered builtin.
+func LookupBuiltin(name string) (*Builtin, bool) {
+	builtinMu.RLock()
+	defer builtinMu.RUnlock()
+	b, ok := builtins[name]
+	return b, ok
+}
+
+// BuiltinNames lists the registered builtins, sorted.
+func BuiltinNames() []string {
+	builtinMu.RLock()
+	defer builtinMu.RUnlock()
+	names := make([]string, 0, len(builtins))
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* ---------- Standard builtins ---------- */
+
+func init() {
+	// print is a keyword, but the parser reads print(...) as a call of this
+	// builtin, so it is the one builtin named after a keyword
+	addBuiltin(&Builtin{Name: "print", Params: []Type{TypeAny}, Variadic: true, Fn: builtinPrint})
+}
+
+func builtinPrint(m *VM, args []Value) (Value, error) {
+	out := make([]string, len(args))
+	for i, a := range args {
+		out[i] = formatValue(a)
+	}
+	_, err := fmt.Fprintln(m.Stdout, strings.Join(out, " "))
+	return nil, err
+}
+
+// formatValue is how print shows a value.
+func formatValue(v Value) string {
+	switch x := v.(type) {
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case string:
+		return x
+	case Char:
+		return string(rune(x))
+	case nil:
+		return "null"
+	case *Channel:
+		return "chan " + x.Elem.String()
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// Repr is how the debugger shows a value: like print, but strings and
+// characters are quoted.
+func Repr(v Value) string {
+	switch x := v.(type) {
+	case string:
+		return strconv.Quote(x)
+	case Char:
+		return strconv.QuoteRune(rune(x))
+	}
+	return formatValue(v)
+}
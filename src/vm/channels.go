@@ -0,0 +1,181 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+/* ---------- Channels ---------- */
+
+// Channel is a typed, optionally buffered queue between fibers. Elem is the
+// type of value it carries; TypeAny carries anything.
+type Channel struct {
+	Elem   Type
+	Cap    int
+	buf    []Value
+	closed bool
+	recvq  []*fiber // blocked receivers, including fibers in select
+	sendq  []*fiber // blocked senders, each with its value in sending
+}
+
+// ready reports whether a receive would not block.
+func (ch *Channel) ready() bool {
+	return len(ch.buf) > 0 || len(ch.sendq) > 0 || ch.closed
+}
+
+// take receives from a ready channel: the oldest buffered value, or the
+// oldest blocked sender's. A closed, drained channel gives null.
+func (m *VM) take(ch *Channel) Value {
+	var v Value
+	switch {
+	case len(ch.buf) > 0:
+		v = ch.buf[0]
+		ch.buf = ch.buf[1:]
+		if len(ch.sendq) > 0 {
+			s := ch.sendq[0]
+			ch.buf = append(ch.buf, s.sending)
+			m.wake(s, nil, nil)
+		}
+	case len(ch.sendq) > 0:
+		s := ch.sendq[0]
+		v = s.sending
+		m.wake(s, nil, nil)
+	}
+	return v
+}
+
+func init() {
+	RegisterVariadicBuiltin("chan", builtinChan, TypeString, TypeInt)
+	RegisterBuiltin("send", builtinSend, TypeChan, TypeAny)
+	RegisterBuiltin("recv", builtinRecv, TypeChan)
+	RegisterVariadicBuiltin("select", builtinSelect, TypeChan)
+	RegisterBuiltin("selected", builtinSelected)
+	RegisterBuiltin("close", builtinClose, TypeChan)
+	RegisterBuiltin("yield", builtinYield)
+}
+
+// chan(type) makes an unbuffered channel of values of the named type,
+// chan(type, n) one that buffers n values.
+func builtinChan(m *VM, args []Value) (Value, error) {
+	elem, ok := typeByName(args[0].(string))
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q", args[0])
+	}
+	ch := &Channel{Elem: elem}
+	switch len(args) {
+	case 1:
+	case 2:
+		n := args[1].(int64)
+		if n < 0 || n > 1<<20 {
+			return nil, fmt.Errorf("buffer size %d out of range", n)
+		}
+		ch.Cap = int(n)
+	default:
+		return nil, errors.New("takes a type and an optional buffer size")
+	}
+	return ch, nil
+}
+
+// send(ch, v) blocks until a receiver takes v or there is room in the
+// buffer.
+func builtinSend(m *VM, args []Value) (Value, error) {
+	ch, v := args[0].(*Channel), args[1]
+	if t := TypeOf(v); ch.Elem != TypeAny && t != ch.Elem {
+		return nil, fmt.Errorf("cannot send %v on chan %v", t, ch.Elem)
+	}
+	switch {
+	case ch.closed:
+		return nil, errors.New("send on closed channel")
+	case len(ch.recvq) > 0:
+		m.hand(ch.recvq[0], ch, v)
+	case len(ch.buf) < ch.Cap:
+		ch.buf = append(ch.buf, v)
+	default:
+		ch.sendq = append(ch.sendq, m.cur)
+		m.cur.sending = v
+		return nil, m.block("send", ch)
+	}
+	return nil, nil
+}
+
+// recv(ch) blocks until there is a value; a closed channel gives null once
+// drained.
+func builtinRecv(m *VM, args []Value) (Value, error) {
+	ch := args[0].(*Channel)
+	if ch.ready() {
+		return m.take(ch), nil
+	}
+	ch.recvq = append(ch.recvq, m.cur)
+	return nil, m.block("recv", ch)
+}
+
+// select(ch...) receives from whichever channel is ready first; selected()
+// then tells which one it was. When several are ready, the scheduler's
+// seed decides, see SchedConfig.
+func builtinSelect(m *VM, args []Value) (Value, error) {
+	chans := make([]*Channel, len(args))
+	for i, a := range args {
+		chans[i] = a.(*Channel)
+	}
+	var ready []int
+	for i, ch := range chans {
+		if ch.ready() {
+			ready = append(ready, i)
+		}
+	}
+	if len(ready) > 0 {
+		i := ready[0]
+		if m.rng != nil {
+			i = ready[m.rng.Intn(len(ready))]
+		}
+		m.cur.selected = i
+		return m.take(chans[i]), nil
+	}
+	for _, ch := range chans {
+		ch.recvq = append(ch.recvq, m.cur)
+	}
+	return nil, m.block("select", chans...)
+}
+
+// selected() is the position among its arguments of the channel the
+// fiber's last select received from, counting from 0, or -1 if it has not
+// selected yet.
+func builtinSelected(m *VM, args []Value) (Value, error) {
+	return int64(m.cur.selected), nil
+}
+
+// hand wakes f, blocked receiving from ch, with v. A fiber in select
+// learns which of its channels it was.
+func (m *VM) hand(f *fiber, ch *Channel, v Value) {
+	if f.blockedIn == "select" {
+		for i, w := range f.waiting {
+			if w == ch {
+				f.selected = i
+			}
+		}
+	}
+	m.wake(f, v, nil)
+}
+
+// close(ch) wakes every receiver with null; blocked senders fail.
+func builtinClose(m *VM, args []Value) (Value, error) {
+	ch := args[0].(*Channel)
+	if ch.closed {
+		return nil, errors.New("close of closed channel")
+	}
+	ch.closed = true
+	for len(ch.recvq) > 0 {
+		m.hand(ch.recvq[0], ch, nil)
+	}
+	for len(ch.sendq) > 0 {
+		m.wake(ch.sendq[0], nil, errors.New("send: send on closed channel"))
+	}
+	return nil, nil
+}
+
+// yield() lets the other fibers run.
+func builtinYield(m *VM, args []Value) (Value, error) {
+	err := m.block("yield")
+	m.wake(m.cur, nil, nil)
+	return nil, err
+}
@@ -0,0 +1,444 @@
+package vm
+
+import (
+	"fmt"
+
+	"quark/parser"
+)
+
+/* ---------- Compiler (AST -> bytecode + constants) ---------- */
+
+type Compiler struct {
+	file        *parser.File
+	consts      *constPool
+	code        []byte
+	globals     map[string]int // top level variable name -> global slot
+	nextGlobal  int
+	globalNames []string       // by slot
+	funcs       map[string]int // function name -> code object index
+	codeObjs    []CodeObject
+	builtins    []string       // builtin import table
+	builtinIdx  map[string]int // builtin name -> import index
+	lines       []LineInfo
+	scope       *funcScope // nil at the top level
+	symbols     []Symbol
+	symIdx      map[string]int // name -> index of its SymUndefined entry
+	relocs      []Reloc
+}
+
+// funcScope is the frame of the function being compiled.
+type funcScope struct {
+	locals  map[string]int // name -> frame slot, parameters first
+	nlocals int
+	names   []string // by slot
+}
+
+func NewCompiler() *Compiler {
+	return &Compiler{
+		consts:     newConstPool(),
+		code:       []byte{},
+		globals:    map[string]int{},
+		funcs:      map[string]int{},
+		builtinIdx: map[string]int{},
+		symIdx:     map[string]int{},
+	}
+}
+func (c *Compiler) addConst(v interface{}) int {
+	return c.consts.add(v)
+}
+func (c *Compiler) emit(b ...byte) {
+	c.code = append(c.code, b...)
+}
+
+// emitOperand emits op with its operands args, WIDE if one needs it, and
+// records how the linker must relocate the first operand.
+func (c *Compiler) emitOperand(n parser.Node, op byte, rel Reloc, args ...int) error {
+	code, err := EncodeInstr(c.code, op, args...)
+	if err != nil {
+		return c.errorf(n, "%v", err)
+	}
+	in, err := DecodeInstr(code, len(c.code))
+	if err != nil {
+		return c.errorf(n, "%v", err)
+	}
+	rel.Offset = in.OperandOffsets()[0]
+	c.relocs = append(c.relocs, rel)
+	c.code = code
+	return nil
+}
+
+// emitInstr emits an instruction that needs no relocation.
+func (c *Compiler) emitInstr(n parser.Node, op byte, args ...int) error {
+	code, err := EncodeInstr(c.code, op, args...)
+	if err != nil {
+		return c.errorf(n, "%v", err)
+	}
+	c.code = code
+	return nil
+}
+
+// builtinRef returns the import table index of a builtin.
+func (c *Compiler) builtinRef(n parser.Node, name string) (int, error) {
+	idx, ok := c.builtinIdx[name]
+	if !ok {
+		if len(c.builtins) >= 256 {
+			return 0, c.errorf(n, "more than 256 distinct builtins used")
+		}
+		idx = len(c.builtins)
+		c.builtins = append(c.builtins, name)
+		c.builtinIdx[name] = idx
+	}
+	return idx, nil
+}
+
+// symbolRef returns the index of the SymUndefined entry for a name defined
+// in another file; the linker fills in operands that refer to it.
+func (c *Compiler) symbolRef(name string) int {
+	idx, ok := c.symIdx[name]
+	if !ok {
+		idx = len(c.symbols)
+		c.symbols = append(c.symbols, Symbol{Name: name, Kind: SymUndefined})
+		c.symIdx[name] = idx
+	}
+	return idx
+}
+
+// define exports a top level variable or function; a later let of the same
+// name replaces the earlier definition.
+func (c *Compiler) define(name string, kind SymbolKind, value int) {
+	for i := range c.symbols {
+		if c.symbols[i].Kind == kind && c.symbols[i].Name == name {
+			c.symbols[i].Value = value
+			return
+		}
+	}
+	c.symbols = append(c.symbols, Symbol{Name: name, Kind: kind, Value: value})
+}
+
+// mark records that the code emitted next comes from n's line.
+func (c *Compiler) mark(n parser.Node) { c.markPos(n.Pos()) }
+
+func (c *Compiler) markPos(p parser.Pos) {
+	pos := c.file.Position(p)
+	c.lines = appendLine(c.lines, len(c.code), pos.Filename, pos.Line)
+}
+
+func (c *Compiler) errorf(n parser.Node, format string, args ...interface{}) error {
+	return &parser.Error{Pos: c.file.Position(n.Pos()), Msg: fmt.Sprintf(format, args...)}
+}
+
+func (c *Compiler) compileExpr(e parser.Expr) error {
+	switch v := e.(type) {
+	case *parser.NumberLit:
+		return c.emitOperand(v, OpLoadConst, Reloc{Kind: RelocConst}, c.addConst(v.Value))
+	case *parser.StringLit:
+		return c.emitOperand(v, OpLoadConst, Reloc{Kind: RelocConst}, c.addConst(v.Value))
+	case *parser.Ident:
+		if c.scope != nil {
+			if li, ok := c.scope.locals[v.Name]; ok {
+				return c.emitInstr(v, OpLoadLocal, li)
+			}
+		}
+		if _, ok := c.funcs[v.Name]; ok {
+			return c.errorf(v, "function %s used as a value", v.Name)
+		}
+		if gi, ok := c.globals[v.Name]; ok {
+			return c.emitOperand(v, OpLoadGlobal, Reloc{Kind: RelocGlobal}, gi)
+		}
+		// may be defined in another file, the linker will tell
+		return c.emitOperand(v, OpLoadGlobal, Reloc{Kind: RelocSymbol, Symbol: c.symbolRef(v.Name)}, 0)
+	case *parser.ParenExpr:
+		return c.compileExpr(v.X)
+	case *parser.BinaryExpr:
+		if err := c.compileExpr(v.X); err != nil {
+			return err
+		}
+		if err := c.compileExpr(v.Y); err != nil {
+			return err
+		}
+		c.markPos(v.OpPos)
+		switch v.Op {
+		case parser.TokPlus:
+			c.emit(byte(OpAdd))
+		case parser.TokMinus:
+			c.emit(byte(OpSub))
+		case parser.TokStar:
+			c.emit(byte(OpMul))
+		case parser.TokSlash:
+			c.emit(byte(OpDiv))
+		case parser.TokPercent:
+			c.emit(byte(OpMod))
+		case parser.TokAmp:
+			c.emit(byte(OpBitAnd))
+		case parser.TokPipe:
+			c.emit(byte(OpBitOr))
+		case parser.TokCaret:
+			c.emit(byte(OpBitXor))
+		case parser.TokShl:
+			c.emit(byte(OpShl))
+		case parser.TokShr:
+			c.emit(byte(OpShr))
+		case parser.TokUshr:
+			c.emit(byte(OpUshr))
+		default:
+			return c.errorf(v, "unknown binary op %v", v.Op)
+		}
+	case *parser.UnaryExpr:
+		if err := c.compileExpr(v.X); err != nil {
+			return err
+		}
+		c.markPos(v.OpPos)
+		if v.Op != parser.TokTilde {
+			return c.errorf(v, "unknown unary op %v", v.Op)
+		}
+		c.emit(byte(OpBitNot))
+	case *parser.CallExpr:
+		return c.compileCall(v, false)
+	default:
+		return fmt.Errorf("unknown expr type %T", v)
+	}
+	return nil
+}
+
+// compileCall compiles a call, or with spawn set a call in a new fiber.
+func (c *Compiler) compileCall(v *parser.CallExpr, spawn bool) error {
+	name := v.Fun.Name
+	if c.scope != nil {
+		if _, ok := c.scope.locals[name]; ok {
+			return c.errorf(v, "%s is not a function", name)
+		}
+	}
+	fi, isFunc := c.funcs[name]
+	if _, ok := c.globals[name]; ok && !isFunc {
+		return c.errorf(v, "%s is not a function", name)
+	}
+	if isFunc && len(v.Args) != c.codeObjs[fi].Arity {
+		return c.errorf(v, "%s takes %d argument(s), got %d", name, c.codeObjs[fi].Arity, len(v.Args))
+	}
+	b, isBuiltin := LookupBuiltin(name)
+	if isBuiltin && !isFunc && spawn {
+		return c.errorf(v, "cannot spawn builtin %s", name)
+	}
+	if isBuiltin && !isFunc && !b.Accepts(len(v.Args)) {
+		return c.errorf(v, "%s called with %d argument(s)", b.Signature(), len(v.Args))
+	}
+	for _, a := range v.Args {
+		if err := c.compileExpr(a); err != nil {
+			return err
+		}
+	}
+	c.mark(v)
+	op := OpCall
+	if spawn {
+		op = OpSpawn
+	}
+	switch {
+	case isFunc:
+		return c.emitOperand(v, op, Reloc{Kind: RelocFunc}, fi, len(v.Args))
+	case isBuiltin:
+		bi, err := c.builtinRef(v, name)
+		if err != nil {
+			return err
+		}
+		return c.emitOperand(v, OpCallBuiltin, Reloc{Kind: RelocBuiltin}, bi, len(v.Args))
+	}
+	// may be defined in another file, the linker checks the arity
+	return c.emitOperand(v, op, Reloc{Kind: RelocSymbol, Symbol: c.symbolRef(name)}, 0, len(v.Args))
+}
+
+func (c *Compiler) compileStmt(s parser.Stmt) error {
+	if _, ok := s.(*parser.BlockStmt); !ok {
+		c.mark(s)
+	}
+	switch st := s.(type) {
+	case *parser.LetStmt:
+		name := st.Name.Name
+		if c.scope == nil {
+			if _, ok := c.funcs[name]; ok {
+				return c.errorf(st.Name, "%s redeclared, it is a function", name)
+			}
+		}
+		// the value is compiled before the name gets its new slot, so it may
+		// refer to an earlier variable of the same name
+		if err := c.compileExpr(st.Value); err != nil {
+			return err
+		}
+		if c.scope != nil {
+			idx := c.scope.nlocals
+			c.scope.nlocals++
+			c.scope.locals[name] = idx
+			c.scope.names = append(c.scope.names, name)
+			return c.emitInstr(st, OpStoreLocal, idx)
+		}
+		idx := c.nextGlobal
+		c.nextGlobal++
+		c.globals[name] = idx
+		c.globalNames = append(c.globalNames, name)
+		if err := c.emitOperand(st, OpStoreGlobal, Reloc{Kind: RelocGlobal}, idx); err != nil {
+			return err
+		}
+		c.define(name, SymGlobal, idx)
+	case *parser.ExprStmt:
+		if err := c.compileExpr(st.X); err != nil {
+			return err
+		}
+		c.emit(byte(OpPop))
+	case *parser.ReturnStmt:
+		if c.scope == nil {
+			return c.errorf(st, "return outside function")
+		}
+		if st.Result != nil {
+			if err := c.compileExpr(st.Result); err != nil {
+				return err
+			}
+		} else if err := c.emitOperand(st, OpLoadConst, Reloc{Kind: RelocConst}, c.addConst(nil)); err != nil {
+			return err
+		}
+		c.emit(OpReturn)
+	case *parser.SpawnStmt:
+		return c.compileCall(st.Call, true)
+	case *parser.BlockStmt:
+		for _, s := range st.List {
+			if err := c.compileStmt(s); err != nil {
+				return err
+			}
+		}
+	case *parser.FuncDecl:
+		if c.scope != nil {
+			return c.errorf(st, "functions can only be declared at the top level")
+		}
+		// compiled after the top level code, see compileProgram
+	default:
+		return fmt.Errorf("unknown stmt type %T", st)
+	}
+	return nil
+}
+
+// declareFuncs gives every function in f a code object, so calls may come
+// before the declaration.
+func (c *Compiler) declareFuncs(f *parser.File) error {
+	for _, s := range f.Stmts {
+		fn, ok := s.(*parser.FuncDecl)
+		if !ok {
+			continue
+		}
+		name := fn.Name.Name
+		if _, dup := c.funcs[name]; dup {
+			return c.errorf(fn.Name, "%s redeclared", name)
+		}
+		if _, ok := LookupBuiltin(name); ok {
+			return c.errorf(fn.Name, "%s redeclared, it is a builtin", name)
+		}
+		seen := map[string]bool{}
+		for _, p := range fn.Params {
+			if seen[p.Name] {
+				return c.errorf(p, "duplicate parameter %s", p.Name)
+			}
+			seen[p.Name] = true
+		}
+		if len(fn.Params) > 255 {
+			return c.errorf(fn, "%s has %d parameters, the limit is 255", name, len(fn.Params))
+		}
+		c.funcs[name] = len(c.codeObjs)
+		c.codeObjs = append(c.codeObjs, CodeObject{Name: name, Kind: CodeFunc, Arity: len(fn.Params)})
+		c.define(name, SymFunc, c.funcs[name])
+	}
+	return nil
+}
+
+func (c *Compiler) compileFunc(fn *parser.FuncDecl) error {
+	co := &c.codeObjs[c.funcs[fn.Name.Name]]
+	c.scope = &funcScope{locals: map[string]int{}}
+	defer func() { c.scope = nil }()
+	for i, p := range fn.Params {
+		c.scope.locals[p.Name] = i
+		c.scope.names = append(c.scope.names, p.Name)
+	}
+	c.scope.nlocals = len(fn.Params)
+	co.Entry = len(c.code)
+	if err := c.compileStmt(fn.Body); err != nil {
+		return err
+	}
+	if _, ok := lastStmt(fn.Body.List).(*parser.ReturnStmt); !ok {
+		// falling off the end returns null
+		c.markPos(fn.Body.Rbrace)
+		if err := c.emitOperand(fn.Body, OpLoadConst, Reloc{Kind: RelocConst}, c.addConst(nil)); err != nil {
+			return err
+		}
+		c.emit(OpReturn)
+	}
+	co.Size = len(c.code) - co.Entry
+	co.NumLocals = c.scope.nlocals
+	co.Locals = c.scope.names
+	return nil
+}
+
+func lastStmt(list []parser.Stmt) parser.Stmt {
+	if len(list) == 0 {
+		return nil
+	}
+	return list[len(list)-1]
+}
+
+// compileProgram compiles f into an unlinked object. The top level
+// statements come first, as the module initialiser, followed by the
+// functions.
+func (c *Compiler) compileProgram(f *parser.File) (*Program, error) {
+	c.file = f
+	c.codeObjs = []CodeObject{{Name: f.Name, Kind: CodeModule}}
+	if err := c.declareFuncs(f); err != nil {
+		return nil, err
+	}
+	for _, s := range f.Stmts {
+		if err := c.compileStmt(s); err != nil {
+			return nil, err
+		}
+	}
+	c.codeObjs[0].Size = len(c.code)
+	for _, s := range f.Stmts {
+		if fn, ok := s.(*parser.FuncDecl); ok {
+			if err := c.compileFunc(fn); err != nil {
+				return nil, err
+			}
+		}
+	}
+	p := &Program{
+		Code:        c.code,
+		Consts:      c.consts.values,
+		Globals:     c.nextGlobal,
+		Funcs:       c.codeObjs,
+		Builtins:    c.builtins,
+		Lines:       c.lines,
+		GlobalNames: c.globalNames,
+		Symbols:     c.symbols,
+		Relocs:      c.relocs,
+	}
+	fillCodeInfo(p)
+	return p, nil
+}
+
+/* ---------- Glue: compile source -> blob ---------- */
+
+// CompilerVersion identifies the code generator. Bump it whenever the
+// compiler output or blob format changes so stale build caches are ignored.
+const CompilerVersion = "0.11.0"
+
+// CompileSourceToBlob parses and compiles one source file. filename is used
+// in error messages.
+func CompileSourceToBlob(filename, src string) ([]byte, error) {
+	f, err := parser.Parse(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	return CompileFileToBlob(f)
+}
+
+// CompileFileToBlob compiles an already parsed file.
+func CompileFileToBlob(f *parser.File) ([]byte, error) {
+	c := NewCompiler()
+	obj, err := c.compileProgram(f)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeProgram(obj)
+}
@@ -0,0 +1,51 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// manyBuiltins registers n builtins taking no arguments, nop0 to nop<n-1>,
+// and returns a source calling each of them.
+func manyBuiltins(t *testing.T, n int) string {
+	t.Helper()
+	var src strings.Builder
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("nop%d", i)
+		if _, ok := LookupBuiltin(name); !ok {
+			if err := RegisterBuiltin(name, func(*VM, []Value) (Value, error) { return nil, nil }); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fmt.Fprintf(&src, "%s();\n", name)
+	}
+	return src.String()
+}
+
+// The builtin operand is a byte, so one object can import 256 builtins.
+func TestCompileBuiltinLimit(t *testing.T) {
+	src := manyBuiltins(t, 256)
+	p, err := Link([]Object{compileObject(t, "t.quark", src)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Builtins) != 256 {
+		t.Errorf("%d builtins imported, want 256", len(p.Builtins))
+	}
+	runProgram(t, p)
+
+	_, err = CompileSourceToBlob("t.quark", src+"print(1);\n")
+	if err == nil || !strings.Contains(err.Error(), "more than 256 distinct builtins used") {
+		t.Errorf("compiling 257 builtins: %v", err)
+	}
+}
+
+// The linker keeps to the same limit across objects.
+func TestLinkBuiltinLimit(t *testing.T) {
+	src := manyBuiltins(t, 256)
+	_, err := Link([]Object{compileObject(t, "a.quark", src), compileObject(t, "b.quark", "print(1);\n")})
+	if err == nil || !strings.Contains(err.Error(), "more than 256 distinct builtins used") {
+		t.Errorf("linking 257 builtins: %v", err)
+	}
+}
@@ -0,0 +1,342 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+/* ---------- Constant values ---------- */
+
+// Char is a single character constant. It is distinct from int64 so the
+// pool can tell 'a' from 97.
+type Char rune
+
+// FuncProto is a function prototype: its code and the constants that code
+// refers to.
+type FuncProto struct {
+	Name   string
+	Arity  int
+	Code   []byte
+	Consts []interface{}
+}
+
+// ClassProto is a class prototype: field names and methods.
+type ClassProto struct {
+	Name    string
+	Fields  []string
+	Methods []*FuncProto
+}
+
+/* ---------- Interning ---------- */
+
+// constPool builds a constant pool in which equal values share one slot.
+// Values are keyed by their encoding, so 1 and 1.0 stay apart, as do 0.0
+// and -0.0, and NaNs with the same payload are merged.
+type constPool struct {
+	values []interface{}
+	index  map[string]int
+}
+
+func newConstPool() *constPool {
+	return &constPool{values: []interface{}{}, index: map[string]int{}}
+}
+
+// add returns the index of v, appending it if it is new.
+func (p *constPool) add(v interface{}) int {
+	enc, err := appendConst(nil, v)
+	if err != nil {
+		// not encodable, EncodeProgram will report it
+		p.values = append(p.values, v)
+		return len(p.values) - 1
+	}
+	key := string(enc)
+	if i, ok := p.index[key]; ok {
+		return i
+	}
+	p.values = append(p.values, v)
+	p.index[key] = len(p.values) - 1
+	return len(p.values) - 1
+}
+
+/* ---------- Constant pool encoding ---------- */
+
+// The pool is a uvarint count followed by tagged values:
+//
+//	tagNull
+//	tagFalse, tagTrue
+//	tagInt    zigzag varint
+//	tagFloat  u64 IEEE 754 bits, so NaN payloads and -0 survive
+//	tagString uvarint length, bytes
+//	tagChar   uvarint code point
+//	tagFunc   name, uvarint arity, uvarint code length, code, nested pool
+//	tagClass  name, uvarint field count, fields, uvarint method count,
+//	          methods encoded as tagFunc bodies
+const (
+	tagNull byte = iota
+	tagFalse
+	tagTrue
+	tagInt
+	tagFloat
+	tagString
+	tagChar
+	tagFunc
+	tagClass
+)
+
+// maxConstDepth bounds prototype nesting so a hostile blob cannot blow the
+// decoder's stack.
+const maxConstDepth = 64
+
+func encodeConsts(consts []interface{}) ([]byte, error) {
+	return appendPool(nil, consts)
+}
+
+func appendPool(b []byte, consts []interface{}) ([]byte, error) {
+	b = binary.AppendUvarint(b, uint64(len(consts)))
+	for i, c := range consts {
+		var err error
+		b, err = appendConst(b, c)
+		if err != nil {
+			return nil, fmt.Errorf("constant %d: %w", i, err)
+		}
+	}
+	return b, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendConst(b []byte, c interface{}) ([]byte, error) {
+	switch v := c.(type) {
+	case nil:
+		return append(b, tagNull), nil
+	case bool:
+		if v {
+			return append(b, tagTrue), nil
+		}
+		return append(b, tagFalse), nil
+	case int64:
+		return binary.AppendVarint(append(b, tagInt), v), nil
+	case float64:
+		return binary.LittleEndian.AppendUint64(append(b, tagFloat), math.Float64bits(v)), nil
+	case string:
+		return appendString(append(b, tagString), v), nil
+	case Char:
+		return binary.AppendUvarint(append(b, tagChar), uint64(uint32(v))), nil
+	case *FuncProto:
+		return appendFunc(append(b, tagFunc), v)
+	case *ClassProto:
+		b = appendString(append(b, tagClass), v.Name)
+		b = binary.AppendUvarint(b, uint64(len(v.Fields)))
+		for _, f := range v.Fields {
+			b = appendString(b, f)
+		}
+		b = binary.AppendUvarint(b, uint64(len(v.Methods)))
+		for _, m := range v.Methods {
+			var err error
+			if b, err = appendFunc(b, m); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("cannot encode constant of type %T", c)
+}
+
+func appendFunc(b []byte, f *FuncProto) ([]byte, error) {
+	b = appendString(b, f.Name)
+	b = binary.AppendUvarint(b, uint64(f.Arity))
+	b = binary.AppendUvarint(b, uint64(len(f.Code)))
+	b = append(b, f.Code...)
+	return appendPool(b, f.Consts)
+}
+
+// byteReader decodes the varint based sections: the constant pool, the
+// symbol table and the relocation table.
+type byteReader struct {
+	what string // section name for errors
+	data []byte
+	pos  int
+}
+
+func (r *byteReader) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s at byte %d: %s", ErrCorrupt, r.what, r.pos, fmt.Sprintf(format, args...))
+}
+
+func (r *byteReader) done() error {
+	if r.pos != len(r.data) {
+		return r.errorf("%d trailing bytes", len(r.data)-r.pos)
+	}
+	return nil
+}
+
+func (r *byteReader) byte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, r.errorf("unexpected end")
+	}
+	c := r.data[r.pos]
+	r.pos++
+	return c, nil
+}
+
+func (r *byteReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		return 0, r.errorf("bad varint")
+	}
+	r.pos += n
+	return v, nil
+}
+
+// count reads a length prefix and checks it against the bytes left, so a
+// corrupt length cannot make us allocate gigabytes.
+func (r *byteReader) count() (int, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(r.data)-r.pos) {
+		return 0, r.errorf("length %d past end", n)
+	}
+	return int(n), nil
+}
+
+func (r *byteReader) bytes() ([]byte, error) {
+	n, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *byteReader) string() (string, error) {
+	b, err := r.bytes()
+	return string(b), err
+}
+
+func decodeConsts(data []byte) ([]interface{}, error) {
+	r := &byteReader{what: "constant pool", data: data}
+	consts, err := r.pool(0)
+	if err != nil {
+		return nil, err
+	}
+	return consts, r.done()
+}
+
+func (r *byteReader) pool(depth int) ([]interface{}, error) {
+	if depth > maxConstDepth {
+		return nil, r.errorf("prototypes nested too deeply")
+	}
+	n, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	consts := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		c, err := r.value(depth)
+		if err != nil {
+			return nil, err
+		}
+		consts = append(consts, c)
+	}
+	return consts, nil
+}
+
+func (r *byteReader) value(depth int) (interface{}, error) {
+	tag, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case tagNull:
+		return nil, nil
+	case tagFalse:
+		return false, nil
+	case tagTrue:
+		return true, nil
+	case tagInt:
+		v, n := binary.Varint(r.data[r.pos:])
+		if n <= 0 {
+			return nil, r.errorf("bad int")
+		}
+		r.pos += n
+		return v, nil
+	case tagFloat:
+		if r.pos+8 > len(r.data) {
+			return nil, r.errorf("unexpected end")
+		}
+		bits := binary.LittleEndian.Uint64(r.data[r.pos:])
+		r.pos += 8
+		return math.Float64frombits(bits), nil
+	case tagString:
+		return r.string()
+	case tagChar:
+		v, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if v > math.MaxUint32 {
+			return nil, r.errorf("char out of range")
+		}
+		return Char(uint32(v)), nil
+	case tagFunc:
+		return r.function(depth)
+	case tagClass:
+		cls := &ClassProto{}
+		if cls.Name, err = r.string(); err != nil {
+			return nil, err
+		}
+		nf, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < nf; i++ {
+			f, err := r.string()
+			if err != nil {
+				return nil, err
+			}
+			cls.Fields = append(cls.Fields, f)
+		}
+		nm, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < nm; i++ {
+			m, err := r.function(depth)
+			if err != nil {
+				return nil, err
+			}
+			cls.Methods = append(cls.Methods, m)
+		}
+		return cls, nil
+	}
+	return nil, r.errorf("unknown tag %d", tag)
+}
+
+func (r *byteReader) function(depth int) (*FuncProto, error) {
+	f := &FuncProto{}
+	var err error
+	if f.Name, err = r.string(); err != nil {
+		return nil, err
+	}
+	arity, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if arity > 255 {
+		return nil, r.errorf("arity %d out of range", arity)
+	}
+	f.Arity = int(arity)
+	if f.Code, err = r.bytes(); err != nil {
+		return nil, err
+	}
+	if f.Consts, err = r.pool(depth + 1); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,200 @@
+package vm
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// sameConst compares constants by value and type, with NaN equal to itself
+// and -0.0 apart from 0.0, as the pool keeps them.
+func sameConst(a, b interface{}) bool {
+	if af, ok := a.(float64); ok {
+		bf, ok := b.(float64)
+		return ok && math.Float64bits(af) == math.Float64bits(bf)
+	}
+	return a == b
+}
+
+func TestConstPoolRoundTrip(t *testing.T) {
+	consts := []interface{}{
+		nil,
+		false,
+		true,
+		int64(0),
+		int64(-1),
+		int64(math.MaxInt64),
+		int64(math.MinInt64),
+		1.5,
+		math.Copysign(0, -1),
+		math.Inf(1),
+		math.Float64frombits(0x7ff8000000000123), // a NaN with a payload
+		"",
+		"héllo\n\x00",
+		Char('a'),
+		Char('€'),
+	}
+	data, err := encodeConsts(consts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeConsts(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(consts) {
+		t.Fatalf("decoded %d constants, want %d", len(got), len(consts))
+	}
+	for i := range consts {
+		if !sameConst(got[i], consts[i]) {
+			t.Errorf("constant %d = %#v (%T), want %#v (%T)", i, got[i], got[i], consts[i], consts[i])
+		}
+	}
+}
+
+// Function and class prototypes carry their own code and a nested pool,
+// and come back equal to what was written.
+func TestConstPoolPrototypes(t *testing.T) {
+	inner := &FuncProto{Name: "inner", Arity: 0, Code: []byte{OpHalt}, Consts: []interface{}{Char('x'), math.Copysign(0, -1)}}
+	outer := &FuncProto{Name: "outer", Arity: 2, Code: []byte{OpLoadConst, 1, 0, OpReturn}, Consts: []interface{}{"s", inner, int64(-5)}}
+	class := &ClassProto{
+		Name:    "Point",
+		Fields:  []string{"x", "y"},
+		Methods: []*FuncProto{{Name: "len", Arity: 1, Code: []byte{OpReturn}}, outer},
+	}
+	consts := []interface{}{int64(1), outer, class, &ClassProto{Name: "Empty"}, &FuncProto{Name: "f"}}
+	data, err := encodeConsts(consts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeConsts(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the decoder gives empty slices as nil and the pool keeps -0.0 apart
+	// from 0.0, so compare by encoding as well as structure
+	again, err := encodeConsts(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(data) {
+		t.Error("re-encoding decoded prototypes changed them")
+	}
+	if f := got[1].(*FuncProto); f.Name != "outer" || f.Arity != 2 || !reflect.DeepEqual(f.Code, outer.Code) || len(f.Consts) != 3 {
+		t.Errorf("outer decoded as %+v", f)
+	} else if in := f.Consts[1].(*FuncProto); in.Name != "inner" || !sameConst(in.Consts[1], inner.Consts[1]) || in.Consts[0] != Char('x') {
+		t.Errorf("inner decoded as %+v", in)
+	}
+	if c := got[2].(*ClassProto); c.Name != "Point" || !reflect.DeepEqual(c.Fields, class.Fields) || len(c.Methods) != 2 || c.Methods[1].Consts[1].(*FuncProto).Name != "inner" {
+		t.Errorf("class decoded as %+v", c)
+	}
+	if FormatConst(got[1]) != "func outer/2" || FormatConst(got[2]) != "class Point" {
+		t.Errorf("prototypes format as %s and %s", FormatConst(got[1]), FormatConst(got[2]))
+	}
+}
+
+// Prototypes nest, so the decoder bounds how deep a hostile pool can make
+// it recurse.
+func TestConstPoolPrototypeDepth(t *testing.T) {
+	// maxConstDepth functions, each holding the next in its pool
+	f := &FuncProto{Name: "f"}
+	for i := 1; i < maxConstDepth; i++ {
+		f = &FuncProto{Name: "f", Consts: []interface{}{f}}
+	}
+	data, err := encodeConsts([]interface{}{f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeConsts(data); err != nil {
+		t.Errorf("%d levels of nesting: %v", maxConstDepth, err)
+	}
+	data, err = encodeConsts([]interface{}{&FuncProto{Name: "g", Consts: []interface{}{f}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeConsts(data); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("%d levels of nesting: got %v, want ErrCorrupt", maxConstDepth+1, err)
+	}
+}
+
+func TestConstPoolInterning(t *testing.T) {
+	p := newConstPool()
+	a := p.add(int64(1))
+	if b := p.add(int64(1)); b != a {
+		t.Errorf("1 added twice got slots %d and %d", a, b)
+	}
+	distinct := []interface{}{1.0, Char(1), "1", true, nil, 0.0, math.Copysign(0, -1)}
+	seen := map[int]interface{}{a: int64(1)}
+	for _, v := range distinct {
+		i := p.add(v)
+		if prev, dup := seen[i]; dup {
+			t.Errorf("%#v shares slot %d with %#v", v, i, prev)
+		}
+		seen[i] = v
+	}
+	if len(p.values) != len(distinct)+1 {
+		t.Errorf("pool has %d values, want %d", len(p.values), len(distinct)+1)
+	}
+}
+
+func TestConstPoolEncodeError(t *testing.T) {
+	if _, err := encodeConsts([]interface{}{int64(1), []int{2}}); err == nil {
+		t.Error("encoding a []int constant succeeded")
+	}
+}
+
+func TestConstPoolCorrupt(t *testing.T) {
+	good, err := encodeConsts([]interface{}{"abc", int64(300), 2.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated", good[:len(good)-1]},
+		{"trailing bytes", append(append([]byte(nil), good...), 0)},
+		{"unknown tag", []byte{1, 0x7f}},
+		{"count past end", []byte{0xff, 0xff, 0x03}},
+		{"string past end", []byte{1, tagString, 10, 'a'}},
+		{"char out of range", []byte{1, tagChar, 0xff, 0xff, 0xff, 0xff, 0x7f}},
+		{"func code past end", []byte{1, tagFunc, 1, 'f', 0, 5, OpHalt}},
+		{"func arity out of range", []byte{1, tagFunc, 1, 'f', 0x80, 0x02, 0, 0}},
+		{"func without its pool", []byte{1, tagFunc, 1, 'f', 0, 1, OpHalt}},
+		{"class method count past end", []byte{1, tagClass, 1, 'C', 0, 0x7f}},
+	}
+	for _, tt := range tests {
+		if _, err := decodeConsts(tt.data); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: got %v, want ErrCorrupt", tt.name, err)
+		}
+	}
+}
+
+func TestProgramConstsRoundTrip(t *testing.T) {
+	blob, err := CompileSourceToBlob("t.quark", "let a = \"x\";\nlet b = 42;\nlet c = 7 / 2;\nprint(a, b, c, \"x\", 42);\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := DecodeProgram(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := EncodeProgram(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(blob) {
+		t.Error("re-encoding a decoded program changed it")
+	}
+	count := map[interface{}]int{}
+	for _, c := range p.Consts {
+		count[c]++
+	}
+	for _, c := range []interface{}{"x", int64(42), int64(7), int64(2)} {
+		if count[c] != 1 {
+			t.Errorf("constant %#v is in the pool %d times, want once", c, count[c])
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/* ---------- Debugger ---------- */
+
+// StopReason says why the debugger handed control back.
+type StopReason int
+
+const (
+	StopStep       StopReason = iota // a step finished
+	StopBreakpoint                   // a breakpoint was reached
+	StopPause                        // the context was canceled
+	StopHalted                       // the program finished
+	StopError                        // the program failed, see the returned error
+)
+
+var stopReasonNames = [...]string{
+	StopStep:       "step",
+	StopBreakpoint: "breakpoint",
+	StopPause:      "pause",
+	StopHalted:     "halted",
+	StopError:      "error",
+}
+
+func (r StopReason) String() string {
+	if int(r) < len(stopReasonNames) {
+		return stopReasonNames[r]
+	}
+	return fmt.Sprintf("StopReason(%d)", int(r))
+}
+
+// Debugger runs a loaded VM under control: to line breakpoints, or a
+// statement at a time. Breakpoints and steps use the program's line table;
+// a program without one can only be run to the end. The debugger stops
+// before the first instruction of a line, and only between instructions,
+// so the VM can be inspected whenever a run method has returned.
+type Debugger struct {
+	m      *VM
+	starts map[int]SrcLine  // address -> the line whose code starts there
+	lines  map[string][]int // file -> lines with code, ascending
+	breaks map[SrcLine]bool
+	err    error // the error the program failed with
+	// stopped is the address the last run stopped at, or -1. The next run
+	// starts by running that instruction, so a breakpoint there is left
+	// rather than hit again.
+	stopped int
+}
+
+// Variable is a named value in a frame or a global slot.
+type Variable struct {
+	Name  string
+	Value Value
+}
+
+// FiberInfo describes an unfinished fiber.
+type FiberInfo struct {
+	ID      int
+	Running bool
+	State   string // "running", "runnable" or "blocked in <builtin>"
+	Trace   []TraceFrame
+}
+
+// NewDebugger debugs the program loaded in m.
+func NewDebugger(m *VM) *Debugger {
+	d := &Debugger{m: m, breaks: map[SrcLine]bool{}, stopped: -1}
+	d.index()
+	return d
+}
+
+// index collects where each line's code starts.
+func (d *Debugger) index() {
+	d.starts = map[int]SrcLine{}
+	d.lines = map[string][]int{}
+	seen := map[SrcLine]bool{}
+	for _, l := range d.m.prog.Lines {
+		if l.Line == 0 {
+			continue
+		}
+		sl := SrcLine{l.File, l.Line}
+		d.starts[l.Addr] = sl
+		if !seen[sl] {
+			seen[sl] = true
+			d.lines[l.File] = append(d.lines[l.File], l.Line)
+		}
+	}
+	for _, ls := range d.lines {
+		sort.Ints(ls)
+	}
+}
+
+// VM is the machine being debugged.
+func (d *Debugger) VM() *VM { return d.m }
+
+// Restart reloads the program from the start, keeping the breakpoints.
+func (d *Debugger) Restart() error {
+	d.err, d.stopped = nil, -1
+	return d.m.LoadProgram(d.m.prog)
+}
+
+// Files lists the source files in the line table.
+func (d *Debugger) Files() []string {
+	files := make([]string, 0, len(d.lines))
+	for f := range d.lines {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// resolveFile finds the line table's name for file. Paths match when one
+// is a suffix of the other at a directory boundary, so an editor's
+// absolute path finds the project-relative name in the table.
+func (d *Debugger) resolveFile(file string) (string, bool) {
+	if _, ok := d.lines[file]; ok {
+		return file, true
+	}
+	file = filepath.ToSlash(filepath.Clean(file))
+	for name := range d.lines {
+		n := filepath.ToSlash(filepath.Clean(name))
+		if n == file || strings.HasSuffix(file, "/"+n) || strings.HasSuffix(n, "/"+file) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// SetBreakpoint sets a breakpoint on the first line at or after line in
+// file that has code. It returns where the breakpoint went, or ok false
+// if there is no such line.
+func (d *Debugger) SetBreakpoint(file string, line int) (at SrcLine, ok bool) {
+	name, ok := d.resolveFile(file)
+	if !ok {
+		return SrcLine{}, false
+	}
+	ls := d.lines[name]
+	i := sort.SearchInts(ls, line)
+	if i == len(ls) {
+		return SrcLine{}, false
+	}
+	at = SrcLine{name, ls[i]}
+	d.breaks[at] = true
+	return at, true
+}
+
+// ClearBreakpoint removes the breakpoint at file:line, if there is one.
+func (d *Debugger) ClearBreakpoint(file string, line int) bool {
+	name, ok := d.resolveFile(file)
+	if !ok || !d.breaks[SrcLine{name, line}] {
+		return false
+	}
+	delete(d.breaks, SrcLine{name, line})
+	return true
+}
+
+// ClearBreakpoints removes every breakpoint in file, or all of them if
+// file is "".
+func (d *Debugger) ClearBreakpoints(file string) {
+	name, _ := d.resolveFile(file)
+	for b := range d.breaks {
+		if file == "" || b.File == name {
+			delete(d.breaks, b)
+		}
+	}
+}
+
+// Breakpoints lists the breakpoints in file and line order.
+func (d *Debugger) Breakpoints() []SrcLine {
+	bs := make([]SrcLine, 0, len(d.breaks))
+	for b := range d.breaks {
+		bs = append(bs, b)
+	}
+	sort.Slice(bs, func(i, j int) bool {
+		if bs[i].File != bs[j].File {
+			return bs[i].File < bs[j].File
+		}
+		return bs[i].Line < bs[j].Line
+	})
+	return bs
+}
+
+// Continue runs until a breakpoint, the end of the program, an error or
+// ctx is canceled.
+func (d *Debugger) Continue(ctx context.Context) (StopReason, error) {
+	return d.run(ctx, func() bool { return false })
+}
+
+// StepIn runs to the next line of the running fiber, entering calls.
+func (d *Debugger) StepIn(ctx context.Context) (StopReason, error) {
+	f, depth, line := d.m.cur, len(d.m.frames), d.line()
+	return d.run(ctx, func() bool {
+		l, ok := d.starts[d.m.ip]
+		if !ok || f.state == fiberDone {
+			return ok
+		}
+		return d.m.cur == f && (l != line || len(d.m.frames) != depth)
+	})
+}
+
+// StepOver runs to the next line of the running fiber in the same call or
+// a caller, running calls made on the way to the end.
+func (d *Debugger) StepOver(ctx context.Context) (StopReason, error) {
+	f, depth, line := d.m.cur, len(d.m.frames), d.line()
+	return d.run(ctx, func() bool {
+		l, ok := d.starts[d.m.ip]
+		if !ok || f.state == fiberDone {
+			return ok
+		}
+		return d.m.cur == f && (len(d.m.frames) < depth || len(d.m.frames) == depth && l != line)
+	})
+}
+
+// StepOut runs until the running call returns, stopping in its caller
+// just after the call. Stepping out of a fiber's bottom frame stops at
+// the next line run by any fiber.
+func (d *Debugger) StepOut(ctx context.Context) (StopReason, error) {
+	f, depth := d.m.cur, len(d.m.frames)
+	return d.run(ctx, func() bool {
+		if f.state == fiberDone {
+			_, ok := d.starts[d.m.ip]
+			return ok
+		}
+		return d.m.cur == f && len(d.m.frames) < depth
+	})
+}
+
+// line is the line the running fiber is on.
+func (d *Debugger) line() SrcLine {
+	file, line, _ := d.m.prog.LineAt(d.m.ip)
+	return SrcLine{file, line}
+}
+
+// run steps the VM until done reports true, checked between instructions,
+// or something else stops it. A breakpoint at the instruction the last run
+// stopped at is not hit again, so continuing from a breakpoint leaves it,
+// while one on the first instruction stops the first run.
+func (d *Debugger) run(ctx context.Context, done func() bool) (StopReason, error) {
+	if d.err != nil {
+		return StopError, d.err
+	}
+	if d.m.halted {
+		return StopHalted, nil
+	}
+	resumed := d.stopped == d.m.ip
+	d.stopped = -1
+	for n := 0; ; n++ {
+		if n%checkEvery == 0 && ctx.Err() != nil {
+			return d.stop(StopPause), nil
+		}
+		if n > 0 || !resumed {
+			if l, ok := d.starts[d.m.ip]; ok && d.breaks[l] {
+				return d.stop(StopBreakpoint), nil
+			}
+		}
+		if n > 0 && done() {
+			return d.stop(StopStep), nil
+		}
+		if err := d.m.Step(); err != nil {
+			d.err = err
+			return StopError, err
+		}
+		if d.m.halted {
+			return StopHalted, nil
+		}
+	}
+}
+
+// stop notes that the VM stopped at its current instruction.
+func (d *Debugger) stop(r StopReason) StopReason {
+	d.stopped = d.m.ip
+	return r
+}
+
+// Err is the error the program failed with, if it has.
+func (d *Debugger) Err() error { return d.err }
+
+// Location is the line the running fiber will run next.
+func (d *Debugger) Location() TraceFrame {
+	return d.Stack()[0]
+}
+
+// Stack is the running fiber's call stack, innermost call first.
+func (d *Debugger) Stack() []TraceFrame {
+	return d.m.Trace(d.m.ip)
+}
+
+// Fibers describes the unfinished fibers, in the order they were spawned.
+func (d *Debugger) Fibers() []FiberInfo {
+	infos := make([]FiberInfo, 0, len(d.m.fibers))
+	for _, f := range d.m.fibers {
+		frames, addr := d.fiberFrames(f)
+		info := FiberInfo{ID: f.id, Running: f == d.m.cur, Trace: traceFrames(d.m.prog, frames, addr)}
+		switch {
+		case info.Running:
+			info.State = "running"
+		case f.state == fiberBlocked:
+			info.State = "blocked in " + f.blockedIn
+		default:
+			info.State = "runnable"
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// fiberFrames returns f's frames and the address its innermost frame is at.
+func (d *Debugger) fiberFrames(f *fiber) ([]frame, int) {
+	if f == d.m.cur {
+		return d.m.frames, d.m.ip
+	}
+	if f.state == fiberBlocked || f.resume {
+		// inside the builtin call it blocked in
+		return f.frames, f.ip - 1
+	}
+	return f.frames, f.ip
+}
+
+func (d *Debugger) fiber(id int) (*fiber, error) {
+	for _, f := range d.m.fibers {
+		if f.id == id {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("no fiber %d", id)
+}
+
+// Locals returns the variables of a frame of fiber id, counting depth from
+// the innermost call. The module initialiser's frame has none; its
+// variables are Globals.
+func (d *Debugger) Locals(id, depth int) ([]Variable, error) {
+	f, err := d.fiber(id)
+	if err != nil {
+		return nil, err
+	}
+	frames, _ := d.fiberFrames(f)
+	if depth < 0 || depth >= len(frames) {
+		return nil, fmt.Errorf("fiber %d has no frame %d", id, depth)
+	}
+	fr := frames[len(frames)-1-depth]
+	vars := make([]Variable, 0, len(fr.locals))
+	for i, v := range fr.locals {
+		name := fr.fn.LocalName(i)
+		if name == "" {
+			name = fmt.Sprintf("local%d", i)
+		}
+		vars = append(vars, Variable{name, v})
+	}
+	return vars, nil
+}
+
+// Globals returns the global variables assigned so far, by slot.
+func (d *Debugger) Globals() []Variable {
+	var vars []Variable
+	for i, v := range d.m.globals {
+		if v == unset {
+			continue
+		}
+		name := d.m.prog.GlobalName(i)
+		if name == "" {
+			name = fmt.Sprintf("global%d", i)
+		}
+		vars = append(vars, Variable{name, v})
+	}
+	return vars
+}
+
+// ErrNoVariable is returned by Lookup for a name that is not in scope.
+var ErrNoVariable = errors.New("no such variable")
+
+// Lookup finds a variable as code in the frame would see it: the latest
+// local of that name, then the latest global.
+func (d *Debugger) Lookup(id, depth int, name string) (Value, error) {
+	locals, err := d.Locals(id, depth)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(locals) - 1; i >= 0; i-- {
+		if locals[i].Name == name {
+			return locals[i].Value, nil
+		}
+	}
+	globals := d.Globals()
+	for i := len(globals) - 1; i >= 0; i-- {
+		if globals[i].Name == name {
+			return globals[i].Value, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %s", ErrNoVariable, name)
+}
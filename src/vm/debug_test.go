@@ -0,0 +1,148 @@
+package vm
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+const debugSrc = `let a = 1;
+func f(x) {
+    let y = x + 1;
+    return y;
+}
+let b = f(a);
+print(b);
+`
+
+func newDebugger(t *testing.T) *Debugger {
+	t.Helper()
+	p, err := Link([]Object{compileObject(t, "main.quark", debugSrc)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewVM()
+	m.Stdout = io.Discard
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatal(err)
+	}
+	return NewDebugger(m)
+}
+
+// wantStop runs one debugger command and checks why and, unless the
+// program ended, at which line it stopped.
+func wantStop(t *testing.T, d *Debugger, run func(context.Context) (StopReason, error), reason StopReason, line int) {
+	t.Helper()
+	r, err := run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != reason {
+		t.Fatalf("stopped for %v at %v, want %v", r, d.Location(), reason)
+	}
+	if r != StopHalted && d.Location().Line != line {
+		t.Fatalf("stopped for %v at %v, want line %d", r, d.Location(), line)
+	}
+}
+
+func TestDebuggerBreakpoints(t *testing.T) {
+	d := newDebugger(t)
+	for _, line := range []int{1, 4, 7} {
+		if _, ok := d.SetBreakpoint("main.quark", line); !ok {
+			t.Fatalf("no breakpoint on line %d", line)
+		}
+	}
+	wantStop(t, d, d.Continue, StopBreakpoint, 1)
+	wantStop(t, d, d.Continue, StopBreakpoint, 4)
+	wantStop(t, d, d.Continue, StopBreakpoint, 7)
+	wantStop(t, d, d.Continue, StopHalted, 0)
+
+	// the first instruction stops the first run every time
+	if err := d.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	wantStop(t, d, d.Continue, StopBreakpoint, 1)
+	d.ClearBreakpoints("")
+	wantStop(t, d, d.Continue, StopHalted, 0)
+}
+
+// A breakpoint on a line with no code goes to the next line that has some.
+func TestDebuggerBreakpointMoves(t *testing.T) {
+	d := newDebugger(t)
+	at, ok := d.SetBreakpoint("/home/me/project/main.quark", 2)
+	if !ok || at != (SrcLine{"main.quark", 3}) {
+		t.Fatalf("breakpoint on line 2 went to %v, %v", at, ok)
+	}
+	if _, ok := d.SetBreakpoint("main.quark", 8); ok {
+		t.Error("a breakpoint past the last line was set")
+	}
+	if _, ok := d.SetBreakpoint("other.quark", 1); ok {
+		t.Error("a breakpoint in another file was set")
+	}
+	wantStop(t, d, d.Continue, StopBreakpoint, 3)
+	if v, err := d.Lookup(0, 0, "x"); err != nil || v != int64(1) {
+		t.Errorf("x is %v, %v", v, err)
+	}
+	if !d.ClearBreakpoint("main.quark", 3) || d.ClearBreakpoint("main.quark", 3) {
+		t.Error("ClearBreakpoint did not clear the breakpoint once")
+	}
+}
+
+func TestDebuggerSteps(t *testing.T) {
+	d := newDebugger(t)
+	wantStop(t, d, d.StepOver, StopStep, 6)
+	wantStop(t, d, d.StepIn, StopStep, 3)
+	if got := d.Stack(); len(got) != 2 || got[0].Func != "f" || got[1].Line != 6 {
+		t.Errorf("stack in f: %v", got)
+	}
+	wantStop(t, d, d.StepOver, StopStep, 4)
+	if v, err := d.Lookup(0, 0, "y"); err != nil || v != int64(2) {
+		t.Errorf("y is %v, %v", v, err)
+	}
+	wantStop(t, d, d.StepOut, StopStep, 6)
+	wantStop(t, d, d.StepOver, StopStep, 7)
+	if v, err := d.Lookup(0, 0, "b"); err != nil || v != int64(2) {
+		t.Errorf("b is %v, %v", v, err)
+	}
+	wantStop(t, d, d.StepOver, StopHalted, 0)
+	wantStop(t, d, d.StepOver, StopHalted, 0)
+}
+
+// Stepping onto a breakpoint stops there once, and continuing leaves it.
+func TestDebuggerStepOntoBreakpoint(t *testing.T) {
+	d := newDebugger(t)
+	d.SetBreakpoint("main.quark", 6)
+	wantStop(t, d, d.StepOver, StopBreakpoint, 6)
+	wantStop(t, d, d.Continue, StopHalted, 0)
+}
+
+func TestDebuggerPause(t *testing.T) {
+	d := newDebugger(t)
+	d.SetBreakpoint("main.quark", 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if r, err := d.Continue(ctx); r != StopPause || err != nil {
+		t.Fatalf("Continue with a canceled context: %v, %v", r, err)
+	}
+	// the pause was at the breakpoint, so continuing runs on from it
+	wantStop(t, d, d.Continue, StopHalted, 0)
+}
+
+func TestDebuggerError(t *testing.T) {
+	p, err := Link([]Object{compileObject(t, "main.quark", "let s = \"a\";\nprint(s - 1);\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewVM()
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDebugger(m)
+	r, err := d.Continue(context.Background())
+	if r != StopError || err == nil || d.Err() != err {
+		t.Fatalf("got %v, %v, want StopError", r, err)
+	}
+	if r, again := d.StepIn(context.Background()); r != StopError || again != err {
+		t.Errorf("running after the error: %v, %v", r, again)
+	}
+}
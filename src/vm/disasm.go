@@ -0,0 +1,252 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/* ---------- Disassembler ---------- */
+
+// Disassemble writes a listing of p. The listing is valid input for
+// Assemble: addresses are written as "0012:" markers the assembler skips,
+// jump targets get "L0012:" labels, line table entries become .line
+// directives, variable names .global and .local directives, and decoded
+// operands are explained in ; comments.
+func Disassemble(w io.Writer, p *Program) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "; format version %d, %d bytes of code, %d constant(s), %d code object(s)\n",
+		FormatVersion, len(p.Code), len(p.Consts), len(p.Funcs))
+	fmt.Fprintf(bw, ".flags%s\n", flagNames(p.Flags))
+	if p.Globals > 0 {
+		fmt.Fprintf(bw, ".globals %d\n", p.Globals)
+	}
+	for i, name := range p.GlobalNames {
+		fmt.Fprintf(bw, ".global %d %s\n", i, asmName(name))
+	}
+	for i, name := range p.Builtins {
+		fmt.Fprintf(bw, "%-38s ; #%d\n", ".builtin "+asmName(name), i)
+	}
+
+	if len(p.Consts) > 0 {
+		fmt.Fprintf(bw, "\n.const\n")
+		for i, c := range p.Consts {
+			fmt.Fprintf(bw, "    %-30s ; #%d\n", FormatConst(c), i)
+		}
+	}
+
+	fmt.Fprintf(bw, "\n.code\n")
+	entries := map[int][]int{}
+	for i, co := range p.Funcs {
+		entries[co.Entry] = append(entries[co.Entry], i)
+	}
+	// first pass: find jump targets so they can be labelled
+	targets := map[int]bool{}
+	for addr := 0; addr < len(p.Code); {
+		in, err := DecodeInstr(p.Code, addr)
+		if err != nil {
+			break
+		}
+		for i, k := range opInfo[in.Op].Operands {
+			if k == OperandAddr {
+				targets[in.Args[i]] = true
+			}
+		}
+		addr += in.Size
+	}
+
+	lineAt := map[int]LineInfo{}
+	for _, l := range p.Lines {
+		lineAt[l.Addr] = l
+	}
+	for addr := 0; addr < len(p.Code); {
+		for _, i := range entries[addr] {
+			writeCodeObject(bw, p, i)
+		}
+		if l, ok := lineAt[addr]; ok {
+			fmt.Fprintf(bw, ".line %s %d\n", asmName(l.File), l.Line)
+		}
+		if targets[addr] {
+			fmt.Fprintf(bw, "%s:\n", label(addr))
+		}
+		in, err := DecodeInstr(p.Code, addr)
+		if err != nil {
+			// dump the rest raw so the listing still reassembles
+			fmt.Fprintf(bw, "; %v\n", err)
+			for ; addr < len(p.Code); addr++ {
+				fmt.Fprintf(bw, "%04d:   .byte %d\n", addr, p.Code[addr])
+			}
+			break
+		}
+		text, note := formatInstr(p, in)
+		if note != "" {
+			fmt.Fprintf(bw, "%04d:   %-30s ; %s\n", addr, text, note)
+		} else {
+			fmt.Fprintf(bw, "%04d:   %s\n", addr, text)
+		}
+		addr += in.Size
+	}
+	// code objects with no code, or starting past the end
+	for i, co := range p.Funcs {
+		if co.Entry >= len(p.Code) {
+			writeCodeObject(bw, p, i)
+		}
+	}
+	return bw.Flush()
+}
+
+// writeCodeObject writes the directive that starts code object i.
+func writeCodeObject(w io.Writer, p *Program, i int) {
+	co := p.Funcs[i]
+	var dir string
+	switch co.Kind {
+	case CodeModule:
+		dir = fmt.Sprintf(".module %s", asmName(co.Name))
+	case CodeFunc:
+		dir = fmt.Sprintf(".func %s %d %d", asmName(co.Name), co.Arity, co.NumLocals)
+	default:
+		dir = fmt.Sprintf("; %v %s", co.Kind, co.Name)
+	}
+	fmt.Fprintf(w, "\n%-38s ; #%d, max stack %d, %d constant(s)\n", dir, i, co.MaxStack, len(co.Consts))
+	for slot, name := range co.Locals {
+		fmt.Fprintf(w, ".local %d %s\n", slot, asmName(name))
+	}
+}
+
+// asmName quotes a code object name unless it is a single plain word.
+func asmName(name string) string {
+	if name == "" || strings.ContainsAny(name, " \t,;\"'\\") {
+		return strconv.Quote(name)
+	}
+	return name
+}
+
+// funcRef is how a CALL operand is written: the callee's name when that is
+// unambiguous, otherwise its index.
+func funcRef(p *Program, fi int) string {
+	if fi >= len(p.Funcs) || !isIdent(p.Funcs[fi].Name) {
+		return strconv.Itoa(fi)
+	}
+	for i, co := range p.Funcs {
+		if i != fi && co.Name == p.Funcs[fi].Name {
+			return strconv.Itoa(fi)
+		}
+	}
+	return p.Funcs[fi].Name
+}
+
+// DisassembleBlob decodes blob and disassembles it.
+func DisassembleBlob(w io.Writer, blob []byte) error {
+	p, err := DecodeProgram(blob)
+	if err != nil {
+		return err
+	}
+	return Disassemble(w, p)
+}
+
+func label(addr int) string { return fmt.Sprintf("L%04d", addr) }
+
+func flagNames(flags uint16) string {
+	s := ""
+	if flags&FlagExecutable != 0 {
+		s += " executable"
+	}
+	return s
+}
+
+func formatInstr(p *Program, in Instr) (string, string) {
+	info := opInfo[in.Op]
+	name := info.Name
+	if in.Wide {
+		name = "WIDE " + name
+	}
+	parts := []string{fmt.Sprintf("%-14s", name)}
+	var notes []string
+	for i, k := range info.Operands {
+		arg := in.Args[i]
+		switch k {
+		case OperandAddr:
+			parts = append(parts, label(arg))
+			if arg >= len(p.Code) {
+				notes = append(notes, "target out of range")
+			}
+		case OperandConst:
+			parts = append(parts, strconv.Itoa(arg))
+			if arg < len(p.Consts) {
+				notes = append(notes, truncate(FormatConst(p.Consts[arg]), 40))
+			} else {
+				notes = append(notes, "const index out of range")
+			}
+		case OperandLocal, OperandGlobal:
+			parts = append(parts, strconv.Itoa(arg))
+		case OperandFunc:
+			parts = append(parts, funcRef(p, arg))
+			if arg < len(p.Funcs) {
+				notes = append(notes, fmt.Sprintf("#%d", arg))
+			} else {
+				notes = append(notes, "code object index out of range")
+			}
+		case OperandBuiltin:
+			if arg < len(p.Builtins) && isIdent(p.Builtins[arg]) {
+				parts = append(parts, p.Builtins[arg])
+			} else {
+				parts = append(parts, strconv.Itoa(arg))
+				notes = append(notes, "builtin index out of range")
+			}
+		case OperandArgc:
+			parts = append(parts, strconv.Itoa(arg))
+		}
+	}
+	return strings.TrimRight(strings.Join(parts, " "), " "), strings.Join(notes, ", ")
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
+
+// FormatConst renders a constant in assembler literal syntax.
+func FormatConst(c interface{}) string {
+	switch v := c.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return formatFloat(v)
+	case string:
+		return strconv.Quote(v)
+	case Char:
+		return strconv.QuoteRune(rune(v))
+	case *FuncProto:
+		return fmt.Sprintf("func %s/%d", v.Name, v.Arity)
+	case *ClassProto:
+		return fmt.Sprintf("class %s", v.Name)
+	}
+	return fmt.Sprintf("<%T>", c)
+}
+
+// formatFloat always produces something that reads back as a float, never
+// as an int.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "+inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eEn") {
+		s += ".0"
+	}
+	return s
+}
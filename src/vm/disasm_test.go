@@ -0,0 +1,140 @@
+package vm
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func disassemble(t *testing.T, p *Program) string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := Disassemble(&b, p); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// wantLines checks that each of want is a line of listing, ignoring
+// leading and trailing blanks.
+func wantLines(t *testing.T, listing string, want ...string) {
+	t.Helper()
+	lines := map[string]bool{}
+	for _, l := range strings.Split(listing, "\n") {
+		lines[strings.TrimSpace(l)] = true
+	}
+	for _, w := range want {
+		if !lines[w] {
+			t.Errorf("listing has no line %q:\n%s", w, listing)
+		}
+	}
+}
+
+func TestDisassembleProgram(t *testing.T) {
+	p, err := Link([]Object{compileObject(t, "t.quark", `let x = 1;
+let s = "str";
+func f(a, b) { return a % b; }
+print(f(7, 3), s, x);
+`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLines(t, disassemble(t, p),
+		".flags executable",
+		".globals 2",
+		".builtin print                         ; #0",
+		`"str"                          ; #1`,
+		".module <main>                         ; #0, max stack 3, 4 constant(s)",
+		".line t.quark 1",
+		"0000:   LOAD_CONST     0               ; 1",
+		"0003:   STORE_GLOBAL   0",
+		"0018:   CALL           f 2             ; #1",
+		"0028:   CALL_BUILTIN   print 3",
+		"0032:   HALT",
+		".func f 2 2                            ; #1, max stack 2, 0 constant(s)",
+		".line t.quark 3",
+		"0039:   MOD",
+	)
+}
+
+func TestDisassembleJumps(t *testing.T) {
+	p := assemble(t, `
+.const
+    one: 1
+.code
+top:
+    LOAD_CONST one
+    JUMP_IF_FALSE done
+    JUMP top
+done:
+    WIDE JUMP done
+`)
+	wantLines(t, disassemble(t, p),
+		"L0000:",
+		"0003:   JUMP_IF_FALSE  L0009",
+		"0006:   JUMP           L0000",
+		"L0009:",
+		"0009:   WIDE JUMP      L0009",
+	)
+}
+
+// Broken code is still listed, with what is wrong with it, so a bad gluon
+// can be looked at.
+func TestDisassembleBadCode(t *testing.T) {
+	p := assemble(t, `
+.code
+    LOAD_CONST 7
+    JUMP 500
+    CALL_BUILTIN 3 0
+    HALT
+    .byte 250 1
+`)
+	wantLines(t, disassemble(t, p),
+		"0000:   LOAD_CONST     7               ; const index out of range",
+		"0003:   JUMP           L0500           ; target out of range",
+		"0006:   CALL_BUILTIN   3 0             ; builtin index out of range",
+		"; unknown opcode 250 at 10",
+		"0010:   .byte 250",
+		"0011:   .byte 1",
+	)
+}
+
+func TestDisassembleBlob(t *testing.T) {
+	blob, err := CompileSourceToBlob("t.quark", "print(1);\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := DisassembleBlob(&b, blob); err != nil {
+		t.Fatal(err)
+	}
+	wantLines(t, b.String(), ".flags", ".module t.quark                        ; #0, max stack 1, 1 constant(s)")
+	if err := DisassembleBlob(&b, blob[:10]); !IsBlobError(err) {
+		t.Errorf("truncated blob: got %v, want a blob error", err)
+	}
+}
+
+func TestFormatConst(t *testing.T) {
+	tests := []struct {
+		c    interface{}
+		want string
+	}{
+		{nil, "null"},
+		{true, "true"},
+		{int64(-3), "-3"},
+		{2.0, "2.0"},
+		{1e21, "1e+21"},
+		{math.NaN(), "nan"},
+		{math.Inf(-1), "-inf"},
+		{"a\"b\n", `"a\"b\n"`},
+		{Char('é'), "'é'"},
+		{&FuncProto{Name: "f", Arity: 2}, "func f/2"},
+		{&ClassProto{Name: "C"}, "class C"},
+	}
+	for _, tt := range tests {
+		if got := FormatConst(tt.c); got != tt.want {
+			t.Errorf("FormatConst(%#v) = %s, want %s", tt.c, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package vm
+
+/* ---------- Pre-decoded instructions ---------- */
+
+// instr is an instruction decoded once when the program is loaded, so the
+// interpreter loop does not decode operands or check bounds. The stream
+// is indexed by code address: ip stays a byte address, as the line table,
+// frames and traces expect, and the entries between instruction starts
+// are opInvalid.
+type instr struct {
+	op   byte
+	size uint8 // bytes of code, with the WIDE prefix; the next instruction is at addr+size
+	a, b int   // operands
+}
+
+// opInvalid marks an address where no instruction starts. No opcode has
+// this value.
+const opInvalid byte = 0xff
+
+// predecode decodes every code object of a verified program. Bytes the
+// verifier proved unreachable may not decode; they stay opInvalid.
+func predecode(p *Program) []instr {
+	code := make([]instr, len(p.Code))
+	for i := range code {
+		code[i].op = opInvalid
+	}
+	for _, co := range p.Funcs {
+		for addr := co.Entry; addr < co.Entry+co.Size; {
+			in, err := DecodeInstr(p.Code[:co.Entry+co.Size], addr)
+			if err != nil {
+				break
+			}
+			d := instr{op: in.Op, size: uint8(in.Size)}
+			if len(in.Args) > 0 {
+				d.a = in.Args[0]
+			}
+			if len(in.Args) > 1 {
+				d.b = in.Args[1]
+			}
+			code[addr] = d
+			addr += in.Size
+		}
+	}
+	return code
+}
+
+// unset is the value of a global slot before its let has run.
+type unsetGlobal struct{}
+
+var unset Value = unsetGlobal{}
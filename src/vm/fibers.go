@@ -0,0 +1,225 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+/* ---------- Fibers ---------- */
+
+// ErrDeadlock is returned when every fiber is blocked on a channel.
+var ErrDeadlock = errors.New("all fibers are blocked, deadlock")
+
+// errBlocked is returned by a builtin that blocked the current fiber. The
+// fiber gets the builtin's result when it is woken.
+var errBlocked = errors.New("fiber blocked")
+
+// DefaultQuantum is the time slice used when SchedConfig.Quantum is 0.
+const DefaultQuantum = 100
+
+// SchedConfig controls the fiber scheduler. Scheduling depends only on
+// instruction counts and Seed, so a program with the same input and the
+// same Seed always interleaves its fibers the same way.
+type SchedConfig struct {
+	// Seed 0 runs fibers round robin and lets select take the first ready
+	// channel. Any other seed picks both at random from that seed.
+	Seed    int64
+	Quantum int // instructions a fiber runs before yielding, DefaultQuantum if 0
+}
+
+type fiberState byte
+
+const (
+	fiberRunnable fiberState = iota
+	fiberBlocked
+	fiberDone
+)
+
+// fiber is a lightweight thread of the program. The running fiber's
+// registers live in the VM; a fiber's own fields hold them while it is
+// switched out.
+type fiber struct {
+	id     int
+	state  fiberState
+	ip     int
+	stack  []Value
+	frames []frame
+
+	blockedIn string     // the builtin it is blocked in, for deadlock reports
+	waiting   []*Channel // the channels whose queues it is in
+	sending   Value      // the value a blocked sender is sending
+	selected  int        // which of its channels the last select received from, -1 before any
+
+	resume bool  // push result when switched in
+	result Value // what the blocking builtin returns
+	err    error // raised instead, when set
+}
+
+// resetFibers makes the program's initialiser the only fiber.
+func (m *VM) resetFibers() {
+	m.cur = &fiber{id: 0, selected: -1}
+	m.fibers = []*fiber{m.cur}
+	m.runq = nil
+	m.nextFiber = 1
+	m.slice = 0
+	m.rng, m.rngSrc = nil, nil
+	if m.Sched.Seed != 0 {
+		m.rngSrc = &countingSource{src: rand.NewSource(m.Sched.Seed)}
+		m.rng = rand.New(m.rngSrc)
+	}
+}
+
+// countingSource is the scheduler's random source. It counts the numbers
+// drawn, so a snapshot can bring a new source from the same seed to the
+// same point.
+type countingSource struct {
+	src   rand.Source
+	drawn uint64
+}
+
+func (s *countingSource) Int63() int64 {
+	s.drawn++
+	return s.src.Int63()
+}
+
+func (s *countingSource) Seed(seed int64) {
+	s.src.Seed(seed)
+	s.drawn = 0
+}
+
+func (m *VM) quantum() int {
+	if m.Sched.Quantum > 0 {
+		return m.Sched.Quantum
+	}
+	return DefaultQuantum
+}
+
+// Fiber is the id of the running fiber. The initialiser's fiber is 0.
+func (m *VM) Fiber() int { return m.cur.id }
+
+// NumFibers is the number of fibers that have not finished.
+func (m *VM) NumFibers() int { return len(m.fibers) }
+
+// spawn starts fn with args in a new fiber, which runs when the scheduler
+// gets to it.
+func (m *VM) spawn(fn *CodeObject, args []Value) error {
+	if err := m.alloc(frameCharge(fn)); err != nil {
+		return err
+	}
+	locals := make([]Value, fn.NumLocals)
+	copy(locals, args)
+	f := &fiber{
+		id:       m.nextFiber,
+		ip:       fn.Entry,
+		stack:    make([]Value, 0, fn.MaxStack),
+		frames:   []frame{{fn: fn, ret: -1, locals: locals}},
+		selected: -1,
+	}
+	m.nextFiber++
+	m.fibers = append(m.fibers, f)
+	m.runq = append(m.runq, f)
+	return nil
+}
+
+// exitFiber ends the running fiber after its bottom frame returned.
+func (m *VM) exitFiber() {
+	m.heap -= frameCharge(m.frames[0].fn)
+	m.cur.state = fiberDone
+	for i, f := range m.fibers {
+		if f == m.cur {
+			m.fibers = append(m.fibers[:i], m.fibers[i+1:]...)
+			break
+		}
+	}
+}
+
+// block suspends the running fiber inside builtin name. Builtins return
+// the result to errBlocked.
+func (m *VM) block(name string, waiting ...*Channel) error {
+	m.cur.state = fiberBlocked
+	m.cur.blockedIn = name
+	m.cur.waiting = waiting
+	return errBlocked
+}
+
+// wake makes a blocked fiber runnable, with v as the result of the builtin
+// it blocked in, or err raised there instead.
+func (m *VM) wake(f *fiber, v Value, err error) {
+	for _, ch := range f.waiting {
+		ch.recvq = removeFiber(ch.recvq, f)
+		ch.sendq = removeFiber(ch.sendq, f)
+	}
+	f.waiting = nil
+	f.sending = nil
+	f.state = fiberRunnable
+	f.resume, f.result, f.err = true, v, err
+	m.runq = append(m.runq, f)
+}
+
+func removeFiber(q []*fiber, f *fiber) []*fiber {
+	for i, g := range q {
+		if g == f {
+			return append(q[:i], q[i+1:]...)
+		}
+	}
+	return q
+}
+
+// reschedule runs after every instruction and switches fibers when the
+// running one has blocked, finished or used up its time slice.
+func (m *VM) reschedule() error {
+	if m.halted {
+		return nil
+	}
+	// a fiber that yielded is runnable and already queued
+	if m.cur.state == fiberRunnable && !m.cur.resume {
+		m.slice++
+		if m.slice < m.quantum() || len(m.runq) == 0 {
+			return nil
+		}
+		m.runq = append(m.runq, m.cur)
+	}
+	if len(m.runq) == 0 {
+		m.save()
+		return m.deadlock()
+	}
+	i := 0
+	if m.rng != nil {
+		i = m.rng.Intn(len(m.runq))
+	}
+	next := m.runq[i]
+	m.runq = append(m.runq[:i], m.runq[i+1:]...)
+	m.save()
+	m.restore(next)
+	return nil
+}
+
+// save stores the VM's registers in the running fiber.
+func (m *VM) save() {
+	m.cur.ip, m.cur.stack, m.cur.frames = m.ip, m.stack, m.frames
+}
+
+// restore makes f the running fiber.
+func (m *VM) restore(f *fiber) {
+	m.cur = f
+	m.ip, m.stack, m.frames = f.ip, f.stack, f.frames
+	m.slice = 0
+	if f.resume && f.err == nil {
+		m.push(f.result)
+	}
+	f.resume, f.result = false, nil
+}
+
+// deadlock describes where each fiber is stuck.
+func (m *VM) deadlock() error {
+	var b strings.Builder
+	for _, f := range m.fibers {
+		fmt.Fprintf(&b, "\n    fiber %d blocked in %s", f.id, f.blockedIn)
+		if t := traceFrames(m.prog, f.frames, f.ip-1); len(t) > 0 {
+			fmt.Fprintf(&b, " %s", t[0])
+		}
+	}
+	return fmt.Errorf("%w:%s", ErrDeadlock, b.String())
+}
@@ -0,0 +1,139 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// runSched links src on its own and runs it with sched, returning what it
+// printed and the error it stopped with.
+func runSched(t *testing.T, sched SchedConfig, src string) (string, error) {
+	t.Helper()
+	p, err := Link([]Object{compileObject(t, "t.quark", src)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	m := NewVM()
+	m.Stdout = &out
+	m.Sched = sched
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	err = m.Run()
+	return out.String(), err
+}
+
+const workersSrc = `
+let done = chan("int");
+func worker(name, c) {
+    print(name, 1);
+    print(name, 2);
+    print(name, 3);
+    send(c, 1);
+}
+spawn worker("a", done);
+spawn worker("b", done);
+spawn worker("c", done);
+recv(done);
+recv(done);
+recv(done);
+print("done");
+`
+
+func TestSchedRoundRobin(t *testing.T) {
+	got, err := runSched(t, SchedConfig{}, workersSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "a 1\na 2\na 3\nb 1\nb 2\nb 3\nc 1\nc 2\nc 3\ndone\n"
+	if got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
+
+// The same seed must give the same interleaving every time, and the seed
+// must actually be what decides it.
+func TestSchedSeedDeterministic(t *testing.T) {
+	outputs := map[string]bool{}
+	for seed := int64(0); seed < 20; seed++ {
+		sched := SchedConfig{Seed: seed, Quantum: 1}
+		first, err := runSched(t, sched, workersSrc)
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		for i := 0; i < 3; i++ {
+			if again, _ := runSched(t, sched, workersSrc); again != first {
+				t.Fatalf("seed %d gave\n%s\nthen\n%s", seed, first, again)
+			}
+		}
+		if !strings.HasSuffix(first, "done\n") || strings.Count(first, "\n") != 10 {
+			t.Errorf("seed %d: output %q", seed, first)
+		}
+		outputs[first] = true
+	}
+	if len(outputs) < 2 {
+		t.Error("every seed interleaved the fibers the same way")
+	}
+}
+
+func TestSchedDeadlock(t *testing.T) {
+	_, err := runSched(t, SchedConfig{}, `
+let c = chan("int");
+func wait(c) { recv(c); }
+spawn wait(c);
+send(c, 1);
+send(c, 2);
+`)
+	if !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("got %v, want ErrDeadlock", err)
+	}
+	if !strings.Contains(err.Error(), "fiber 0 blocked in send") {
+		t.Errorf("deadlock report %q does not say where fiber 0 is", err)
+	}
+}
+
+func TestSchedDeadlockAllFibers(t *testing.T) {
+	_, err := runSched(t, SchedConfig{Seed: 3}, `
+let a = chan("int");
+let b = chan("int");
+func wait(c) { recv(c); }
+spawn wait(a);
+spawn wait(b);
+select(a, b);
+`)
+	if !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("got %v, want ErrDeadlock", err)
+	}
+	for _, want := range []string{"fiber 0 blocked in select", "fiber 1 blocked in recv", "fiber 2 blocked in recv"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("deadlock report %q has no %q", err, want)
+		}
+	}
+}
+
+func TestSelected(t *testing.T) {
+	got, err := runSched(t, SchedConfig{}, `
+let a = chan("int", 1);
+let b = chan("int", 1);
+func later(c, v) { send(c, v); }
+func shut(c) { close(c); }
+print(selected());
+send(b, 5);
+print(select(a, b), selected());
+spawn later(b, 9);
+print(select(a, b), selected());
+spawn shut(a);
+print(select(a, b), selected());
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first select finds b ready, the second blocks until a fiber
+	// sends on b and the third until a fiber closes a
+	if want := "-1\n5 1\n9 1\nnull 0\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,169 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+/* ---------- Program input ---------- */
+
+// readLine reads the next line of m.Stdin, without its line ending. ok is
+// false at the end of the input. Stdin is read through a buffer kept
+// across calls, which is started again if Stdin is replaced.
+//
+// Under RunContext the read is made in a goroutine, so a program waiting
+// for a line on a terminal still stops when the context ends. The read
+// carries on, and the next readLine takes its line.
+func (m *VM) readLine() (line string, ok bool, err error) {
+	if m.reading != nil && m.stdinSrc != m.Stdin {
+		m.reading = nil
+	}
+	if m.reading == nil {
+		if m.stdin == nil || m.stdinSrc != m.Stdin || m.resumeIn != nil {
+			if err := m.openStdin(); err != nil {
+				return "", false, err
+			}
+		}
+		if m.ctx == nil || m.ctx.Done() == nil {
+			return m.gotLine(m.stdin.ReadString('\n'))
+		}
+		p := &pendingLine{from: m.inputPos(), done: make(chan struct{})}
+		go func(r *bufio.Reader) {
+			p.line, p.err = r.ReadString('\n')
+			close(p.done)
+		}(m.stdin)
+		m.reading = p
+	}
+	var canceled <-chan struct{}
+	if m.ctx != nil {
+		canceled = m.ctx.Done()
+	}
+	select {
+	case <-m.reading.done:
+		p := m.reading
+		m.reading = nil
+		return m.gotLine(p.line, p.err)
+	case <-canceled:
+		return "", false, m.stopped(m.ctx.Err())
+	}
+}
+
+// pendingLine is a read of stdin running in its own goroutine. line and err
+// are set when done is closed.
+type pendingLine struct {
+	from inputPos // where the input was when the read started
+	done chan struct{}
+	line string
+	err  error
+}
+
+// gotLine finishes a read of a line.
+func (m *VM) gotLine(line string, err error) (string, bool, error) {
+	m.stdinPos += int64(len(line))
+	if err == io.EOF {
+		if line == "" {
+			return "", false, nil
+		}
+		err = nil // a last line with no newline
+	}
+	if err != nil {
+		return "", false, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), true, nil
+}
+
+// inputPos is how far a program had got through its input: the bytes it
+// had read and those read ahead into the buffer but not yet returned.
+type inputPos struct {
+	offset int64
+	ahead  []byte
+}
+
+// openStdin starts reading m.Stdin. After LoadSnapshot it first moves past
+// the input the program had read, seeking where Stdin can, otherwise
+// reading and dropping it, so Stdin must be the input the snapshot's
+// program was given, from the start. The bytes read ahead are checked
+// against it.
+func (m *VM) openStdin() error {
+	at := m.resumeIn
+	m.resumeIn = nil
+	if at == nil {
+		m.stdin, m.stdinSrc, m.stdinPos = bufio.NewReader(m.Stdin), m.Stdin, 0
+		return nil
+	}
+	// on failure the next read starts again from wherever Stdin is
+	m.stdin, m.stdinSrc, m.stdinPos = nil, nil, 0
+	if err := skipInput(m.Stdin, at.offset); err != nil {
+		return err
+	}
+	m.stdin = bufio.NewReaderSize(m.Stdin, max(len(at.ahead), 4096))
+	m.stdinSrc, m.stdinPos = m.Stdin, at.offset
+	if got, _ := m.stdin.Peek(len(at.ahead)); !bytes.Equal(got, at.ahead) {
+		return errors.New("the input is not the one the snapshot was taken with")
+	}
+	return nil
+}
+
+func skipInput(r io.Reader, n int64) error {
+	if s, ok := r.(io.Seeker); ok {
+		// pipes and terminals are Seekers that fail
+		if _, err := s.Seek(n, io.SeekStart); err == nil {
+			return nil
+		}
+	}
+	skipped, err := io.CopyN(io.Discard, r, n)
+	if err == io.EOF {
+		return fmt.Errorf("the input ends at byte %d, before the %d bytes the snapshot had read", skipped, n)
+	}
+	return err
+}
+
+// inputPos is where the program is in its input, for Snapshot.
+func (m *VM) inputPos() inputPos {
+	if m.resumeIn != nil {
+		return *m.resumeIn
+	}
+	if m.reading != nil {
+		// the program has not had the line being read
+		return m.reading.from
+	}
+	if m.stdin == nil || m.stdinSrc != m.Stdin {
+		return inputPos{}
+	}
+	ahead, _ := m.stdin.Peek(m.stdin.Buffered())
+	return inputPos{m.stdinPos, append([]byte(nil), ahead...)}
+}
+
+func init() {
+	RegisterBuiltin("readLine", builtinReadLine)
+	RegisterVariadicBuiltin("input", builtinInput, TypeAny)
+}
+
+// readLine() returns the next line of input, or null at the end of it.
+func builtinReadLine(m *VM, args []Value) (Value, error) {
+	line, ok, err := m.readLine()
+	if !ok {
+		return nil, err
+	}
+	return line, nil
+}
+
+// input(prompt...) prints its arguments as print does, without the
+// newline, then reads a line like readLine.
+func builtinInput(m *VM, args []Value) (Value, error) {
+	if len(args) > 0 {
+		prompt := make([]string, len(args))
+		for i, a := range args {
+			prompt[i] = formatValue(a)
+		}
+		if _, err := io.WriteString(m.Stdout, strings.Join(prompt, " ")); err != nil {
+			return nil, err
+		}
+	}
+	return builtinReadLine(m, nil)
+}
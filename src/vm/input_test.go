@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadSrc(t *testing.T, src string) *VM {
+	t.Helper()
+	p, err := Link([]Object{compileObject(t, "t.quark", src)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewVM()
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestReadLine(t *testing.T) {
+	m := loadSrc(t, "print(readLine(), readLine(), readLine(), readLine());\n")
+	var out bytes.Buffer
+	m.Stdout = &out
+	m.Stdin = strings.NewReader("dos\r\n\nlast")
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "dos  last null\n"; out.String() != want {
+		t.Errorf("output %q, want %q", out.String(), want)
+	}
+}
+
+// A line asked for under RunContext can be waited for with no input
+// coming: ending the context stops the program, and the line read meanwhile
+// goes to the next run.
+func TestReadLineCanceled(t *testing.T) {
+	m := loadSrc(t, "print(readLine());\nprint(readLine());\n")
+	var out bytes.Buffer
+	r, w := io.Pipe()
+	m.Stdout, m.Stdin = &out, r
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		// the write returns once the program has read the line
+		io.WriteString(w, "first\n")
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err := m.RunContext(ctx)
+	if !errors.Is(err, ErrCanceled) {
+		t.Fatalf("got %v, want ErrCanceled", err)
+	}
+	ip := m.IP()
+	if op := m.Program().Code[ip]; op != OpCallBuiltin {
+		t.Errorf("stopped at %s, want the CALL_BUILTIN of readLine", OpName(op))
+	}
+
+	// a snapshot taken now has read just the first line
+	snap, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed := NewVM()
+	var rout bytes.Buffer
+	resumed.Stdout, resumed.Stdin = &rout, strings.NewReader("first\nsecond\n")
+	if err := resumed.LoadSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumed.Run(); err != nil || rout.String() != "second\n" {
+		t.Errorf("resumed snapshot: %v, output %q", err, rout.String())
+	}
+
+	go io.WriteString(w, "second\n")
+	if err := m.RunContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := "first\nsecond\n"; out.String() != want {
+		t.Errorf("output %q, want %q", out.String(), want)
+	}
+}
+
+func TestReadLineTimeout(t *testing.T) {
+	m := loadSrc(t, "print(input(\"name? \"));\n")
+	r, w := io.Pipe()
+	defer w.Close()
+	m.Stdout, m.Stdin = io.Discard, r
+	m.Limits.Timeout = 20 * time.Millisecond
+	done := make(chan error)
+	go func() { done <- m.Run() }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrTimeout) {
+			t.Errorf("got %v, want ErrTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a program waiting for input ran past its timeout")
+	}
+}
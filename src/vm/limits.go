@@ -0,0 +1,82 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/* ---------- Execution limits ---------- */
+
+var (
+	ErrStepLimit     = errors.New("instruction limit exceeded")
+	ErrTimeout       = errors.New("time limit exceeded")
+	ErrCanceled      = errors.New("execution canceled")
+	ErrStackOverflow = errors.New("stack overflow")
+)
+
+// DefaultMaxStackDepth is the call depth allowed when Limits.MaxStackDepth
+// is 0.
+const DefaultMaxStackDepth = 10000
+
+// checkEvery is how many instructions run between checks of the context.
+const checkEvery = 1024
+
+// Limits bound what a program may use. The zero value allows unlimited
+// instructions, time and memory, and DefaultMaxStackDepth nested calls.
+type Limits struct {
+	MaxSteps      int64         // instructions executed since Load, 0 for no limit
+	Timeout       time.Duration // wall-clock time for each Run, 0 for no limit
+	MaxStackDepth int           // nested calls, DefaultMaxStackDepth if 0
+	MaxMemory     int64         // bytes of values the program may hold, 0 for no limit
+}
+
+func (l Limits) maxStackDepth() int {
+	if l.MaxStackDepth > 0 {
+		return l.MaxStackDepth
+	}
+	return DefaultMaxStackDepth
+}
+
+// IsLimitError reports whether err means the program was stopped by one of
+// its Limits or by cancellation, rather than failing on its own.
+func IsLimitError(err error) bool {
+	return errors.Is(err, ErrStepLimit) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrCanceled) || errors.Is(err, ErrStackOverflow) || errors.Is(err, ErrOutOfMemory)
+}
+
+// RunContext is Run, stopping with ErrCanceled or ErrTimeout when ctx is
+// done or m.Limits.Timeout has passed. The VM is left at the instruction it
+// stopped before, so it can be run again.
+func (m *VM) RunContext(ctx context.Context) error {
+	if m.prog == nil {
+		return errors.New("no program loaded")
+	}
+	if m.Limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Limits.Timeout)
+		defer cancel()
+	}
+	m.ctx = ctx
+	defer func() { m.ctx = nil }()
+	for !m.halted {
+		if err := ctx.Err(); err != nil {
+			return m.runtimeError(m.ip, m.stopped(err))
+		}
+		if err := m.runBatch(checkEvery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stopped is the error for a run stopped by its context ending with err.
+func (m *VM) stopped(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %d instructions", ErrTimeout, m.steps)
+	}
+	return fmt.Errorf("%w after %d instructions", ErrCanceled, m.steps)
+}
+
+// Steps is the number of instructions executed since Load.
+func (m *VM) Steps() int64 { return m.steps }
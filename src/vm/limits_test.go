@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const spinSrc = `
+.code
+top:
+    JUMP top
+`
+
+func loadSpin(t *testing.T, limits Limits) *VM {
+	t.Helper()
+	m := NewVM()
+	m.Limits = limits
+	if err := m.LoadProgram(assemble(t, spinSrc)); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMaxSteps(t *testing.T) {
+	m := loadSpin(t, Limits{MaxSteps: 100})
+	err := m.Run()
+	if !errors.Is(err, ErrStepLimit) || !IsLimitError(err) {
+		t.Fatalf("got %v, want ErrStepLimit", err)
+	}
+	if !strings.Contains(err.Error(), "100 instructions executed") {
+		t.Errorf("error %q does not say how many instructions ran", err)
+	}
+	if m.Steps() != 100 {
+		t.Errorf("%d steps executed, want 100", m.Steps())
+	}
+	// the VM stops between instructions, so raising the limit carries on
+	m.Limits.MaxSteps = 150
+	if err := m.Run(); !errors.Is(err, ErrStepLimit) || m.Steps() != 150 {
+		t.Errorf("after raising the limit: %v with %d steps", err, m.Steps())
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	m := loadSpin(t, Limits{Timeout: 10 * time.Millisecond})
+	start := time.Now()
+	err := m.Run()
+	if !errors.Is(err, ErrTimeout) || !IsLimitError(err) {
+		t.Fatalf("got %v, want ErrTimeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("a 10ms timeout took %v", d)
+	}
+	var re *RuntimeError
+	if !errors.As(err, &re) || len(re.Trace) == 0 {
+		t.Errorf("%v has no stack trace", err)
+	}
+}
+
+func TestRunContextCanceled(t *testing.T) {
+	m := loadSpin(t, Limits{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	err := m.RunContext(ctx)
+	if !errors.Is(err, ErrCanceled) || !IsLimitError(err) {
+		t.Fatalf("got %v, want ErrCanceled", err)
+	}
+	if m.Halted() {
+		t.Error("a canceled VM is halted")
+	}
+}
+
+func TestStackDepth(t *testing.T) {
+	src := "func f(n) { return f(n + 1); }\nprint(f(0));\n"
+	p, err := Link([]Object{compileObject(t, "t.quark", src)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		depth int
+		want  string
+	}{
+		{50, "more than 50 nested calls"},
+		{0, "more than 10000 nested calls"},
+	} {
+		m := NewVM()
+		m.Limits.MaxStackDepth = tt.depth
+		if err := m.LoadProgram(p); err != nil {
+			t.Fatal(err)
+		}
+		err := m.Run()
+		if !errors.Is(err, ErrStackOverflow) || !IsLimitError(err) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("MaxStackDepth %d: got %v, want ErrStackOverflow with %q", tt.depth, err, tt.want)
+		}
+	}
+}
+
+func TestIsLimitError(t *testing.T) {
+	for _, err := range []error{ErrStepLimit, ErrTimeout, ErrCanceled, ErrStackOverflow, ErrOutOfMemory} {
+		if !IsLimitError(&RuntimeError{Err: err}) {
+			t.Errorf("IsLimitError(%v) is false", err)
+		}
+	}
+	for _, err := range []error{nil, ErrDeadlock, ErrHalted, &ArithmeticError{}, errors.New("other")} {
+		if IsLimitError(err) {
+			t.Errorf("IsLimitError(%v) is true", err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/* ---------- Line table ---------- */
+
+// LineInfo maps code to source: the instructions from Addr up to the next
+// entry's Addr were compiled from File:Line.
+type LineInfo struct {
+	Addr int
+	File string
+	Line int
+}
+
+// LineAt returns the source line of the instruction at addr, or ok false if
+// the program has no line for it.
+func (p *Program) LineAt(addr int) (file string, line int, ok bool) {
+	i := sort.Search(len(p.Lines), func(i int) bool { return p.Lines[i].Addr > addr }) - 1
+	if i < 0 || p.Lines[i].Line == 0 {
+		return "", 0, false
+	}
+	return p.Lines[i].File, p.Lines[i].Line, true
+}
+
+// appendLine adds an entry for code starting at addr. An entry with no
+// code before addr is replaced, and one for the same line as the entry
+// before it is dropped. A line of 0 marks code with no source line.
+func appendLine(lines []LineInfo, addr int, file string, line int) []LineInfo {
+	if n := len(lines); n > 0 && lines[n-1].Addr == addr {
+		lines = lines[:n-1]
+	}
+	if n := len(lines); n > 0 && lines[n-1].File == file && lines[n-1].Line == line {
+		return lines
+	} else if n == 0 && line == 0 {
+		return lines
+	}
+	return append(lines, LineInfo{addr, file, line})
+}
+
+// Line table section: uvarint file count and the file names, then uvarint
+// entry count and per entry uvarint address delta, file index and line.
+func encodeLines(lines []LineInfo) []byte {
+	var files []string
+	fileIdx := map[string]int{}
+	for _, l := range lines {
+		if _, ok := fileIdx[l.File]; !ok {
+			fileIdx[l.File] = len(files)
+			files = append(files, l.File)
+		}
+	}
+	b := binary.AppendUvarint(nil, uint64(len(files)))
+	for _, f := range files {
+		b = appendString(b, f)
+	}
+	b = binary.AppendUvarint(b, uint64(len(lines)))
+	prev := 0
+	for _, l := range lines {
+		b = binary.AppendUvarint(b, uint64(l.Addr-prev))
+		b = binary.AppendUvarint(b, uint64(fileIdx[l.File]))
+		b = binary.AppendUvarint(b, uint64(l.Line))
+		prev = l.Addr
+	}
+	return b
+}
+
+func decodeLines(data []byte, codeLen int) ([]LineInfo, error) {
+	r := &byteReader{what: "line table", data: data}
+	nfiles, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, nfiles)
+	for i := range files {
+		if files[i], err = r.string(); err != nil {
+			return nil, err
+		}
+	}
+	n, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]LineInfo, 0, n)
+	addr := 0
+	for i := 0; i < n; i++ {
+		var fields [3]uint64
+		for j := range fields {
+			if fields[j], err = r.uvarint(); err != nil {
+				return nil, err
+			}
+		}
+		if fields[0] > uint64(codeLen-addr) || (i > 0 && fields[0] == 0) {
+			return nil, r.errorf("entry %d: bad address", i)
+		}
+		addr += int(fields[0])
+		if fields[1] >= uint64(nfiles) {
+			return nil, r.errorf("entry %d: file index %d out of range", i, fields[1])
+		}
+		if fields[2] > 1<<31 {
+			return nil, r.errorf("entry %d: line %d out of range", i, fields[2])
+		}
+		lines = append(lines, LineInfo{Addr: addr, File: files[fields[1]], Line: int(fields[2])})
+	}
+	return lines, r.done()
+}
+
+/* ---------- Runtime errors ---------- */
+
+// TraceFrame is one call in a stack trace.
+type TraceFrame struct {
+	Func string
+	Addr int    // the instruction running in this frame
+	File string // "" if the program has no line for Addr
+	Line int
+}
+
+func (f TraceFrame) String() string {
+	if f.File == "" {
+		return fmt.Sprintf("at %s (%04d)", f.Func, f.Addr)
+	}
+	return fmt.Sprintf("at %s (%s:%d)", f.Func, f.File, f.Line)
+}
+
+// RuntimeError is an error raised while a program ran, with the call stack
+// at that point, innermost call first.
+type RuntimeError struct {
+	Err   error
+	Trace []TraceFrame
+}
+
+// Error lists the trace below the message. Runs of identical frames, as
+// left by deep recursion, are printed once with a repeat count.
+func (e *RuntimeError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Err.Error())
+	for i := 0; i < len(e.Trace); {
+		s := e.Trace[i].String()
+		n := 1
+		for i+n < len(e.Trace) && e.Trace[i+n].String() == s {
+			n++
+		}
+		b.WriteString("\n    ")
+		b.WriteString(s)
+		if n > 2 {
+			fmt.Fprintf(&b, "\n    ... repeated %d more times", n-1)
+			i += n
+		} else {
+			i++
+		}
+	}
+	return b.String()
+}
+
+func (e *RuntimeError) Unwrap() error { return e.Err }
+
+// Trace returns the running fiber's call stack, innermost call first,
+// taking addr as the instruction running in the innermost frame.
+func (m *VM) Trace(addr int) []TraceFrame {
+	return traceFrames(m.prog, m.frames, addr)
+}
+
+func traceFrames(p *Program, frames []frame, addr int) []TraceFrame {
+	trace := make([]TraceFrame, 0, len(frames))
+	for i := len(frames) - 1; i >= 0; i-- {
+		fr := frames[i]
+		f := TraceFrame{Func: fr.fn.Name, Addr: addr}
+		f.File, f.Line, _ = p.LineAt(addr)
+		trace = append(trace, f)
+		// the caller is inside its CALL instruction, which ends at ret
+		addr = fr.ret - 1
+	}
+	return trace
+}
+
+// runtimeError adds the stack trace at addr to err.
+func (m *VM) runtimeError(addr int, err error) error {
+	var re *RuntimeError
+	if errors.As(err, &re) || errors.Is(err, ErrHalted) || errors.Is(err, ErrDeadlock) {
+		return err
+	}
+	if m.cur.id != 0 {
+		err = fmt.Errorf("fiber %d: %w", m.cur.id, err)
+	}
+	return &RuntimeError{Err: err, Trace: m.Trace(addr)}
+}
@@ -0,0 +1,115 @@
+package vm
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func runError(t *testing.T, src string) *RuntimeError {
+	t.Helper()
+	p, err := Link([]Object{compileObject(t, "t.quark", src)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewVM()
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatal(err)
+	}
+	var re *RuntimeError
+	if err := m.Run(); !errors.As(err, &re) {
+		t.Fatalf("got %v, want a RuntimeError", err)
+	}
+	return re
+}
+
+func TestRuntimeErrorTrace(t *testing.T) {
+	re := runError(t, `func inner(x) {
+    return "a" - x;
+}
+func outer(x) { return inner(x); }
+print(outer(1));
+`)
+	want := []string{"at inner (t.quark:2)", "at outer (t.quark:4)", "at <main> (t.quark:5)"}
+	var got []string
+	for _, f := range re.Trace {
+		got = append(got, f.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("trace %q, want %q", got, want)
+	}
+	msg := "unsupported operand types for SUB: string and int\n    " + strings.Join(want, "\n    ")
+	if re.Error() != msg {
+		t.Errorf("error %q, want %q", re.Error(), msg)
+	}
+}
+
+// Deep recursion prints the repeated frame once.
+func TestRuntimeErrorTraceRepeats(t *testing.T) {
+	re := runError(t, "func f(n) { return f(n + 1); }\nf(0);\n")
+	want := "stack overflow: more than 10000 nested calls\n    at f (t.quark:1)\n    ... repeated 9998 more times\n    at <main> (t.quark:2)"
+	if re.Error() != want {
+		t.Errorf("error %q, want %q", re.Error(), want)
+	}
+}
+
+// Frames with no line, as in hand written assembly, give the address.
+func TestTraceFrameWithoutLine(t *testing.T) {
+	f := TraceFrame{Func: "f", Addr: 12}
+	if got := f.String(); got != "at f (0012)" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestLineTableRoundTrip(t *testing.T) {
+	lines := []LineInfo{{0, "a.quark", 1}, {5, "a.quark", 3}, {9, "b.quark", 1}, {20, "", 0}, {30, "a.quark", 70000}}
+	got, err := decodeLines(encodeLines(lines), 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, lines) {
+		t.Errorf("decoded %v, want %v", got, lines)
+	}
+	if _, err := decodeLines(encodeLines(lines), 25); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("an entry past the code: got %v, want ErrCorrupt", err)
+	}
+	if _, err := decodeLines(encodeLines([]LineInfo{{0, "a", 1}, {0, "a", 2}}), 40); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("two entries at one address: got %v, want ErrCorrupt", err)
+	}
+}
+
+func TestLineAt(t *testing.T) {
+	p := &Program{Lines: []LineInfo{{0, "a.quark", 1}, {5, "a.quark", 3}, {9, "", 0}}}
+	tests := []struct {
+		addr int
+		file string
+		line int
+		ok   bool
+	}{
+		{0, "a.quark", 1, true},
+		{4, "a.quark", 1, true},
+		{5, "a.quark", 3, true},
+		{9, "", 0, false},
+		{100, "", 0, false},
+	}
+	for _, tt := range tests {
+		file, line, ok := p.LineAt(tt.addr)
+		if file != tt.file || line != tt.line || ok != tt.ok {
+			t.Errorf("LineAt(%d) = %s, %d, %v", tt.addr, file, line, ok)
+		}
+	}
+}
+
+func TestAppendLine(t *testing.T) {
+	var lines []LineInfo
+	lines = appendLine(lines, 0, "a", 0) // no line before any code: dropped
+	lines = appendLine(lines, 0, "a", 1)
+	lines = appendLine(lines, 3, "a", 1) // same line: dropped
+	lines = appendLine(lines, 6, "a", 2)
+	lines = appendLine(lines, 6, "a", 4) // no code for line 2: replaced
+	want := []LineInfo{{0, "a", 1}, {6, "a", 4}}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("got %v, want %v", lines, want)
+	}
+}
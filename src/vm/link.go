@@ -0,0 +1,560 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+/* ---------- Symbols and relocations ---------- */
+
+type SymbolKind byte
+
+const (
+	SymUndefined SymbolKind = iota // referenced here, defined in another object
+	SymGlobal                      // top level variable, Value is its global slot
+	SymFunc                        // function, Value is its code object index
+)
+
+type Symbol struct {
+	Name  string
+	Kind  SymbolKind
+	Value int
+}
+
+type RelocKind byte
+
+const (
+	RelocConst   RelocKind = iota // operand indexes this object's constant pool
+	RelocGlobal                   // operand is one of this object's global slots
+	RelocAddr                     // operand is an address in this object's code
+	RelocSymbol                   // operand refers to Symbols[Symbol]
+	RelocFunc                     // operand indexes this object's code objects
+	RelocBuiltin                  // operand indexes this object's builtin imports
+)
+
+// Reloc marks an operand the linker must rewrite. Offset is the byte offset
+// of the operand in the object's code.
+type Reloc struct {
+	Offset int
+	Kind   RelocKind
+	Symbol int // index into Symbols, for RelocSymbol
+}
+
+// Symbols section: uvarint count, then name, kind byte, uvarint value.
+func encodeSymbols(syms []Symbol) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(syms)))
+	for _, s := range syms {
+		b = appendString(b, s.Name)
+		b = append(b, byte(s.Kind))
+		b = binary.AppendUvarint(b, uint64(s.Value))
+	}
+	return b
+}
+
+// decodeSymbols reads the symbol table of p, whose code object table must
+// already be decoded.
+func decodeSymbols(data []byte, p *Program) ([]Symbol, error) {
+	r := &byteReader{what: "symbol table", data: data}
+	n, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	syms := make([]Symbol, 0, n)
+	for i := 0; i < n; i++ {
+		var s Symbol
+		if s.Name, err = r.string(); err != nil {
+			return nil, err
+		}
+		kind, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		if SymbolKind(kind) > SymFunc {
+			return nil, r.errorf("unknown symbol kind %d", kind)
+		}
+		s.Kind = SymbolKind(kind)
+		v, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if v > math.MaxUint32 {
+			return nil, r.errorf("symbol %s: value %d out of range", s.Name, v)
+		}
+		s.Value = int(v)
+		if err := p.checkSymbol(s); err != nil {
+			return nil, r.errorf("%v", err)
+		}
+		syms = append(syms, s)
+	}
+	return syms, r.done()
+}
+
+// checkSymbol reports a definition that is not one of p's global slots or
+// functions.
+func (p *Program) checkSymbol(s Symbol) error {
+	switch s.Kind {
+	case SymGlobal:
+		if s.Value < 0 || s.Value >= p.Globals {
+			return fmt.Errorf("symbol %s: global slot %d out of range", s.Name, s.Value)
+		}
+	case SymFunc:
+		if s.Value < 0 || s.Value >= len(p.Funcs) || p.Funcs[s.Value].Kind == CodeModule {
+			return fmt.Errorf("symbol %s: code object %d is not a function", s.Name, s.Value)
+		}
+	}
+	return nil
+}
+
+// Relocations section: uvarint count, then uvarint offset, kind byte and,
+// for RelocSymbol, a uvarint symbol index.
+func encodeRelocs(relocs []Reloc) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(relocs)))
+	for _, r := range relocs {
+		b = binary.AppendUvarint(b, uint64(r.Offset))
+		b = append(b, byte(r.Kind))
+		if r.Kind == RelocSymbol {
+			b = binary.AppendUvarint(b, uint64(r.Symbol))
+		}
+	}
+	return b
+}
+
+func decodeRelocs(data []byte, nsyms int) ([]Reloc, error) {
+	r := &byteReader{what: "relocation table", data: data}
+	n, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	relocs := make([]Reloc, 0, n)
+	for i := 0; i < n; i++ {
+		off, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		kind, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		rel := Reloc{Offset: int(off), Kind: RelocKind(kind)}
+		switch rel.Kind {
+		case RelocConst, RelocGlobal, RelocAddr, RelocFunc, RelocBuiltin:
+		case RelocSymbol:
+			sym, err := r.uvarint()
+			if err != nil {
+				return nil, err
+			}
+			if sym >= uint64(nsyms) {
+				return nil, r.errorf("symbol index %d out of range", sym)
+			}
+			rel.Symbol = int(sym)
+		default:
+			return nil, r.errorf("unknown relocation kind %d", kind)
+		}
+		relocs = append(relocs, rel)
+	}
+	return relocs, r.done()
+}
+
+/* ---------- Linker ---------- */
+
+// Object is one input to the linker. Name is used in error messages.
+type Object struct {
+	Name string
+	Prog *Program
+}
+
+// LinkError reports a problem linking a set of objects.
+type LinkError struct {
+	Object string
+	Msg    string
+}
+
+func (e *LinkError) Error() string {
+	if e.Object == "" {
+		return "link: " + e.Msg
+	}
+	return fmt.Sprintf("link: %s: %s", e.Object, e.Msg)
+}
+
+// linkInstr is an instruction after relocation. Jump operands (target[i])
+// hold the index of the target instruction in the linked stream until
+// layout turns them into addresses.
+type linkInstr struct {
+	op     byte
+	args   []int
+	target []bool // args[i] is an instruction index to turn into an address
+	file   string // source line, from the object's line table
+	line   int
+}
+
+// Link combines objects into one executable program, in order. Constants
+// are merged, so a value used by several objects is stored once. Each
+// object gets its own range of global slots, its functions are appended to
+// the code object table, jumps are rebased, and references to another
+// object's top level variables and functions are resolved through the
+// symbol tables. Builtin import tables are merged by name. The module
+// initialisers of all objects are laid out one after the other as the
+// program's single "<main>" code object, with the functions after it.
+// Executables (e.g. dependency gluons) can be linked in too: their
+// operands are relocated by decoding their code, and an OpHalt in their
+// initialiser continues with the next object instead of stopping.
+func Link(objs []Object) (*Program, error) {
+	l := &linker{objs: objs, defs: map[string][]int{}}
+	return l.link()
+}
+
+type linker struct {
+	objs       []Object
+	defs       map[string][]int // name -> objects defining it
+	constMap   [][]int          // object, its constant index -> linked index
+	globalBase []int
+	funcIndex  [][]int // object, its code object index -> linked index; -1 for modules
+	builtinMap [][]int // object, its builtin import -> linked import
+	out        *Program
+	stream     []linkInstr
+}
+
+// linkObj is an object's code, decoded and grouped by code object.
+type linkObj struct {
+	instrs  [][]Instr // per code object
+	relocAt map[int]Reloc
+}
+
+func (l *linker) link() (*Program, error) {
+	for i, o := range l.objs {
+		for _, s := range o.Prog.Symbols {
+			// decoded objects were checked already, built ones were not
+			if err := o.Prog.checkSymbol(s); err != nil {
+				return nil, &LinkError{o.Name, err.Error()}
+			}
+			if s.Kind != SymUndefined {
+				l.defs[s.Name] = append(l.defs[s.Name], i)
+			}
+		}
+	}
+
+	l.out = &Program{Flags: FlagExecutable}
+	pool := newConstPool()
+	l.out.Funcs = []CodeObject{{Name: "<main>", Kind: CodeModule}}
+	l.constMap = make([][]int, len(l.objs))
+	l.globalBase = make([]int, len(l.objs))
+	l.funcIndex = make([][]int, len(l.objs))
+	l.builtinMap = make([][]int, len(l.objs))
+	imported := map[string]int{}
+	decoded := make([]linkObj, len(l.objs))
+	for i, o := range l.objs {
+		if len(o.Prog.Funcs) == 0 {
+			return nil, &LinkError{o.Name, "no code objects"}
+		}
+		l.constMap[i] = make([]int, len(o.Prog.Consts))
+		for k, c := range o.Prog.Consts {
+			l.constMap[i][k] = pool.add(c)
+		}
+		l.builtinMap[i] = make([]int, len(o.Prog.Builtins))
+		for k, name := range o.Prog.Builtins {
+			b, ok := imported[name]
+			if !ok {
+				b = len(l.out.Builtins)
+				if b > 255 {
+					return nil, &LinkError{o.Name, "more than 256 distinct builtins used"}
+				}
+				imported[name] = b
+				l.out.Builtins = append(l.out.Builtins, name)
+			}
+			l.builtinMap[i][k] = b
+		}
+		l.globalBase[i] = l.out.Globals
+		l.out.Globals += o.Prog.Globals
+		if len(o.Prog.GlobalNames) > 0 {
+			// objects without names leave their slots unnamed
+			names := make([]string, l.out.Globals)
+			copy(names, l.out.GlobalNames)
+			copy(names[l.globalBase[i]:], o.Prog.GlobalNames)
+			l.out.GlobalNames = names
+		}
+		l.funcIndex[i] = make([]int, len(o.Prog.Funcs))
+		for k, co := range o.Prog.Funcs {
+			if co.Kind == CodeModule {
+				l.funcIndex[i][k] = -1
+				continue
+			}
+			l.funcIndex[i][k] = len(l.out.Funcs)
+			l.out.Funcs = append(l.out.Funcs, CodeObject{Name: co.Name, Kind: co.Kind, Arity: co.Arity, NumLocals: co.NumLocals, MaxStack: co.MaxStack, Locals: co.Locals})
+		}
+
+		d, err := decodeObject(o.Prog)
+		if err != nil {
+			return nil, &LinkError{o.Name, err.Error()}
+		}
+		decoded[i] = d
+	}
+
+	l.out.Consts = pool.values
+
+	// module initialisers first, then the final HALT, then the functions
+	main := &l.out.Funcs[0]
+	for i, o := range l.objs {
+		for k, co := range o.Prog.Funcs {
+			if co.Kind != CodeModule {
+				continue
+			}
+			if _, _, err := l.appendCode(i, k, decoded[i].instrs[k], decoded[i].relocAt); err != nil {
+				return nil, err
+			}
+			main.MaxStack = max(main.MaxStack, co.MaxStack)
+		}
+	}
+	l.stream = append(l.stream, linkInstr{op: OpHalt})
+	mainEnd := len(l.stream)
+	spans := make([][2]int, len(l.out.Funcs))
+	for i, o := range l.objs {
+		for k, co := range o.Prog.Funcs {
+			if co.Kind == CodeModule {
+				continue
+			}
+			start, end, err := l.appendCode(i, k, decoded[i].instrs[k], decoded[i].relocAt)
+			if err != nil {
+				return nil, err
+			}
+			spans[l.funcIndex[i][k]] = [2]int{start, end}
+		}
+	}
+
+	code, addrs, err := layout(0, l.stream)
+	if err != nil {
+		return nil, err
+	}
+	l.out.Code = code
+	for k, li := range l.stream {
+		l.out.Lines = appendLine(l.out.Lines, addrs[k], li.file, li.line)
+	}
+	main.Size = addrs[mainEnd]
+	for f := 1; f < len(l.out.Funcs); f++ {
+		co := &l.out.Funcs[f]
+		co.Entry = addrs[spans[f][0]]
+		co.Size = addrs[spans[f][1]] - co.Entry
+	}
+	for f := range l.out.Funcs {
+		l.out.Funcs[f].Consts = constRefs(l.out, &l.out.Funcs[f])
+	}
+	return l.out, nil
+}
+
+// decodeObject decodes p's code and splits it by code object. Relocations
+// are derived by decoding when p has none, as for executables.
+func decodeObject(p *Program) (linkObj, error) {
+	all, err := DecodeCode(p.Code)
+	if err != nil {
+		return linkObj{}, err
+	}
+	d := linkObj{instrs: make([][]Instr, len(p.Funcs)), relocAt: map[int]Reloc{}}
+	relocs := p.Relocs
+	if len(relocs) == 0 {
+		relocs = deriveRelocs(all)
+	}
+	for _, r := range relocs {
+		d.relocAt[r.Offset] = r
+	}
+	for k, co := range p.Funcs {
+		for _, in := range all {
+			if in.Addr >= co.Entry && in.Addr < co.Entry+co.Size {
+				d.instrs[k] = append(d.instrs[k], in)
+			}
+		}
+	}
+	return d, nil
+}
+
+// appendCode relocates the instructions of code object k of object i onto
+// the linked stream and returns where they went.
+func (l *linker) appendCode(i, k int, instrs []Instr, relocAt map[int]Reloc) (start, end int, err error) {
+	o := l.objs[i]
+	co := o.Prog.Funcs[k]
+	module := co.Kind == CodeModule
+	// a trailing HALT of an executable's initialiser would only jump to the
+	// next object, so it is dropped
+	drop := module && len(instrs) > 0 && o.Prog.Executable() && instrs[len(instrs)-1].Op == OpHalt
+	// address within the object -> index in the linked stream; a dropped
+	// instruction and the end of the code object map to whatever comes next
+	start = len(l.stream)
+	index := make(map[int]int, len(instrs)+1)
+	for j, in := range instrs {
+		index[in.Addr] = start + j
+	}
+	end = start + len(instrs)
+	if drop {
+		end--
+	}
+	index[co.Entry+co.Size] = end
+
+	for j, in := range instrs {
+		if drop && j == len(instrs)-1 {
+			break
+		}
+		file, line, _ := o.Prog.LineAt(in.Addr)
+		if in.Op == OpHalt && module && o.Prog.Executable() {
+			l.stream = append(l.stream, linkInstr{op: OpJump, args: []int{end}, target: []bool{true}, file: file, line: line})
+			continue
+		}
+		li := linkInstr{op: in.Op, args: append([]int(nil), in.Args...), target: make([]bool, len(in.Args)), file: file, line: line}
+		for a, at := range in.OperandOffsets() {
+			r, ok := relocAt[at]
+			if !ok {
+				continue
+			}
+			switch r.Kind {
+			case RelocConst:
+				if li.args[a] >= len(l.constMap[i]) {
+					return 0, 0, &LinkError{o.Name, fmt.Sprintf("constant index %d at %d out of range", li.args[a], in.Addr)}
+				}
+				li.args[a] = l.constMap[i][li.args[a]]
+			case RelocGlobal:
+				li.args[a] += l.globalBase[i]
+			case RelocAddr:
+				t, ok := index[li.args[a]]
+				if !ok {
+					return 0, 0, &LinkError{o.Name, fmt.Sprintf("jump at %d targets %d, which is not an instruction of %s", in.Addr, li.args[a], co.Name)}
+				}
+				li.args[a] = t
+				li.target[a] = true
+			case RelocFunc:
+				if li.args[a] >= len(l.funcIndex[i]) || l.funcIndex[i][li.args[a]] < 0 {
+					return 0, 0, &LinkError{o.Name, fmt.Sprintf("call at %d of code object %d, which is not a function", in.Addr, li.args[a])}
+				}
+				li.args[a] = l.funcIndex[i][li.args[a]]
+			case RelocBuiltin:
+				if li.args[a] >= len(l.builtinMap[i]) {
+					return 0, 0, &LinkError{o.Name, fmt.Sprintf("builtin %d at %d out of range", li.args[a], in.Addr)}
+				}
+				li.args[a] = l.builtinMap[i][li.args[a]]
+			case RelocSymbol:
+				v, err := l.resolveSymbol(o.Prog.Symbols[r.Symbol].Name, opInfo[in.Op].Operands[a], li.args)
+				if err != nil {
+					return 0, 0, &LinkError{o.Name, err.Error()}
+				}
+				li.args[a] = v
+			}
+		}
+		l.stream = append(l.stream, li)
+	}
+	return start, end, nil
+}
+
+// layout assigns addresses from base to the linked stream and encodes it. An
+// instruction needs a WIDE prefix when an operand passes 65535, and for
+// jumps that depends on the addresses being assigned, so sizes are
+// recomputed until they settle. Instructions only ever grow, so this ends.
+// addrs[k] is the address of stream[k]; addrs[len(stream)] is the end.
+func layout(base int, stream []linkInstr) ([]byte, []int, error) {
+	addrs := make([]int, len(stream)+1)
+	addrs[0] = base
+	sizes := make([]int, len(stream))
+	for {
+		for k, li := range stream {
+			if sizes[k] == 0 {
+				sizes[k] = InstrSize(li.op, li.args...)
+			}
+			addrs[k+1] = addrs[k] + sizes[k]
+		}
+		changed := false
+		for k, li := range stream {
+			if size := InstrSize(li.op, resolveTargets(li, addrs)...); size > sizes[k] {
+				sizes[k] = size
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	var code []byte
+	for _, li := range stream {
+		var err error
+		code, err = EncodeInstr(code, li.op, resolveTargets(li, addrs)...)
+		if err != nil {
+			return nil, nil, &LinkError{"", err.Error()}
+		}
+	}
+	return code, addrs, nil
+}
+
+// resolveTargets returns li's operands with instruction indices turned into
+// addresses.
+func resolveTargets(li linkInstr, addrs []int) []int {
+	args := append([]int(nil), li.args...)
+	for a := range args {
+		if li.target[a] {
+			args[a] = addrs[args[a]]
+		}
+	}
+	return args
+}
+
+// resolveSymbol returns the linked global slot or code object index of the
+// definition of name, for an operand of the given kind. args are the
+// operands of the referring instruction, used to check a call's arity.
+func (l *linker) resolveSymbol(name string, kind OperandKind, args []int) (int, error) {
+	owners := l.defs[name]
+	switch len(owners) {
+	case 0:
+		return 0, fmt.Errorf("undefined: %s", name)
+	case 1:
+	default:
+		var names []string
+		for _, i := range owners {
+			names = append(names, l.objs[i].Name)
+		}
+		sort.Strings(names)
+		return 0, fmt.Errorf("%s is defined in more than one file (%s)", name, strings.Join(names, ", "))
+	}
+	o := owners[0]
+	for _, s := range l.objs[o].Prog.Symbols {
+		if s.Name != name || s.Kind == SymUndefined {
+			continue
+		}
+		switch {
+		case kind == OperandFunc && s.Kind == SymFunc:
+			co := l.objs[o].Prog.Funcs[s.Value]
+			if args[1] != co.Arity {
+				return 0, fmt.Errorf("%s takes %d argument(s), got %d", name, co.Arity, args[1])
+			}
+			return l.funcIndex[o][s.Value], nil
+		case kind == OperandGlobal && s.Kind == SymGlobal:
+			return l.globalBase[o] + s.Value, nil
+		case kind == OperandFunc:
+			return 0, fmt.Errorf("%s is not a function", name)
+		default:
+			return 0, fmt.Errorf("function %s used as a value", name)
+		}
+	}
+	return 0, fmt.Errorf("undefined: %s", name)
+}
+
+// deriveRelocs builds relocations for code that has none, such as an
+// already linked executable: every operand is taken to be relative to its
+// own program.
+func deriveRelocs(instrs []Instr) []Reloc {
+	var relocs []Reloc
+	for _, in := range instrs {
+		offs := in.OperandOffsets()
+		for a, k := range opInfo[in.Op].Operands {
+			at := offs[a]
+			switch k {
+			case OperandConst:
+				relocs = append(relocs, Reloc{Offset: at, Kind: RelocConst})
+			case OperandGlobal:
+				relocs = append(relocs, Reloc{Offset: at, Kind: RelocGlobal})
+			case OperandAddr:
+				relocs = append(relocs, Reloc{Offset: at, Kind: RelocAddr})
+			case OperandFunc:
+				relocs = append(relocs, Reloc{Offset: at, Kind: RelocFunc})
+			case OperandBuiltin:
+				relocs = append(relocs, Reloc{Offset: at, Kind: RelocBuiltin})
+			}
+		}
+	}
+	return relocs
+}
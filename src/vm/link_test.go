@@ -0,0 +1,203 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// compileObject compiles src to an unlinked object, as `quark glue` does
+// for each file.
+func compileObject(t *testing.T, name, src string) Object {
+	t.Helper()
+	blob, err := CompileSourceToBlob(name, src)
+	if err != nil {
+		t.Fatalf("compile %s: %v", name, err)
+	}
+	p, err := DecodeProgram(blob)
+	if err != nil {
+		t.Fatalf("decode %s: %v", name, err)
+	}
+	if p.Executable() {
+		t.Fatalf("%s compiled to an executable, want an object", name)
+	}
+	return Object{Name: name, Prog: p}
+}
+
+// runProgram runs p to the end and returns what it printed.
+func runProgram(t *testing.T, p *Program) string {
+	t.Helper()
+	var out bytes.Buffer
+	m := NewVM()
+	m.Stdout = &out
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := m.Run(); err != nil {
+		t.Fatalf("run: %v\noutput so far:\n%s", err, out.String())
+	}
+	return out.String()
+}
+
+func TestLinkResolvesSymbols(t *testing.T) {
+	lib := compileObject(t, "lib.quark", `
+let base = 10;
+let greeting = "hi";
+func add(x) { return x + base; }
+func twice(x) { return add(add(x)) - base; }
+`)
+	main := compileObject(t, "main.quark", `
+let mine = 1;
+print(greeting, add(5), twice(mine));
+print(base + mine);
+`)
+	p, err := Link([]Object{lib, main})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := runProgram(t, p), "hi 15 11\n11\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+	// each object keeps its own global slots, one after the other
+	if p.Globals != lib.Prog.Globals+main.Prog.Globals {
+		t.Errorf("%d globals, want %d", p.Globals, lib.Prog.Globals+main.Prog.Globals)
+	}
+	if got := p.GlobalName(lib.Prog.Globals); got != "mine" {
+		t.Errorf("first global of main.quark is %q, want mine", got)
+	}
+	if len(p.Symbols) != 0 || len(p.Relocs) != 0 {
+		t.Errorf("linked program keeps %d symbols and %d relocations", len(p.Symbols), len(p.Relocs))
+	}
+}
+
+// Jumps, constants and calls are relative to their own object until they
+// are linked, so an object placed after another must be rebased.
+func TestLinkRelocatesSecondObject(t *testing.T) {
+	first := compileObject(t, "a.quark", `
+let a = "first";
+func f(x) { return x * 2; }
+print(a, f(1));
+`)
+	second := compileObject(t, "b.quark", `
+let b = "second";
+func g(x) { return x * 3; }
+print(b, g(1), 7 / 2);
+`)
+	p, err := Link([]Object{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := runProgram(t, p), "first 2\nsecond 3 3.5\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+	p, err = Link([]Object{second, first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := runProgram(t, p), "second 3 3.5\nfirst 2\n"; got != want {
+		t.Errorf("in the other order, output %q, want %q", got, want)
+	}
+}
+
+func TestLinkMergesConstants(t *testing.T) {
+	a := compileObject(t, "a.quark", `print("shared", 42);`)
+	b := compileObject(t, "b.quark", `print("shared", 42, "own");`)
+	p, err := Link([]Object{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Consts) != 3 {
+		t.Errorf("linked pool is %v, want \"shared\", 42 and \"own\" once each", p.Consts)
+	}
+	if got, want := runProgram(t, p), "shared 42\nshared 42 own\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		srcs []string
+		want string
+	}{
+		{"undefined", []string{`print(missing);`}, "undefined: missing"},
+		{"defined twice", []string{`let x = 1;`, `let x = 2;`, `print(x);`}, "x is defined in more than one file (0.quark, 1.quark)"},
+		{"wrong arity", []string{`func f(a, b) { return a; }`, `print(f(1));`}, "f takes 2 argument(s), got 1"},
+		{"function as a value", []string{`func f() { return 1; }`, `print(f);`}, "function f used as a value"},
+		{"variable called", []string{`let f = 1;`, `print(f());`}, "f is not a function"},
+	}
+	for _, tt := range tests {
+		var objs []Object
+		for i, src := range tt.srcs {
+			objs = append(objs, compileObject(t, string(rune('0'+i))+".quark", src))
+		}
+		_, err := Link(objs)
+		if err == nil {
+			t.Errorf("%s: linked", tt.name)
+			continue
+		}
+		if _, ok := err.(*LinkError); !ok || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want a LinkError containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// A symbol whose value is not a slot or function of its object, from a
+// corrupt or crafted object file, is an error rather than a linker panic.
+func TestLinkBadSymbols(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(s *Symbol)
+		want string
+	}{
+		{"global past the object's globals", func(s *Symbol) { s.Kind, s.Value = SymGlobal, 1000 }, "global slot 1000 out of range"},
+		{"function past the code objects", func(s *Symbol) { s.Kind, s.Value = SymFunc, 1000 }, "code object 1000 is not a function"},
+		{"function that is the initialiser", func(s *Symbol) { s.Kind, s.Value = SymFunc, 0 }, "code object 0 is not a function"},
+		{"negative value", func(s *Symbol) { s.Kind, s.Value = SymGlobal, -1 }, "global slot -1 out of range"},
+	}
+	src := "let v = 1;\nfunc f(x) { return x; }\n"
+	for _, tt := range tests {
+		lib := compileObject(t, "lib.quark", src)
+		main := compileObject(t, "main.quark", "print(f(v));")
+		encodable := true
+		for i := range lib.Prog.Symbols {
+			if s := &lib.Prog.Symbols[i]; s.Name == "f" {
+				tt.edit(s)
+				encodable = s.Value >= 0
+			}
+		}
+		_, err := Link([]Object{lib, main})
+		if _, ok := err.(*LinkError); !ok || !strings.Contains(err.Error(), "lib.quark: symbol f: "+tt.want) {
+			t.Errorf("%s: got %v, want a LinkError containing %q", tt.name, err, tt.want)
+		}
+		if !encodable {
+			continue
+		}
+		// the same object read from a file is rejected as it is decoded
+		blob, err := EncodeProgram(lib.Prog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DecodeProgram(blob); !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: decoding got %v, want ErrCorrupt containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// An executable linked in, such as a dependency Gluon, runs its initialiser
+// and then carries on with the next object rather than halting.
+func TestLinkExecutable(t *testing.T) {
+	dep, err := Link([]Object{compileObject(t, "dep.quark", `let d = 5; func dbl(x) { return x * 2; } print("dep");`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := compileObject(t, "main.quark", `print("main", 1);`)
+	p, err := Link([]Object{{Name: "dep.gluon", Prog: dep}, main})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := runProgram(t, p), "dep\nmain 1\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
@@ -1,694 +1,464 @@
 package vm
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/json"
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
 	"strconv"
-	"strings"
-	"unicode"
 )
 
-/* ---------- Opcodes ---------- */
-
-const (
-	OpHalt byte = iota
-	OpLoadConst      // operand: u16 const index
-	OpStoreLocal     // operand: u16 local index
-	OpLoadLocal      // operand: u16 local index
-	OpAdd            // pop a,b push a+b
-	OpSub
-	OpMul
-	OpDiv
-	OpCallBuiltin    // operand: u8 builtin id, operand: u8 argc
-	OpPop
-	OpJump           // operand: u16 addr
-	OpJumpIfFalse    // operand: u16 addr
-)
-
-/* ---------- Lexer ---------- */
-type TokenKind int
-
-const (
-	TokEOF TokenKind = iota
-	TokIdent
-	TokNumber
-	TokString
-	TokLet
-	TokPrint
-	TokAssign   // =
-	TokSemi     // ;
-	TokLParen   // (
-	TokRParen   // )
-	TokPlus
-	TokMinus
-	TokStar
-	TokSlash
-	TokUnknown
-)
-
-type Token struct {
-	Kind  TokenKind
-	Value string
-	Pos   int
-}
-
-type Lexer struct {
-	input string
-	pos   int
-}
+/* ---------- VM ---------- */
 
-func NewLexer(s string) *Lexer { return &Lexer{input: s} }
+type Value interface{}
 
-func (l *Lexer) next() rune {
-	if l.pos >= len(l.input) {
-		return 0
-	}
-	r := rune(l.input[l.pos])
-	l.pos++
-	return r
-}
-func (l *Lexer) peek() rune {
-	if l.pos >= len(l.input) {
-		return 0
+// frame is a function activation. The module initialiser runs in the
+// bottom frame.
+type frame struct {
+	fn     *CodeObject
+	ret    int     // caller's ip
+	base   int     // caller's stack height, after the arguments were popped
+	locals []Value // sized from the code object, so never grows
+}
+
+// ErrHalted is returned by Step once the program has executed OpHalt.
+var ErrHalted = errors.New("program has halted")
+
+// VM runs one loaded program. It is not safe for concurrent use.
+type VM struct {
+	Stdout  io.Writer // program output, os.Stdout by default
+	Stdin   io.Reader // program input, os.Stdin by default; read through a buffer by input and readLine
+	Limits  Limits
+	Sched   SchedConfig
+	Profile *Profile // counts what runs when set
+
+	prog     *Program
+	builtins []*Builtin // prog.Builtins, resolved
+	ip       int
+	stack    []Value
+	code     []instr // prog.Code, pre-decoded
+	globals  []Value // unset until assigned
+	frames   []frame
+	halted   bool
+	steps    int64
+	heap     int64 // bytes in use, see alloc
+
+	cur       *fiber   // the running fiber, whose registers are ip, stack and frames
+	fibers    []*fiber // unfinished fibers
+	runq      []*fiber // runnable fibers waiting for their turn
+	nextFiber int
+	slice     int // instructions cur has run in its time slice
+	rng       *rand.Rand
+	rngSrc    *countingSource // rng's source, nil when rng is
+
+	stdin    *bufio.Reader // buffers Stdin, see readLine
+	stdinSrc io.Reader     // the Stdin that stdin reads
+	stdinPos int64         // bytes of stdinSrc read through stdin
+	resumeIn *inputPos     // where a snapshot left the input, until Stdin is next read
+	reading  *pendingLine  // a read of stdin still running, see readLine
+
+	ctx context.Context // of the RunContext running, nil outside it
+}
+
+func NewVM() *VM {
+	return &VM{Stdout: os.Stdout, Stdin: os.Stdin}
+}
+
+// Load decodes and verifies an executable blob and resets the VM to the
+// start of it.
+func (m *VM) Load(blob []byte) error {
+	prog, err := DecodeProgram(blob)
+	if err != nil {
+		return err
 	}
-	return rune(l.input[l.pos])
+	return m.LoadProgram(prog)
 }
 
-func (l *Lexer) skipSpace() {
-	for unicode.IsSpace(l.peek()) {
-		l.next()
+// LoadProgram is Load for an already decoded program.
+func (m *VM) LoadProgram(prog *Program) error {
+	if !prog.Executable() {
+		return fmt.Errorf("%w: blob is an unlinked object, link it with `quark glue` first", ErrNotBytecode)
 	}
-}
-
-func (l *Lexer) readWhile(pred func(rune) bool) string {
-	var b strings.Builder
-	for pred(l.peek()) && l.peek() != 0 {
-		b.WriteRune(l.next())
+	if _, err := Verify(prog); err != nil {
+		return err
 	}
-	return b.String()
+	builtins, err := resolveBuiltins(prog)
+	if err != nil {
+		return err
+	}
+	m.prog = prog
+	m.builtins = builtins
+	m.ip = 0
+	m.stack = make([]Value, 0, prog.Funcs[0].MaxStack)
+	m.code = predecode(prog)
+	m.globals = make([]Value, prog.Globals)
+	for i := range m.globals {
+		m.globals[i] = unset
+	}
+	m.frames = []frame{{fn: &prog.Funcs[0]}}
+	m.halted = false
+	m.steps = 0
+	m.resumeIn = nil
+	m.resetFibers()
+	m.heap = m.liveBytes()
+	return nil
 }
 
-func (l *Lexer) NextToken() Token {
-	l.skipSpace()
-	start := l.pos
-	ch := l.peek()
-	if ch == 0 {
-		return Token{Kind: TokEOF, Pos: start}
-	}
-	if unicode.IsLetter(ch) || ch == '_' {
-		s := l.readWhile(func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' })
-		switch s {
-		case "let":
-			return Token{Kind: TokLet, Value: s, Pos: start}
-		case "print":
-			return Token{Kind: TokPrint, Value: s, Pos: start}
-		default:
-			return Token{Kind: TokIdent, Value: s, Pos: start}
-		}
-	}
-	// numbers
-	if unicode.IsDigit(ch) {
-		num := l.readWhile(func(r rune) bool { return unicode.IsDigit(r) })
-		return Token{Kind: TokNumber, Value: num, Pos: start}
-	}
-	// strings : "..."
-	if ch == '"' {
-		l.next()
-		var b strings.Builder
-		for {
-			c := l.next()
-			if c == 0 {
-				return Token{Kind: TokUnknown, Pos: start}
-			}
-			if c == '"' {
-				break
-			}
-			if c == '\\' {
-				n := l.next()
-				if n == 'n' {
-					b.WriteByte('\n')
-				} else {
-					b.WriteRune(n)
-				}
-			} else {
-				b.WriteRune(c)
-			}
+// resolveBuiltins looks up the builtins prog imports.
+func resolveBuiltins(prog *Program) ([]*Builtin, error) {
+	builtins := make([]*Builtin, len(prog.Builtins))
+	for i, name := range prog.Builtins {
+		b, ok := LookupBuiltin(name)
+		if !ok {
+			return nil, fmt.Errorf("program uses builtin %s, which is not registered", name)
 		}
-		return Token{Kind: TokString, Value: b.String(), Pos: start}
-	}
-	switch l.next() {
-	case '=':
-		return Token{Kind: TokAssign, Pos: start}
-	case ';':
-		return Token{Kind: TokSemi, Pos: start}
-	case '(':
-		return Token{Kind: TokLParen, Pos: start}
-	case ')':
-		return Token{Kind: TokRParen, Pos: start}
-	case '+':
-		return Token{Kind: TokPlus, Pos: start}
-	case '-':
-		return Token{Kind: TokMinus, Pos: start}
-	case '*':
-		return Token{Kind: TokStar, Pos: start}
-	case '/':
-		return Token{Kind: TokSlash, Pos: start}
-	default:
-		return Token{Kind: TokUnknown, Pos: start}
+		builtins[i] = b
 	}
+	return builtins, nil
 }
 
-/* ---------- Parser ---------- */
-
-type Expr interface{}
-type NumberLiteral struct{ Val int64 }
-type StringLiteral struct{ Val string }
-type Ident struct{ Name string }
-type Binary struct {
-	Op    TokenKind
-	Left  Expr
-	Right Expr
-}
-type Call struct {
-	Callee string
-	Args   []Expr
-}
-
-type Stmt interface{}
-type LetStmt struct {
-	Name string
-	Val  Expr
-}
-type ExprStmt struct {
-	E Expr
-}
+// Program returns the loaded program.
+func (m *VM) Program() *Program { return m.prog }
 
-type Parser struct {
-	lex  *Lexer
-	cur  Token
-	peek Token
-}
+// IP is the address of the next instruction.
+func (m *VM) IP() int { return m.ip }
 
-func NewParser(src string) *Parser {
-	l := NewLexer(src)
-	p := &Parser{lex: l}
-	p.cur = p.lex.NextToken()
-	p.peek = p.lex.NextToken()
-	return p
-}
+// Halted reports whether the program has finished.
+func (m *VM) Halted() bool { return m.halted }
 
-func (p *Parser) advance() {
-	p.cur = p.peek
-	p.peek = p.lex.NextToken()
-}
+// Stack returns a copy of the operand stack, bottom first.
+func (m *VM) Stack() []Value { return append([]Value(nil), m.stack...) }
 
-func (p *Parser) expect(kind TokenKind) error {
-	if p.cur.Kind == kind {
+// Locals returns a copy of the current frame's locals. The module
+// initialiser has none; its variables are globals.
+func (m *VM) Locals() []Value {
+	if len(m.frames) == 0 {
 		return nil
 	}
-	return fmt.Errorf("expected token %v, got %v", kind, p.cur.Kind)
+	return append([]Value(nil), m.frames[len(m.frames)-1].locals...)
 }
 
-func (p *Parser) parseProgram() ([]Stmt, error) {
-	var out []Stmt
-	for p.cur.Kind != TokEOF {
-		st, err := p.parseStatement()
-		if err != nil {
-			return nil, err
+// Globals returns a copy of the assigned global slots.
+func (m *VM) Globals() map[int]Value {
+	g := map[int]Value{}
+	for k, v := range m.globals {
+		if v != unset {
+			g[k] = v
 		}
-		out = append(out, st)
 	}
-	return out, nil
+	return g
 }
 
-func (p *Parser) parseStatement() (Stmt, error) {
-	if p.cur.Kind == TokLet {
-		p.advance()
-		if p.cur.Kind != TokIdent {
-			return nil, fmt.Errorf("expected identifier after let")
-		}
-		name := p.cur.Value
-		p.advance()
-		if p.cur.Kind != TokAssign {
-			return nil, fmt.Errorf("expected = after identifier")
-		}
-		p.advance()
-		expr, err := p.parseExpression()
-		if err != nil {
-			return nil, err
-		}
-		if p.cur.Kind == TokSemi {
-			p.advance()
-		}
-		return LetStmt{Name: name, Val: expr}, nil
-	}
-	// expression statement
-	expr, err := p.parseExpression()
-	if err != nil {
-		return nil, err
-	}
-	if p.cur.Kind == TokSemi {
-		p.advance()
-	}
-	return ExprStmt{E: expr}, nil
+// Run executes until OpHalt, an error or a limit.
+func (m *VM) Run() error {
+	return m.RunContext(context.Background())
 }
 
-func (p *Parser) parseExpression() (Expr, error) {
-	return p.parseBinary(0)
+func RunBytecode(blob []byte) error {
+	m := NewVM()
+	if err := m.Load(blob); err != nil {
+		return err
+	}
+	return m.Run()
 }
 
-var precedence = map[TokenKind]int{
-	TokPlus:  10,
-	TokMinus: 10,
-	TokStar:  20,
-	TokSlash: 20,
+func (m *VM) push(v Value) { m.stack = append(m.stack, v) }
+
+// pop never finds the stack empty: the verifier proved every instruction
+// has its operands.
+func (m *VM) pop() Value {
+	v := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return v
 }
 
-func (p *Parser) parseBinary(minPrec int) (Expr, error) {
-	left, err := p.parsePrimary()
-	if err != nil {
-		return nil, err
+// Step executes one instruction. Errors from the program are
+// *RuntimeError, carrying the stack trace.
+func (m *VM) Step() error {
+	if m.prog == nil {
+		return errors.New("no program loaded")
 	}
-	for {
-		op := p.cur.Kind
-		prec, ok := precedence[op]
-		if !ok || prec < minPrec {
-			break
-		}
-		p.advance()
-		right, err := p.parseBinary(prec + 1)
-		if err != nil {
-			return nil, err
-		}
-		left = Binary{Op: op, Left: left, Right: right}
+	if m.halted {
+		return ErrHalted
 	}
-	return left, nil
+	if err := m.cur.err; err != nil {
+		// raised in the builtin the fiber was blocked in
+		m.cur.err = nil
+		return m.runtimeError(m.ip-1, err)
+	}
+	addr := m.ip
+	if m.Profile != nil && addr < len(m.prog.Code) {
+		m.Profile.record(m, addr)
+	}
+	if err := m.step(); err != nil {
+		return m.runtimeError(addr, err)
+	}
+	return m.reschedule()
 }
 
-func (p *Parser) parsePrimary() (Expr, error) {
-	switch p.cur.Kind {
-	case TokNumber:
-		n, _ := strconv.ParseInt(p.cur.Value, 10, 64)
-		v := NumberLiteral{Val: n}
-		p.advance()
-		return v, nil
-	case TokString:
-		v := StringLiteral{Val: p.cur.Value}
-		p.advance()
-		return v, nil
-	case TokIdent, TokPrint:
-		name := p.cur.Value
-		p.advance()
-		if p.cur.Kind == TokLParen {
-			// call
-			p.advance()
-			var args []Expr
-			if p.cur.Kind != TokRParen {
-				for {
-					arg, err := p.parseExpression()
-					if err != nil {
-						return nil, err
-					}
-					args = append(args, arg)
-					if p.cur.Kind == TokRParen {
-						break
-					}
-					break
-				}
+// runBatch runs up to n instructions, as n calls of Step would. While the
+// running fiber is the only one that can run, the scheduler only counts
+// its time slice, so that is done inline rather than through reschedule.
+func (m *VM) runBatch(n int) error {
+	if m.Profile != nil {
+		for ; n > 0 && !m.halted; n-- {
+			if err := m.Step(); err != nil {
+				return err
 			}
-			if p.cur.Kind == TokRParen {
-				p.advance()
+		}
+		return nil
+	}
+	for ; n > 0 && !m.halted; n-- {
+		cur := m.cur
+		if cur.err != nil || cur.resume || cur.state != fiberRunnable || len(m.runq) > 0 {
+			if err := m.Step(); err != nil {
+				return err
 			}
-			return Call{Callee: name, Args: args}, nil
+			continue
 		}
-		return Ident{Name: name}, nil
-	case TokLParen:
-		p.advance()
-		e, err := p.parseExpression()
-		if err != nil {
-			return nil, err
+		addr := m.ip
+		if err := m.step(); err != nil {
+			return m.runtimeError(addr, err)
 		}
-		if p.cur.Kind == TokRParen {
-			p.advance()
+		if m.cur.state != fiberRunnable || m.cur.resume || len(m.runq) > 0 || m.halted {
+			if err := m.reschedule(); err != nil {
+				return err
+			}
+			continue
 		}
-		return e, nil
-	default:
-		return nil, fmt.Errorf("unexpected token in primary: %v", p.cur)
+		m.slice++
 	}
+	return nil
 }
 
-/* ---------- Compiler (AST -> bytecode + constants) ---------- */
-
-type Compiler struct {
-	consts   []interface{}
-	code     []byte
-	locals   map[string]uint16 // map local name -> index
-	nextLoc  uint16
-}
-
-func NewCompiler() *Compiler {
-	return &Compiler{
-		consts:  []interface{}{},
-		code:    []byte{},
-		locals:  map[string]uint16{},
-		nextLoc: 0,
-	}
-}
-func (c *Compiler) addConst(v interface{}) uint16 {
-	for i, x := range c.consts {
-		if x == v {
-			return uint16(i)
+// step runs the instruction at ip from the pre-decoded stream. Operand
+// ranges, stack depths and local assignment were checked by Verify when
+// the program was loaded, so they are not checked again here.
+func (m *VM) step() error {
+	if m.Limits.MaxSteps > 0 && m.steps >= m.Limits.MaxSteps {
+		return fmt.Errorf("%w: %d instructions executed", ErrStepLimit, m.steps)
+	}
+	m.steps++
+	if m.ip >= len(m.code) {
+		return errors.New("ip out of range")
+	}
+	in := &m.code[m.ip]
+	at, depth := m.ip, len(m.stack)
+	m.ip += int(in.size)
+	err := m.exec(in)
+	if errors.Is(err, ErrOutOfMemory) || errors.Is(err, ErrCanceled) || errors.Is(err, ErrTimeout) {
+		// instructions charge memory, and builtins wait for input, before
+		// they change anything but the stack, so put the operands back and
+		// run it again next time
+		m.ip, m.stack = at, m.stack[:depth]
+		m.steps--
+	}
+	return err
+}
+
+// exec runs in, with ip already past it.
+func (m *VM) exec(in *instr) error {
+	switch in.op {
+	case OpHalt:
+		m.halted = true
+	case OpLoadConst:
+		m.push(m.prog.Consts[in.a])
+	case OpStoreLocal:
+		m.frames[len(m.frames)-1].locals[in.a] = m.pop()
+	case OpLoadLocal:
+		m.push(m.frames[len(m.frames)-1].locals[in.a])
+	case OpStoreGlobal:
+		if m.globals[in.a] == unset {
+			if err := m.alloc(slotSize); err != nil {
+				return err
+			}
 		}
-	}
-	c.consts = append(c.consts, v)
-	return uint16(len(c.consts) - 1)
-}
-func (c *Compiler) emit(b ...byte) {
-	c.code = append(c.code, b...)
-}
-func (c *Compiler) emitU16(u uint16) {
-	b := make([]byte, 2)
-	binary.LittleEndian.PutUint16(b, u)
-	c.emit(b...)
-}
-
-func (c *Compiler) compileExpr(e Expr) error {
-	switch v := e.(type) {
-	case NumberLiteral:
-		idx := c.addConst(v.Val)
-		c.emit(byte(OpLoadConst))
-		c.emitU16(idx)
-	case StringLiteral:
-		idx := c.addConst(v.Val)
-		c.emit(byte(OpLoadConst))
-		c.emitU16(idx)
-	case Ident:
-		li, ok := c.locals[v.Name]
-		if !ok {
-			return fmt.Errorf("unknown identifier %s", v.Name)
+		m.globals[in.a] = m.pop()
+	case OpLoadGlobal:
+		v := m.globals[in.a]
+		if v == unset {
+			return fmt.Errorf("uninitialized global %d", in.a)
 		}
-		c.emit(byte(OpLoadLocal))
-		c.emitU16(li)
-	case Binary:
-		if err := c.compileExpr(v.Left); err != nil {
-			return err
+		m.push(v)
+	case OpCall:
+		if len(m.frames) >= m.Limits.maxStackDepth() {
+			return fmt.Errorf("%w: more than %d nested calls", ErrStackOverflow, m.Limits.maxStackDepth())
 		}
-		if err := c.compileExpr(v.Right); err != nil {
+		fn := &m.prog.Funcs[in.a]
+		if err := m.alloc(frameCharge(fn)); err != nil {
 			return err
 		}
-		switch v.Op {
-		case TokPlus:
-			c.emit(byte(OpAdd))
-		case TokMinus:
-			c.emit(byte(OpSub))
-		case TokStar:
-			c.emit(byte(OpMul))
-		case TokSlash:
-			c.emit(byte(OpDiv))
-		default:
-			return fmt.Errorf("unknown binary op")
+		argc := in.b
+		locals := make([]Value, fn.NumLocals)
+		copy(locals, m.stack[len(m.stack)-argc:])
+		m.stack = m.stack[:len(m.stack)-argc]
+		if need := len(m.stack) + fn.MaxStack; need > cap(m.stack) {
+			m.stack = append(make([]Value, 0, 2*need), m.stack...)
 		}
-	case Call:
-		for _, a := range v.Args {
-			if err := c.compileExpr(a); err != nil {
-				return err
+		m.frames = append(m.frames, frame{fn: fn, ret: m.ip, base: len(m.stack), locals: locals})
+		m.ip = fn.Entry
+	case OpReturn:
+		v := m.pop()
+		if len(m.frames) == 1 {
+			// the bottom frame of a spawned fiber, nobody takes the result
+			m.exitFiber()
+			return nil
+		}
+		fr := m.frames[len(m.frames)-1]
+		m.frames = m.frames[:len(m.frames)-1]
+		m.heap -= frameCharge(fr.fn)
+		m.stack = m.stack[:fr.base]
+		m.push(v)
+		m.ip = fr.ret
+	case OpSpawn:
+		argc := in.b
+		if err := m.spawn(&m.prog.Funcs[in.a], m.stack[len(m.stack)-argc:]); err != nil {
+			return err
+		}
+		m.stack = m.stack[:len(m.stack)-argc]
+	case OpAdd, OpSub, OpMul, OpDiv, OpMod:
+		n := len(m.stack)
+		av, bv := m.stack[n-2], m.stack[n-1]
+		// int and float operands, the common case, are done in place
+		if a, ok := av.(int64); ok {
+			// int / int is true division, done as floats, unless it is
+			// by zero, which has no result
+			if b, ok := bv.(int64); ok && (in.op != OpDiv || b == 0) {
+				m.stack = m.stack[:n-1]
+				switch in.op {
+				case OpAdd:
+					m.stack[n-2] = a + b
+				case OpSub:
+					m.stack[n-2] = a - b
+				case OpMul:
+					m.stack[n-2] = a * b
+				default:
+					v, err := intDiv(in.op, a, b)
+					if err != nil {
+						return err
+					}
+					m.stack[n-2] = v
+				}
+				return nil
 			}
 		}
-		if v.Callee == "print" {
-			argc := byte(len(v.Args))
-			c.emit(byte(OpCallBuiltin))
-			c.emit(argc)
-		} else {
-			return fmt.Errorf("unknown function %s", v.Callee)
+		m.stack = m.stack[:n-2]
+		return m.arith(in.op, av, bv)
+	case OpBitAnd, OpBitOr, OpBitXor, OpShl, OpShr, OpUshr:
+		n := len(m.stack)
+		a, aok := m.stack[n-2].(int64)
+		b, bok := m.stack[n-1].(int64)
+		if !aok || !bok {
+			return fmt.Errorf("unsupported operand types for %s: %v and %v", OpName(in.op), TypeOf(m.stack[n-2]), TypeOf(m.stack[n-1]))
 		}
-	default:
-		return fmt.Errorf("unknown expr type %T", v)
-	}
-	return nil
-}
-
-func (c *Compiler) compileStmt(s Stmt) error {
-	switch st := s.(type) {
-	case LetStmt:
-		idx := c.nextLoc
-		c.nextLoc++
-		c.locals[st.Name] = idx
-		if err := c.compileExpr(st.Val); err != nil {
+		m.stack = m.stack[:n-1]
+		m.stack[n-2] = bitwise(in.op, a, b)
+	case OpBitNot:
+		n := len(m.stack)
+		a, ok := m.stack[n-1].(int64)
+		if !ok {
+			return fmt.Errorf("unsupported operand type for %s: %v", OpName(in.op), TypeOf(m.stack[n-1]))
+		}
+		m.stack[n-1] = ^a
+	case OpCallBuiltin:
+		argc := in.b
+		args := make([]Value, argc)
+		copy(args, m.stack[len(m.stack)-argc:])
+		m.stack = m.stack[:len(m.stack)-argc]
+
+		b := m.builtins[in.a]
+		if err := b.check(args); err != nil {
 			return err
 		}
-		c.emit(byte(OpStoreLocal))
-		c.emitU16(idx)
-	case ExprStmt:
-		if err := c.compileExpr(st.E); err != nil {
+		v, err := b.Fn(m, args)
+		if errors.Is(err, errBlocked) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", b.Name, err)
+		}
+		// charged once the builtin has made it; if that is refused the
+		// call is made again, and a line readLine or input took is lost
+		if err := m.alloc(sizeOf(v)); err != nil {
 			return err
 		}
-		c.emit(byte(OpPop))
+		m.push(v)
+	case OpPop:
+		m.pop()
+	case OpJump:
+		m.ip = in.a
+	case OpJumpIfFalse:
+		sf := false
+		switch x := m.pop().(type) {
+		case int64:
+			sf = x == 0
+		case float64:
+			sf = x == 0
+		case bool:
+			sf = !x
+		case string:
+			sf = x == ""
+		}
+		if sf {
+			m.ip = in.a
+		}
+	case opInvalid:
+		return fmt.Errorf("no instruction at %d", m.ip-int(in.size))
 	default:
-		return fmt.Errorf("unknown stmt type %T", st)
+		return fmt.Errorf("unknown opcode %d", in.op)
 	}
 	return nil
 }
 
-func (c *Compiler) compileProgram(stmts []Stmt) ([]byte, []interface{}, error) {
-	for _, s := range stmts {
-		if err := c.compileStmt(s); err != nil {
-			return nil, nil, err
-		}
-	}
-	return c.code, c.consts, nil
-}
-
-/* ---------- Serializer / Deserializer ---------- */
-
-// Format: [4-byte len][const JSON bytes][bytecode bytes]
-func SerializeBytecode(code []byte, consts []interface{}) ([]byte, error) {
-	j, err := json.Marshal(consts)
-	if err != nil {
-		return nil, err
-	}
-	buf := bytes.NewBuffer(nil)
-	ln := uint32(len(j))
-	binary.Write(buf, binary.LittleEndian, ln)
-	buf.Write(j)
-	buf.Write(code)
-	return buf.Bytes(), nil
-}
-
-func DeserializeBytecode(blob []byte) ([]byte, []interface{}, error) {
-	if len(blob) < 4 {
-		return nil, nil, errors.New("blob too small")
-	}
-	ln := binary.LittleEndian.Uint32(blob[:4])
-	if int(4+ln) > len(blob) {
-		return nil, nil, errors.New("invalid length")
-	}
-	constJSON := blob[4 : 4+ln]
-	var consts []interface{}
-	if err := json.Unmarshal(constJSON, &consts); err != nil {
-		return nil, nil, err
-	}
-	code := blob[4+ln:]
-	return code, consts, nil
-}
-
-/* ---------- VM ---------- */
-
-type Value interface{}
-
-func RunBytecode(blob []byte) error {
-	code, consts, err := DeserializeBytecode(blob)
-	if err != nil {
-		return err
-	}
-	ip := 0
-	var stack []Value
-	locals := map[uint16]Value{}
-
-	push := func(v Value) { stack = append(stack, v) }
-	pop := func() (Value, error) {
-		if len(stack) == 0 {
-			return nil, errors.New("stack empty")
-		}
-		v := stack[len(stack)-1]
-		stack = stack[:len(stack)-1]
-		return v, nil
-	}
-
-	readU16 := func() (uint16, error) {
-		if ip+2 > len(code) {
-			return 0, errors.New("read past end")
-		}
-		x := binary.LittleEndian.Uint16(code[ip : ip+2])
-		ip += 2
-		return x, nil
-	}
-
-	for {
-		if ip >= len(code) {
-			return errors.New("ip out of range")
-		}
-		op := byte(code[ip])
-		ip++
-		switch op {
-		case OpHalt:
-			return nil
-		case OpLoadConst:
-			idx, err := readU16()
-			if err != nil {
-				return err
-			}
-			if int(idx) >= len(consts) {
-				return fmt.Errorf("const idx out of range")
-			}
-			push(consts[idx])
-		case OpStoreLocal:
-			li, err := readU16()
-			if err != nil {
-				return err
-			}
-			v, err := pop()
-			if err != nil {
-				return err
-			}
-			locals[li] = v
-		case OpLoadLocal:
-			li, err := readU16()
-			if err != nil {
-				return err
-			}
-			v, ok := locals[li]
-			if !ok {
-				return fmt.Errorf("uninitialized local %d", li)
-			}
-			push(v)
-		case OpAdd, OpSub, OpMul, OpDiv:
-			bv, err := pop()
-			if err != nil {
-				return err
-			}
-			av, err := pop()
-			if err != nil {
-				return err
-			}
-			switch a := av.(type) {
-			case float64:
-				af := a
-				bf := 0.0
-				switch bb := bv.(type) {
-				case float64:
-					bf = bb
-				case string:
-					bf, _ = strconv.ParseFloat(bb, 64)
-				}
-				var res float64
-				if op == OpAdd {
-					res = af + bf
-				} else if op == OpSub {
-					res = af - bf
-				} else if op == OpMul {
-					res = af * bf
-				} else {
-					res = af / bf
-				}
-				push(res)
-			case string:
-				if op == OpAdd {
-					if bs, ok := bv.(string); ok {
-						push(a + bs)
-						continue
-					}
+// arith is ADD, SUB, MUL, DIV and MOD for operands other than two ints.
+func (m *VM) arith(op byte, av, bv Value) error {
+	switch a := av.(type) {
+	case int64:
+		m.push(floatArith(op, float64(a), bv))
+	case float64:
+		m.push(floatArith(op, a, bv))
+	case string:
+		if op == OpAdd {
+			if bs, ok := bv.(string); ok {
+				// charged before concatenating, so a string over the
+				// limit is never built
+				if err := m.alloc(int64(len(a) + len(bs))); err != nil {
+					return err
 				}
-				return fmt.Errorf("unsupported operand types for op")
-			default:
-				return fmt.Errorf("unsupported operand a type %T", a)
-			}
-		case OpCallBuiltin:
-			if ip >= len(code) {
-				return fmt.Errorf("unexpected eof for builtin")
-			}
-			argc := int(code[ip])
-			ip++
-			if len(stack) < argc {
-				return fmt.Errorf("stack underflow for call, want %d", argc)
+				m.push(a + bs)
+				return nil
 			}
-
-			args := make([]Value, argc)
-			for i := argc - 1; i >= 0; i-- {
-				v := stack[len(stack)-1]
-				stack = stack[:len(stack)-1]
-				args[i] = v
-			}
-
-			out := make([]string, len(args))
-			for i, a := range args {
-				switch x := a.(type) {
-				case float64:
-					out[i] = strconv.FormatFloat(x, 'f', -1, 64)
-				case string:
-					out[i] = x
-				default:
-					out[i] = fmt.Sprintf("%v", x)
-				}
-			}
-			fmt.Println(strings.Join(out, " "))
-
-			push(nil)
-		case OpPop:
-			if _, err := pop(); err != nil {
-				return err
-			}
-		case OpJump:
-			addr, err := readU16()
-			if err != nil {
-				return err
-			}
-			ip = int(addr)
-		case OpJumpIfFalse:
-			addr, err := readU16()
-			if err != nil {
-				return err
-			}
-			v, err := pop()
-			if err != nil {
-				return err
-			}
-			sf := false
-			switch x := v.(type) {
-			case float64:
-				sf = x == 0
-			case string:
-				sf = x == ""
-			default:
-				sf = false
-			}
-			if sf {
-				ip = int(addr)
-			}
-		default:
-			return fmt.Errorf("unknown opcode %d", op)
 		}
+		return fmt.Errorf("unsupported operand types for %s: %v and %v", OpName(op), TypeOf(av), TypeOf(bv))
+	default:
+		return fmt.Errorf("unsupported operand types for %s: %v and %v", OpName(op), TypeOf(av), TypeOf(bv))
 	}
+	return nil
 }
 
-/* ---------- Glue: compile source -> blob ---------- */
-
-func CompileSourceToBlob(src string) ([]byte, error) {
-	p := NewParser(src)
-	stmts, err := p.parseProgram()
-	if err != nil {
-		return nil, err
-	}
-	c := NewCompiler()
-	code, consts, err := c.compileProgram(stmts)
-	if err != nil {
-		return nil, err
-	}
-	blob, err := SerializeBytecode(code, consts)
-	if err != nil {
-		return nil, err
-	}
-	return blob, nil
+func floatArith(op byte, af float64, bv Value) float64 {
+	bf := 0.0
+	switch bb := bv.(type) {
+	case int64:
+		bf = float64(bb)
+	case float64:
+		bf = bb
+	case string:
+		bf, _ = strconv.ParseFloat(bb, 64)
+	}
+	switch op {
+	case OpAdd:
+		return af + bf
+	case OpSub:
+		return af - bf
+	case OpMul:
+		return af * bf
+	case OpMod:
+		return math.Mod(af, bf)
+	}
+	return af / bf
 }
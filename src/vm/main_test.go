@@ -0,0 +1,162 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const addSrc = `
+.const
+    a: 2
+    b: 3
+.code
+    LOAD_CONST a
+    LOAD_CONST b
+    CALL add 2
+    STORE_GLOBAL 0
+    HALT
+.func add 2 3
+    LOAD_LOCAL 0
+    LOAD_LOCAL 1
+    ADD
+    STORE_LOCAL 2
+    LOAD_LOCAL 2
+    RETURN
+`
+
+// Stepping shows the registers after each instruction, through a call and
+// back.
+func TestStepInspect(t *testing.T) {
+	p := assemble(t, addSrc)
+	m := NewVM()
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatal(err)
+	}
+	add := p.Funcs[1].Entry
+	steps := []struct {
+		ip     int
+		stack  []Value
+		locals []Value
+	}{
+		{3, []Value{int64(2)}, []Value{}},
+		{6, []Value{int64(2), int64(3)}, []Value{}},
+		{add, []Value{}, []Value{int64(2), int64(3), nil}},
+		{add + 3, []Value{int64(2)}, []Value{int64(2), int64(3), nil}},
+		{add + 6, []Value{int64(2), int64(3)}, []Value{int64(2), int64(3), nil}},
+		{add + 7, []Value{int64(5)}, []Value{int64(2), int64(3), nil}},
+		{add + 10, []Value{}, []Value{int64(2), int64(3), int64(5)}},
+		{add + 13, []Value{int64(5)}, []Value{int64(2), int64(3), int64(5)}},
+		{10, []Value{int64(5)}, []Value{}},
+		{13, []Value{}, []Value{}},
+	}
+	for i, want := range steps {
+		if err := m.Step(); err != nil {
+			t.Fatalf("step %d: %v", i+1, err)
+		}
+		if m.IP() != want.ip || !sameValues(m.Stack(), want.stack) || !sameValues(m.Locals(), want.locals) {
+			t.Errorf("after step %d: ip %d, stack %v, locals %v; want ip %d, stack %v, locals %v",
+				i+1, m.IP(), m.Stack(), m.Locals(), want.ip, want.stack, want.locals)
+		}
+	}
+	if g := m.Globals(); len(g) != 1 || g[0] != int64(5) {
+		t.Errorf("globals %v, want slot 0 set to 5", g)
+	}
+	if err := m.Step(); err != nil || !m.Halted() {
+		t.Fatalf("HALT: %v, halted %v", err, m.Halted())
+	}
+	if err := m.Step(); !errors.Is(err, ErrHalted) {
+		t.Errorf("step after HALT: %v, want ErrHalted", err)
+	}
+	if m.Steps() != int64(len(steps)+1) {
+		t.Errorf("%d steps counted, want %d", m.Steps(), len(steps)+1)
+	}
+}
+
+// sameValues is reflect.DeepEqual with nil and empty slices equal.
+func sameValues(a, b []Value) bool {
+	return len(a) == len(b) && (len(a) == 0 || reflect.DeepEqual(a, b))
+}
+
+func TestInspectReturnsCopies(t *testing.T) {
+	m := NewVM()
+	if err := m.LoadProgram(assemble(t, addSrc)); err != nil {
+		t.Fatal(err)
+	}
+	m.Step()
+	m.Stack()[0] = "changed"
+	if got := m.Stack()[0]; got != int64(2) {
+		t.Errorf("changing Stack's result changed the stack to %v", got)
+	}
+}
+
+// Loading again starts the program over.
+func TestLoadResets(t *testing.T) {
+	p := assemble(t, addSrc)
+	m := NewVM()
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatal(err)
+	}
+	if m.IP() != 0 || m.Halted() || m.Steps() != 0 || len(m.Stack()) != 0 || len(m.Globals()) != 0 {
+		t.Errorf("after reloading: ip %d, halted %v, %d steps, stack %v, globals %v", m.IP(), m.Halted(), m.Steps(), m.Stack(), m.Globals())
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	m := NewVM()
+	if err := m.Step(); err == nil {
+		t.Error("Step with nothing loaded succeeded")
+	}
+	object, err := CompileSourceToBlob("t.quark", "print(1);\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Load(object); !errors.Is(err, ErrNotBytecode) {
+		t.Errorf("loading an unlinked object: %v, want ErrNotBytecode", err)
+	}
+	if err := m.Load([]byte("junk")); !IsBlobError(err) {
+		t.Errorf("loading junk: %v, want a blob error", err)
+	}
+}
+
+// Program I/O goes through Stdout and Stdin, not the process's.
+func TestProgramIO(t *testing.T) {
+	p, err := Link([]Object{compileObject(t, "t.quark", `print("got", readLine()); print(input("name? "));`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	m := NewVM()
+	m.Stdout = &out
+	m.Stdin = strings.NewReader("first\nsecond\n")
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "got first\nname? second\n"; out.String() != want {
+		t.Errorf("output %q, want %q", out.String(), want)
+	}
+}
+
+func TestRunBytecode(t *testing.T) {
+	blob, err := AssembleToBlob("t.qasm", addSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RunBytecode(blob); err != nil {
+		t.Errorf("RunBytecode: %v", err)
+	}
+	if err := RunBytecode(blob[:20]); !IsBlobError(err) {
+		t.Errorf("RunBytecode of a truncated blob: %v", err)
+	}
+}
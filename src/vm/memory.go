@@ -0,0 +1,116 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+/* ---------- Memory accounting ---------- */
+
+// ErrOutOfMemory is returned when an allocation would take the program past
+// Limits.MaxMemory. The allocation is not made and the VM is left before
+// the instruction that asked for it, so a host may raise the limit, or drop
+// values, and Run again.
+var ErrOutOfMemory = errors.New("out of memory")
+
+// slotSize is what one Value slot of the stack, a frame or the globals is
+// charged, the size of an interface value.
+const slotSize = int64(unsafe.Sizeof(Value(nil)))
+
+// frameSize is the fixed charge for a call frame.
+const frameSize = int64(unsafe.Sizeof(frame{}))
+
+// sizeOf is the heap memory v owns, beyond its slot. Numbers, bools and
+// chars live in the slot itself; a channel owns its buffer slots but not
+// the values in them.
+func sizeOf(v Value) int64 {
+	switch x := v.(type) {
+	case string:
+		return int64(len(x))
+	case *Channel:
+		return int64(unsafe.Sizeof(*x)) + slotSize*int64(x.Cap)
+	}
+	return 0
+}
+
+// frameCharge is what a call to fn is charged for its frame, locals and
+// operand stack. It is given back on return.
+func frameCharge(fn *CodeObject) int64 {
+	return frameSize + slotSize*int64(fn.NumLocals+fn.MaxStack)
+}
+
+// alloc charges n bytes to the program. The running total only grows
+// between measurements, so when it passes the limit the live memory is
+// measured from the roots; only if that is still over is it an error.
+func (m *VM) alloc(n int64) error {
+	m.heap += n
+	if m.Limits.MaxMemory <= 0 || m.heap <= m.Limits.MaxMemory {
+		return nil
+	}
+	m.heap = m.liveBytes() + n
+	if m.heap > m.Limits.MaxMemory {
+		m.heap -= n
+		return fmt.Errorf("%w: allocating %d bytes with %d in use, the limit is %d", ErrOutOfMemory, n, m.heap, m.Limits.MaxMemory)
+	}
+	return nil
+}
+
+// liveBytes measures the memory reachable from the fibers and the
+// globals. Frames are charged as in frameCharge, which covers their slots;
+// a string or channel referenced from several slots is counted once.
+func (m *VM) liveBytes() int64 {
+	seen := map[unsafe.Pointer]bool{}
+	total := int64(0)
+	var add func(v Value)
+	add = func(v Value) {
+		var p unsafe.Pointer
+		switch x := v.(type) {
+		case string:
+			if len(x) == 0 {
+				return
+			}
+			p = unsafe.Pointer(unsafe.StringData(x))
+		case *Channel:
+			p = unsafe.Pointer(x)
+		default:
+			return
+		}
+		if seen[p] {
+			return
+		}
+		seen[p] = true
+		total += sizeOf(v)
+		if ch, ok := v.(*Channel); ok {
+			for _, b := range ch.buf {
+				add(b)
+			}
+		}
+	}
+	m.save()
+	for _, f := range m.fibers {
+		for _, fr := range f.frames {
+			total += frameCharge(fr.fn)
+			for _, v := range fr.locals {
+				add(v)
+			}
+		}
+		for _, v := range f.stack {
+			add(v)
+		}
+		add(f.sending)
+		add(f.result)
+	}
+	for _, v := range m.globals {
+		if v != unset {
+			total += slotSize
+			add(v)
+		}
+	}
+	return total
+}
+
+// MemoryInUse is the VM's current estimate of the program's memory, in
+// bytes. It is exact right after a measurement and may overcount between
+// them, since values that are dropped are only noticed by measuring.
+func (m *VM) MemoryInUse() int64 { return m.heap }
@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// loadLimited loads src with a memory limit of max bytes.
+func loadLimited(t *testing.T, src string, max int64) *VM {
+	t.Helper()
+	p, err := Link([]Object{compileObject(t, "t.quark", src)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewVM()
+	m.Limits.MaxMemory = max
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMaxMemoryString(t *testing.T) {
+	m := loadLimited(t, "func grow(s) { return grow(s + s); }\ngrow(\"x\");\n", 1<<16)
+	err := m.Run()
+	if !errors.Is(err, ErrOutOfMemory) || !IsLimitError(err) {
+		t.Fatalf("got %v, want ErrOutOfMemory", err)
+	}
+	if !strings.Contains(err.Error(), "the limit is 65536") {
+		t.Errorf("error %q does not give the limit", err)
+	}
+	var re *RuntimeError
+	if !errors.As(err, &re) || len(re.Trace) == 0 || re.Trace[0].Func != "grow" {
+		t.Errorf("%v is not traced to grow", err)
+	}
+	if m.MemoryInUse() > 1<<16 {
+		t.Errorf("%d bytes in use after the failed allocation, over the limit", m.MemoryInUse())
+	}
+	// left before the ADD, so with twice the memory it doubles once more
+	ip, steps := m.IP(), m.Steps()
+	m.Limits.MaxMemory = 1 << 17
+	if err := m.Run(); !errors.Is(err, ErrOutOfMemory) || m.IP() != ip || m.Steps() <= steps {
+		t.Errorf("after raising the limit: %v at %d, want ErrOutOfMemory at %d again", err, m.IP(), ip)
+	}
+}
+
+// The failing allocation is not made, so raising the limit lets the
+// program carry on.
+func TestMaxMemoryRaised(t *testing.T) {
+	m := loadLimited(t, "let c = chan(\"int\", 100000);\nprint(1);\n", 1<<16)
+	var out strings.Builder
+	m.Stdout = &out
+	if err := m.Run(); !errors.Is(err, ErrOutOfMemory) {
+		t.Fatalf("got %v, want ErrOutOfMemory", err)
+	}
+	m.Limits.MaxMemory = 0
+	if err := m.Run(); err != nil || out.String() != "1\n" {
+		t.Errorf("after raising the limit: %v, output %q", err, out.String())
+	}
+}
+
+// Only live values count: strings that were dropped are not charged once
+// the memory is measured.
+func TestMaxMemoryGarbage(t *testing.T) {
+	src := "let s = \"" + strings.Repeat("x", 1000) + "\";\nfunc f() { let t = s + s; return 0; }\n" +
+		strings.Repeat("f();\n", 100)
+	m := loadLimited(t, src, 1<<14)
+	if err := m.Run(); err != nil {
+		t.Errorf("200000 bytes allocated, little of it live: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package vm
+
+import "encoding/binary"
+
+/* ---------- Variable names ---------- */
+
+// The name table is debug info like the line table: what the program's
+// global slots and each code object's locals were called in the source.
+// It is optional and nothing but the debugger reads it.
+
+// hasNames reports whether p has anything for the name table.
+func (p *Program) hasNames() bool {
+	if len(p.GlobalNames) > 0 {
+		return true
+	}
+	for _, co := range p.Funcs {
+		if len(co.Locals) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// GlobalName returns the source name of global slot i, or "".
+func (p *Program) GlobalName(i int) string {
+	if i < len(p.GlobalNames) {
+		return p.GlobalNames[i]
+	}
+	return ""
+}
+
+// LocalName returns the source name of local slot i of co, or "".
+func (co *CodeObject) LocalName(i int) string {
+	if i < len(co.Locals) {
+		return co.Locals[i]
+	}
+	return ""
+}
+
+// Name table section: uvarint count and the global names by slot, then
+// uvarint code object count and per code object a uvarint count and the
+// names of its locals by slot. Unnamed slots are "".
+func encodeNames(p *Program) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(p.GlobalNames)))
+	for _, name := range p.GlobalNames {
+		b = appendString(b, name)
+	}
+	b = binary.AppendUvarint(b, uint64(len(p.Funcs)))
+	for _, co := range p.Funcs {
+		b = binary.AppendUvarint(b, uint64(len(co.Locals)))
+		for _, name := range co.Locals {
+			b = appendString(b, name)
+		}
+	}
+	return b
+}
+
+// decodeNames reads the name table into p, whose code object table must
+// already be decoded.
+func decodeNames(data []byte, p *Program) error {
+	r := &byteReader{what: "name table", data: data}
+	names := func(max int, what string) ([]string, error) {
+		n, err := r.count()
+		if err != nil {
+			return nil, err
+		}
+		if n > max {
+			return nil, r.errorf("%d names for %d %s", n, max, what)
+		}
+		out := make([]string, n)
+		for i := range out {
+			if out[i], err = r.string(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	var err error
+	if p.GlobalNames, err = names(p.Globals, "globals"); err != nil {
+		return err
+	}
+	n, err := r.count()
+	if err != nil {
+		return err
+	}
+	if n != len(p.Funcs) {
+		return r.errorf("names for %d code objects, the program has %d", n, len(p.Funcs))
+	}
+	for i := range p.Funcs {
+		co := &p.Funcs[i]
+		if co.Locals, err = names(co.NumLocals, co.Name+" locals"); err != nil {
+			return err
+		}
+	}
+	return r.done()
+}
@@ -0,0 +1,302 @@
+package vm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+)
+
+/* ---------- Opcodes ---------- */
+
+const (
+	OpHalt       byte = iota
+	OpLoadConst       // operand: u16 const index
+	OpStoreLocal      // operand: u16 frame local index
+	OpLoadLocal       // operand: u16 frame local index
+	OpAdd             // pop a,b push a+b
+	OpSub
+	OpMul
+	OpDiv
+	OpCallBuiltin // operand: u8 builtin id, operand: u8 argc
+	OpPop
+	OpJump        // operand: u16 addr
+	OpJumpIfFalse // operand: u16 addr
+	OpWide        // prefix: the next instruction's u16 operands are u32
+	OpStoreGlobal // operand: u16 global index
+	OpLoadGlobal  // operand: u16 global index
+	OpCall        // operand: u16 code object index, operand: u8 argc
+	OpReturn      // pop the result, drop the frame, push the result for the caller
+	OpSpawn       // operand: u16 code object index, operand: u8 argc; runs the call in a new fiber
+	OpMod         // pop a,b push a%b
+	OpBitAnd      // pop a,b push a&b, ints only
+	OpBitOr
+	OpBitXor
+	OpBitNot // pop a push ^a, ints only
+	OpShl    // pop a,b push a<<b, the count is taken mod 64
+	OpShr    // arithmetic shift right
+	OpUshr   // logical shift right
+)
+
+// OperandKind says how an inline operand is encoded and what it refers to.
+type OperandKind int
+
+const (
+	OperandConst   OperandKind = iota // u16 constant pool index
+	OperandLocal                      // u16 slot in the current frame
+	OperandAddr                       // u16 absolute code address
+	OperandArgc                       // u8 argument count
+	OperandGlobal                     // u16 global slot
+	OperandFunc                       // u16 code object index
+	OperandBuiltin                    // u8 index into the builtin import table
+)
+
+// Size is the encoded size of the operand, without an OpWide prefix.
+func (k OperandKind) Size() int {
+	if k == OperandArgc || k == OperandBuiltin {
+		return 1
+	}
+	return 2
+}
+
+// WideSize is the encoded size of the operand after an OpWide prefix. Only
+// the u16 operands widen.
+func (k OperandKind) WideSize() int {
+	if k == OperandArgc || k == OperandBuiltin {
+		return 1
+	}
+	return 4
+}
+
+func (k OperandKind) size(wide bool) int {
+	if wide {
+		return k.WideSize()
+	}
+	return k.Size()
+}
+
+// OpInfo describes an opcode for tools: the disassembler, the assembler,
+// the verifier and the linker all work from this table.
+type OpInfo struct {
+	Name     string
+	Operands []OperandKind
+}
+
+var opInfo = map[byte]OpInfo{
+	OpHalt:        {"HALT", nil},
+	OpLoadConst:   {"LOAD_CONST", []OperandKind{OperandConst}},
+	OpStoreLocal:  {"STORE_LOCAL", []OperandKind{OperandLocal}},
+	OpLoadLocal:   {"LOAD_LOCAL", []OperandKind{OperandLocal}},
+	OpAdd:         {"ADD", nil},
+	OpSub:         {"SUB", nil},
+	OpMul:         {"MUL", nil},
+	OpDiv:         {"DIV", nil},
+	OpCallBuiltin: {"CALL_BUILTIN", []OperandKind{OperandBuiltin, OperandArgc}},
+	OpPop:         {"POP", nil},
+	OpJump:        {"JUMP", []OperandKind{OperandAddr}},
+	OpJumpIfFalse: {"JUMP_IF_FALSE", []OperandKind{OperandAddr}},
+	OpWide:        {"WIDE", nil},
+	OpStoreGlobal: {"STORE_GLOBAL", []OperandKind{OperandGlobal}},
+	OpLoadGlobal:  {"LOAD_GLOBAL", []OperandKind{OperandGlobal}},
+	OpCall:        {"CALL", []OperandKind{OperandFunc, OperandArgc}},
+	OpReturn:      {"RETURN", nil},
+	OpSpawn:       {"SPAWN", []OperandKind{OperandFunc, OperandArgc}},
+	OpMod:         {"MOD", nil},
+	OpBitAnd:      {"BIT_AND", nil},
+	OpBitOr:       {"BIT_OR", nil},
+	OpBitXor:      {"BIT_XOR", nil},
+	OpBitNot:      {"BIT_NOT", nil},
+	OpShl:         {"SHL", nil},
+	OpShr:         {"SHR", nil},
+	OpUshr:        {"USHR", nil},
+}
+
+// LookupOp returns the opcode metadata for op.
+func LookupOp(op byte) (OpInfo, bool) {
+	info, ok := opInfo[op]
+	return info, ok
+}
+
+// OpByName finds an opcode by mnemonic. Case and underscores are ignored,
+// so LOAD_CONST, LoadConst and loadconst are the same.
+func OpByName(name string) (byte, bool) {
+	norm := func(s string) string { return strings.ToLower(strings.ReplaceAll(s, "_", "")) }
+	for op, info := range opInfo {
+		if norm(info.Name) == norm(name) {
+			return op, true
+		}
+	}
+	return 0, false
+}
+
+func OpName(op byte) string {
+	if info, ok := opInfo[op]; ok {
+		return info.Name
+	}
+	return fmt.Sprintf("OP_%d", op)
+}
+
+// Instr is one decoded instruction. A WIDE prefix is folded into the
+// instruction it modifies: Op is the modified opcode, Wide is set and Size
+// counts the prefix byte.
+type Instr struct {
+	Addr int
+	Op   byte
+	Args []int
+	Size int
+	Wide bool
+}
+
+// OperandOffsets returns the code offset of each of in's operands.
+func (in Instr) OperandOffsets() []int {
+	at := in.Addr + 1
+	if in.Wide {
+		at++
+	}
+	kinds := opInfo[in.Op].Operands
+	offs := make([]int, len(kinds))
+	for i, k := range kinds {
+		offs[i] = at
+		at += k.size(in.Wide)
+	}
+	return offs
+}
+
+// DecodeInstr decodes the instruction starting at code[addr].
+func DecodeInstr(code []byte, addr int) (Instr, error) {
+	if addr < 0 || addr >= len(code) {
+		return Instr{}, fmt.Errorf("address %d out of range", addr)
+	}
+	in := Instr{Addr: addr, Size: 1}
+	op := code[addr]
+	if op == OpWide {
+		if addr+1 >= len(code) {
+			return Instr{}, fmt.Errorf("WIDE at %d has no instruction", addr)
+		}
+		in.Wide = true
+		in.Size++
+		op = code[addr+1]
+		if op == OpWide || !hasWideOperand(op) {
+			return Instr{}, fmt.Errorf("WIDE at %d cannot prefix %s", addr, OpName(op))
+		}
+	}
+	info, ok := opInfo[op]
+	if !ok {
+		return Instr{}, fmt.Errorf("unknown opcode %d at %d", op, addr)
+	}
+	in.Op = op
+	for _, k := range info.Operands {
+		at := addr + in.Size
+		size := k.size(in.Wide)
+		if at+size > len(code) {
+			return Instr{}, fmt.Errorf("truncated %s operand at %d", info.Name, addr)
+		}
+		switch size {
+		case 1:
+			in.Args = append(in.Args, int(code[at]))
+		case 2:
+			in.Args = append(in.Args, int(binary.LittleEndian.Uint16(code[at:])))
+		default:
+			in.Args = append(in.Args, int(binary.LittleEndian.Uint32(code[at:])))
+		}
+		in.Size += size
+	}
+	return in, nil
+}
+
+// DecodeCode decodes a whole code section.
+func DecodeCode(code []byte) ([]Instr, error) {
+	var out []Instr
+	for addr := 0; addr < len(code); {
+		in, err := DecodeInstr(code, addr)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, in)
+		addr += in.Size
+	}
+	return out, nil
+}
+
+// hasWideOperand reports whether op has an operand WIDE can widen.
+func hasWideOperand(op byte) bool {
+	for _, k := range opInfo[op].Operands {
+		if k.WideSize() != k.Size() {
+			return true
+		}
+	}
+	return false
+}
+
+// needsWide reports whether any of args is too big for its narrow encoding.
+func needsWide(info OpInfo, args []int) bool {
+	for i, k := range info.Operands {
+		if i < len(args) && k.WideSize() != k.Size() && args[i] > math.MaxUint16 {
+			return true
+		}
+	}
+	return false
+}
+
+// EncodeInstr appends the encoding of op with args to code. A WIDE prefix
+// is added when an operand does not fit in u16; an operand that does not
+// fit even then is an error, never truncated.
+func EncodeInstr(code []byte, op byte, args ...int) ([]byte, error) {
+	info, ok := opInfo[op]
+	if !ok {
+		return nil, fmt.Errorf("unknown opcode %d", op)
+	}
+	return encodeInstr(code, op, needsWide(info, args), args)
+}
+
+// EncodeWideInstr is EncodeInstr with the WIDE prefix forced.
+func EncodeWideInstr(code []byte, op byte, args ...int) ([]byte, error) {
+	if !hasWideOperand(op) {
+		return nil, fmt.Errorf("WIDE cannot prefix %s", OpName(op))
+	}
+	return encodeInstr(code, op, true, args)
+}
+
+func encodeInstr(code []byte, op byte, wide bool, args []int) ([]byte, error) {
+	info, ok := opInfo[op]
+	if !ok || op == OpWide {
+		return nil, fmt.Errorf("unknown opcode %d", op)
+	}
+	if len(args) != len(info.Operands) {
+		return nil, fmt.Errorf("%s takes %d operand(s), got %d", info.Name, len(info.Operands), len(args))
+	}
+	if wide {
+		code = append(code, OpWide)
+	}
+	code = append(code, op)
+	for i, k := range info.Operands {
+		size := k.size(wide)
+		max := 1<<(8*size) - 1
+		if args[i] < 0 || args[i] > max {
+			return nil, fmt.Errorf("%s operand %d out of range 0..%d", info.Name, args[i], max)
+		}
+		switch size {
+		case 1:
+			code = append(code, byte(args[i]))
+		case 2:
+			code = binary.LittleEndian.AppendUint16(code, uint16(args[i]))
+		default:
+			code = binary.LittleEndian.AppendUint32(code, uint32(args[i]))
+		}
+	}
+	return code, nil
+}
+
+// InstrSize is the encoded size of op with args, including any WIDE prefix.
+func InstrSize(op byte, args ...int) int {
+	info := opInfo[op]
+	wide := needsWide(info, args)
+	size := 1
+	if wide {
+		size++
+	}
+	for _, k := range info.Operands {
+		size += k.size(wide)
+	}
+	return size
+}
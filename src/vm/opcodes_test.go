@@ -0,0 +1,184 @@
+package vm
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestEncodeWideOperands(t *testing.T) {
+	tests := []struct {
+		op   byte
+		args []int
+		wide bool
+		size int
+	}{
+		{OpLoadConst, []int{0}, false, 3},
+		{OpLoadConst, []int{math.MaxUint16}, false, 3},
+		{OpLoadConst, []int{math.MaxUint16 + 1}, true, 6},
+		{OpJump, []int{70000}, true, 6},
+		{OpStoreGlobal, []int{math.MaxUint32}, true, 6},
+		// the argument count is a u8 and is never widened
+		{OpCall, []int{70000, 3}, true, 7},
+		{OpCallBuiltin, []int{1, 2}, false, 3},
+	}
+	for _, tt := range tests {
+		code, err := EncodeInstr(nil, tt.op, tt.args...)
+		if err != nil {
+			t.Errorf("%s %v: %v", OpName(tt.op), tt.args, err)
+			continue
+		}
+		if len(code) != tt.size || len(code) != InstrSize(tt.op, tt.args...) {
+			t.Errorf("%s %v is %d bytes, InstrSize says %d, want %d", OpName(tt.op), tt.args, len(code), InstrSize(tt.op, tt.args...), tt.size)
+		}
+		in, err := DecodeInstr(code, 0)
+		if err != nil {
+			t.Errorf("%s %v: decode: %v", OpName(tt.op), tt.args, err)
+			continue
+		}
+		if in.Op != tt.op || in.Wide != tt.wide || in.Size != len(code) {
+			t.Errorf("%s %v decoded as %s wide=%v size %d", OpName(tt.op), tt.args, OpName(in.Op), in.Wide, in.Size)
+		}
+		for i := range tt.args {
+			if in.Args[i] != tt.args[i] {
+				t.Errorf("%s %v decoded with operands %v", OpName(tt.op), tt.args, in.Args)
+				break
+			}
+		}
+	}
+}
+
+func TestEncodeOperandOutOfRange(t *testing.T) {
+	if _, err := EncodeInstr(nil, OpLoadConst, math.MaxUint32+1); err == nil {
+		t.Error("a constant index past u32 was encoded")
+	}
+	if _, err := EncodeInstr(nil, OpCall, 1, 256); err == nil {
+		t.Error("an argument count past u8 was encoded")
+	}
+	if _, err := EncodeWideInstr(nil, OpAdd); err == nil {
+		t.Error("WIDE ADD was encoded")
+	}
+}
+
+func TestDecodeBadWide(t *testing.T) {
+	for _, code := range [][]byte{
+		{OpWide},
+		{OpWide, OpWide, OpJump, 0, 0, 0, 0},
+		{OpWide, OpHalt},
+		{OpWide, OpJump, 0, 0},
+	} {
+		if in, err := DecodeInstr(code, 0); err == nil {
+			t.Errorf("% x decoded as %+v", code, in)
+		}
+	}
+}
+
+// checkLayout decodes code laid out from address 0 and checks every jump
+// lands on the instruction the stream said it should, in the narrow form
+// when its target fits one.
+func checkLayout(t *testing.T, stream []linkInstr, code []byte, addrs []int) {
+	t.Helper()
+	if addrs[len(stream)] != len(code) {
+		t.Fatalf("code is %d bytes, addresses end at %d", len(code), addrs[len(stream)])
+	}
+	for k, li := range stream {
+		in, err := DecodeInstr(code, addrs[k])
+		if err != nil {
+			t.Fatalf("instruction %d: %v", k, err)
+		}
+		if in.Op != li.op || addrs[k]+in.Size != addrs[k+1] {
+			t.Fatalf("instruction %d is %s of %d bytes at %d, next at %d", k, OpName(in.Op), in.Size, addrs[k], addrs[k+1])
+		}
+		if li.op != OpJump {
+			continue
+		}
+		if want := addrs[li.args[0]]; in.Args[0] != want || in.Wide != (want > math.MaxUint16) {
+			t.Errorf("jump %d goes to %d with wide=%v, want %d", k, in.Args[0], in.Wide, want)
+		}
+	}
+}
+
+func jumpTo(k int) linkInstr {
+	return linkInstr{op: OpJump, args: []int{k}, target: []bool{true}}
+}
+
+// Widening a jump moves everything after it, which can push another
+// jump's target past u16 in turn; layout must keep going until no size
+// changes.
+func TestLayoutWidensJumps(t *testing.T) {
+	const pad = math.MaxUint16 - 7 // POPs between the jumps and the near target
+	var stream []linkInstr
+	stream = append(stream, jumpTo(-1), jumpTo(2+pad))
+	for i := 0; i < pad; i++ {
+		stream = append(stream, linkInstr{op: OpPop})
+	}
+	stream = append(stream, linkInstr{op: OpPop}) // the near target
+	for i := 0; i < 10; i++ {
+		stream = append(stream, linkInstr{op: OpPop})
+	}
+	stream = append(stream, jumpTo(0), linkInstr{op: OpHalt})
+	stream[0].args[0] = len(stream) - 1
+
+	code, addrs, err := layout(0, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLayout(t, stream, code, addrs)
+	// with both jumps narrow the near target is at 65534; widening the far
+	// jump takes it to 65537, so the near jump widens too
+	if near := addrs[2+pad]; near != math.MaxUint16+5 {
+		t.Errorf("near target at %d, want %d", near, math.MaxUint16+5)
+	}
+	if code[0] != OpWide || code[6] != OpWide {
+		t.Error("the first two jumps are not both WIDE")
+	}
+	if back := addrs[len(stream)-2]; code[back] != OpJump {
+		t.Error("the jump back to 0 was widened")
+	}
+}
+
+func TestLayoutFromBase(t *testing.T) {
+	stream := []linkInstr{jumpTo(2), {op: OpPop}, {op: OpHalt}}
+	code, addrs, err := layout(math.MaxUint16, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs[0] != math.MaxUint16 || addrs[2] != math.MaxUint16+7 {
+		t.Errorf("addresses %v", addrs)
+	}
+	if in, _ := DecodeInstr(code, 0); !in.Wide || in.Args[0] != addrs[2] {
+		t.Errorf("jump decoded as %+v, want a WIDE jump to %d", in, addrs[2])
+	}
+}
+
+// A program with more than 65536 globals runs, with WIDE operands for the
+// high slots, and its listing reassembles to the same code.
+func TestRunWideGlobals(t *testing.T) {
+	p := assemble(t, `
+.const
+    v: "far"
+.code
+    LOAD_CONST v
+    STORE_GLOBAL 70000
+    LOAD_GLOBAL 70000
+    CALL_BUILTIN print 1
+    POP
+    WIDE LOAD_CONST v
+    CALL_BUILTIN print 1
+    POP
+    HALT
+`)
+	if p.Globals != 70001 {
+		t.Errorf("%d globals, want 70001", p.Globals)
+	}
+	if got := runProgram(t, p); got != "far\nfar\n" {
+		t.Errorf("output %q", got)
+	}
+	var listing bytes.Buffer
+	if err := Disassemble(&listing, p); err != nil {
+		t.Fatal(err)
+	}
+	if again := assemble(t, listing.String()); !bytes.Equal(again.Code, p.Code) {
+		t.Errorf("listing reassembles to different code:\n%s", listing.String())
+	}
+}
@@ -0,0 +1,213 @@
+package vm
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+/* ---------- pprof output ---------- */
+
+// protoBuf encodes protocol buffer fields. The profile format is small and
+// stable enough that it is written by hand rather than with a protobuf
+// library.
+type protoBuf struct {
+	b []byte
+}
+
+func (pb *protoBuf) tag(field, wire int) {
+	pb.b = binary.AppendUvarint(pb.b, uint64(field<<3|wire))
+}
+
+func (pb *protoBuf) uint64(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	pb.tag(field, 0)
+	pb.b = binary.AppendUvarint(pb.b, x)
+}
+
+func (pb *protoBuf) int64(field int, x int64) { pb.uint64(field, uint64(x)) }
+
+func (pb *protoBuf) bytes(field int, b []byte) {
+	pb.tag(field, 2)
+	pb.b = binary.AppendUvarint(pb.b, uint64(len(b)))
+	pb.b = append(pb.b, b...)
+}
+
+func (pb *protoBuf) packed(field int, xs []uint64) {
+	var inner []byte
+	for _, x := range xs {
+		inner = binary.AppendUvarint(inner, x)
+	}
+	pb.bytes(field, inner)
+}
+
+func (pb *protoBuf) msg(field int, f func(*protoBuf)) {
+	var inner protoBuf
+	f(&inner)
+	pb.bytes(field, inner.b)
+}
+
+// Field numbers from github.com/google/pprof/proto/profile.proto.
+const (
+	profSampleType    = 1
+	profSample        = 2
+	profLocation      = 4
+	profFunction      = 5
+	profStringTable   = 6
+	profTimeNanos     = 9
+	profDurationNanos = 10
+	profPeriodType    = 11
+	profPeriod        = 12
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID      = 1
+	locationAddress = 3
+	locationLine    = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+	functionStartLine  = 5
+)
+
+// WritePprof writes the stack samples as a gzipped pprof profile, for
+// `go tool pprof`. Each Quark code object is a function and each sampled
+// address a location, with its source line from prog's line table.
+func (p *Profile) WritePprof(w io.Writer, prog *Program) error {
+	strs := []string{""}
+	strIdx := map[string]int64{"": 0}
+	str := func(s string) int64 {
+		i, ok := strIdx[s]
+		if !ok {
+			i = int64(len(strs))
+			strs = append(strs, s)
+			strIdx[s] = i
+		}
+		return i
+	}
+	valueType := func(typ, unit string) func(*protoBuf) {
+		return func(pb *protoBuf) {
+			pb.int64(valueTypeType, str(typ))
+			pb.int64(valueTypeUnit, str(unit))
+		}
+	}
+
+	var out protoBuf
+	out.msg(profSampleType, valueType("samples", "count"))
+	out.msg(profSampleType, valueType("instructions", "count"))
+
+	keys := make([]string, 0, len(p.samples))
+	for k := range p.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	locs := map[int]uint64{} // address -> location id
+	var addrs []int
+	for _, k := range keys {
+		s := p.samples[k]
+		ids := make([]uint64, len(s.addrs))
+		for i, addr := range s.addrs {
+			id, ok := locs[addr]
+			if !ok {
+				id = uint64(len(locs) + 1)
+				locs[addr] = id
+				addrs = append(addrs, addr)
+			}
+			ids[i] = id
+		}
+		out.msg(profSample, func(pb *protoBuf) {
+			pb.packed(sampleLocationID, ids)
+			pb.packed(sampleValue, []uint64{uint64(s.count), uint64(s.count * p.sampleEvery())})
+		})
+	}
+
+	funcs := map[*CodeObject]uint64{}
+	var funcOrder []*CodeObject
+	for _, addr := range addrs {
+		co := prog.FuncAt(addr)
+		var fid uint64
+		if co != nil {
+			if fid = funcs[co]; fid == 0 {
+				fid = uint64(len(funcs) + 1)
+				funcs[co] = fid
+				funcOrder = append(funcOrder, co)
+			}
+		}
+		_, line, _ := prog.LineAt(addr)
+		out.msg(profLocation, func(pb *protoBuf) {
+			pb.uint64(locationID, locs[addr])
+			pb.uint64(locationAddress, uint64(addr))
+			if fid != 0 {
+				pb.msg(locationLine, func(pb *protoBuf) {
+					pb.uint64(lineFunctionID, fid)
+					pb.int64(lineLine, int64(line))
+				})
+			}
+		})
+	}
+	for _, co := range funcOrder {
+		file, line, _ := prog.LineAt(co.Entry)
+		out.msg(profFunction, func(pb *protoBuf) {
+			pb.uint64(functionID, funcs[co])
+			pb.int64(functionName, str(pprofName(co)))
+			pb.int64(functionSystemName, str(pprofName(co)))
+			pb.int64(functionFilename, str(file))
+			pb.int64(functionStartLine, int64(line))
+		})
+	}
+
+	if !p.start.IsZero() {
+		out.int64(profTimeNanos, p.start.UnixNano())
+	}
+	out.int64(profDurationNanos, p.elapsed.Nanoseconds())
+	out.msg(profPeriodType, valueType("instructions", "count"))
+	out.int64(profPeriod, p.sampleEvery())
+	// the string table goes last, once every string has been interned
+	for _, s := range strs {
+		out.bytes(profStringTable, []byte(s))
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(out.b); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// pprofName is the name pprof shows for a code object. Module initialisers
+// are named like Go's package initialisers, main.init for the linked
+// program's, since pprof cannot show names such as <main>.
+func pprofName(co *CodeObject) string {
+	if co.Kind != CodeModule {
+		return co.Name
+	}
+	name := "main"
+	if co.Name != "<main>" {
+		base := path.Base(co.Name)
+		name = strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+				return r
+			}
+			return '_'
+		}, strings.TrimSuffix(base, path.Ext(base)))
+		if name == "" {
+			name = "main"
+		}
+	}
+	return name + ".init"
+}
@@ -0,0 +1,224 @@
+package vm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// pbField is one field of an encoded protocol buffer message: v for a
+// varint, b for a length delimited field.
+type pbField struct {
+	num int
+	v   uint64
+	b   []byte
+}
+
+// pbFields splits a message into its fields, for the varint and length
+// delimited wire types WritePprof uses.
+func pbFields(t *testing.T, b []byte) []pbField {
+	t.Helper()
+	var fields []pbField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad tag at % x", b)
+		}
+		b = b[n:]
+		f := pbField{num: int(tag >> 3)}
+		x, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad varint in field %d", f.num)
+		}
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			f.v = x
+		case 2:
+			if x > uint64(len(b)) {
+				t.Fatalf("field %d runs past the message", f.num)
+			}
+			f.b, b = b[:x], b[x:]
+		default:
+			t.Fatalf("field %d has wire type %d", f.num, tag&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// pbPacked decodes a packed repeated varint field.
+func pbPacked(t *testing.T, b []byte) []uint64 {
+	t.Helper()
+	var xs []uint64
+	for len(b) > 0 {
+		x, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad packed varint % x", b)
+		}
+		xs, b = append(xs, x), b[n:]
+	}
+	return xs
+}
+
+func TestWritePprof(t *testing.T) {
+	p, err := Link([]Object{compileObject(t, "t.quark", `func sq(x) {
+    return x * x;
+}
+print(sq(3));
+`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewVM()
+	m.Stdout = io.Discard
+	m.Profile = NewProfile()
+	m.Profile.SampleEvery = 1
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	m.Profile.Stop()
+	var buf bytes.Buffer
+	if err := m.Profile.WritePprof(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type line struct{ fn, line uint64 }
+	var strs []string
+	var samples [][2][]uint64 // location ids and values
+	locs := map[uint64]line{}
+	funcs := map[uint64][2]uint64{} // id -> name and file string indexes
+	var sampleTypes []uint64
+	for _, f := range pbFields(t, data) {
+		switch f.num {
+		case profStringTable:
+			strs = append(strs, string(f.b))
+		case profSampleType:
+			for _, g := range pbFields(t, f.b) {
+				if g.num == valueTypeType {
+					sampleTypes = append(sampleTypes, g.v)
+				}
+			}
+		case profSample:
+			var s [2][]uint64
+			for _, g := range pbFields(t, f.b) {
+				switch g.num {
+				case sampleLocationID:
+					s[0] = pbPacked(t, g.b)
+				case sampleValue:
+					s[1] = pbPacked(t, g.b)
+				}
+			}
+			samples = append(samples, s)
+		case profLocation:
+			var id uint64
+			var l line
+			for _, g := range pbFields(t, f.b) {
+				switch g.num {
+				case locationID:
+					id = g.v
+				case locationLine:
+					for _, h := range pbFields(t, g.b) {
+						switch h.num {
+						case lineFunctionID:
+							l.fn = h.v
+						case lineLine:
+							l.line = h.v
+						}
+					}
+				}
+			}
+			locs[id] = l
+		case profFunction:
+			var id uint64
+			var fn [2]uint64
+			for _, g := range pbFields(t, f.b) {
+				switch g.num {
+				case functionID:
+					id = g.v
+				case functionName:
+					fn[0] = g.v
+				case functionFilename:
+					fn[1] = g.v
+				}
+			}
+			funcs[id] = fn
+		}
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("string table %q does not start with the empty string", strs)
+	}
+	str := func(i uint64) string {
+		if i >= uint64(len(strs)) {
+			t.Fatalf("string index %d out of range", i)
+		}
+		return strs[i]
+	}
+	if len(sampleTypes) != 2 || str(sampleTypes[0]) != "samples" || str(sampleTypes[1]) != "instructions" {
+		t.Errorf("sample types %v", sampleTypes)
+	}
+
+	// with a sample every instruction, every instruction is in a sample
+	// and each stack reads back as function:line frames
+	total := uint64(0)
+	stacks := map[string]bool{}
+	for _, s := range samples {
+		if len(s[1]) != 2 || s[1][0] != s[1][1] {
+			t.Errorf("sample values %v, want a count and as many instructions", s[1])
+		}
+		total += s[1][0]
+		var frames []string
+		for _, id := range s[0] {
+			l, ok := locs[id]
+			fn, fok := funcs[l.fn]
+			if !ok || !fok {
+				t.Fatalf("sample has unknown location %d", id)
+			}
+			if file := str(fn[1]); file != "t.quark" {
+				t.Errorf("%s is in file %q", str(fn[0]), file)
+			}
+			frames = append(frames, fmt.Sprintf("%s:%d", str(fn[0]), l.line))
+		}
+		stacks[strings.Join(frames, " ")] = true
+	}
+	if total != uint64(m.Profile.Total) || total != uint64(m.Steps()) {
+		t.Errorf("samples count %d instructions, the run took %d", total, m.Steps())
+	}
+	for _, want := range []string{"main.init:4", "sq:2 main.init:4"} {
+		if !stacks[want] {
+			t.Errorf("no sample of %s in %v", want, stacks)
+		}
+	}
+}
+
+func TestPprofName(t *testing.T) {
+	tests := []struct {
+		co   CodeObject
+		want string
+	}{
+		{CodeObject{Name: "<main>", Kind: CodeModule}, "main.init"},
+		{CodeObject{Name: "lib/my-util.quark", Kind: CodeModule}, "my_util.init"},
+		{CodeObject{Name: ".quark", Kind: CodeModule}, "main.init"},
+		{CodeObject{Name: "sq", Kind: CodeFunc}, "sq"},
+	}
+	for _, tt := range tests {
+		if got := pprofName(&tt.co); got != tt.want {
+			t.Errorf("pprofName(%s) = %s, want %s", tt.co.Name, got, tt.want)
+		}
+	}
+}
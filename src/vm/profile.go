@@ -0,0 +1,189 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/* ---------- Profiler ---------- */
+
+// DefaultSampleEvery is the stack sampling interval used when
+// Profile.SampleEvery is 0.
+const DefaultSampleEvery = 100
+
+// maxSampleDepth bounds the frames kept per stack sample, so sampling
+// deep recursion stays cheap. The outermost frames are dropped.
+const maxSampleDepth = 64
+
+// Profile collects execution counts while a program runs. Every
+// instruction is counted by opcode and by source line; every SampleEvery
+// instructions the running fiber's call stack is sampled, for the pprof
+// output. Set VM.Profile to a NewProfile to turn it on.
+type Profile struct {
+	SampleEvery int64
+
+	Ops     [256]int64        // instructions executed, by opcode
+	Lines   map[SrcLine]int64 // instructions executed, by source line
+	Total   int64             // instructions executed
+	samples map[string]*stackSample
+	start   time.Time
+	elapsed time.Duration
+}
+
+// SrcLine is a line of source code.
+type SrcLine struct {
+	File string
+	Line int
+}
+
+func (l SrcLine) String() string {
+	if l.File == "" {
+		return "(no line)"
+	}
+	return fmt.Sprintf("%s:%d", l.File, l.Line)
+}
+
+// stackSample is a call stack seen by the profiler, innermost address
+// first, and how many samples saw it.
+type stackSample struct {
+	addrs []int
+	count int64
+}
+
+func NewProfile() *Profile {
+	return &Profile{Lines: map[SrcLine]int64{}, samples: map[string]*stackSample{}}
+}
+
+func (p *Profile) sampleEvery() int64 {
+	if p.SampleEvery > 0 {
+		return p.SampleEvery
+	}
+	return DefaultSampleEvery
+}
+
+// record counts the instruction about to run at addr.
+func (p *Profile) record(m *VM, addr int) {
+	if p.start.IsZero() {
+		p.start = time.Now()
+	}
+	code := m.prog.Code
+	op := code[addr]
+	if op == OpWide && addr+1 < len(code) {
+		op = code[addr+1]
+	}
+	p.Ops[op]++
+	file, line, _ := m.prog.LineAt(addr)
+	p.Lines[SrcLine{file, line}]++
+	p.Total++
+	if p.Total%p.sampleEvery() != 0 {
+		return
+	}
+	addrs := make([]int, 0, min(len(m.frames), maxSampleDepth))
+	var key strings.Builder
+	for i := len(m.frames) - 1; i >= 0 && len(addrs) < maxSampleDepth; i-- {
+		addrs = append(addrs, addr)
+		fmt.Fprintf(&key, "%d,", addr)
+		addr = m.frames[i].ret - 1
+	}
+	s, ok := p.samples[key.String()]
+	if !ok {
+		s = &stackSample{addrs: addrs}
+		p.samples[key.String()] = s
+	}
+	s.count++
+}
+
+// Stop ends the wall-clock measurement of the run.
+func (p *Profile) Stop() {
+	if !p.start.IsZero() && p.elapsed == 0 {
+		p.elapsed = time.Since(p.start)
+	}
+}
+
+// funcCounts sums the stack samples by code object: flat counts samples
+// where it was running, cum those where it was anywhere on the stack.
+func (p *Profile) funcCounts(prog *Program) (flat, cum map[*CodeObject]int64) {
+	flat, cum = map[*CodeObject]int64{}, map[*CodeObject]int64{}
+	for _, s := range p.samples {
+		seen := map[*CodeObject]bool{}
+		for i, addr := range s.addrs {
+			co := prog.FuncAt(addr)
+			if co == nil {
+				continue
+			}
+			if i == 0 {
+				flat[co] += s.count
+			}
+			if !seen[co] {
+				seen[co] = true
+				cum[co] += s.count
+			}
+		}
+	}
+	return flat, cum
+}
+
+// WriteSummary writes the hottest opcodes, source lines and functions of
+// prog as text tables.
+func (p *Profile) WriteSummary(w io.Writer, prog *Program, top int) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	pct := func(n, of int64) string {
+		if of == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(of))
+	}
+	fmt.Fprintf(tw, "%d instructions in %v\n", p.Total, p.elapsed.Round(time.Microsecond))
+
+	fmt.Fprintf(tw, "\ncount\t%%\topcode\t\n")
+	var ops []int
+	for op, n := range p.Ops {
+		if n > 0 {
+			ops = append(ops, op)
+		}
+	}
+	sort.SliceStable(ops, func(a, b int) bool { return p.Ops[ops[a]] > p.Ops[ops[b]] })
+	for _, op := range ops[:min(top, len(ops))] {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t\n", p.Ops[op], pct(p.Ops[op], p.Total), OpName(byte(op)))
+	}
+
+	fmt.Fprintf(tw, "\ncount\t%%\tline\t\n")
+	lines := make([]SrcLine, 0, len(p.Lines))
+	for l := range p.Lines {
+		lines = append(lines, l)
+	}
+	sort.Slice(lines, func(a, b int) bool {
+		if p.Lines[lines[a]] != p.Lines[lines[b]] {
+			return p.Lines[lines[a]] > p.Lines[lines[b]]
+		}
+		return lines[a].String() < lines[b].String()
+	})
+	for _, l := range lines[:min(top, len(lines))] {
+		fmt.Fprintf(tw, "%d\t%s\t%v\t\n", p.Lines[l], pct(p.Lines[l], p.Total), l)
+	}
+
+	flat, cum := p.funcCounts(prog)
+	var samples int64
+	for _, s := range p.samples {
+		samples += s.count
+	}
+	fmt.Fprintf(tw, "\nflat\tflat%%\tcum\tcum%%\tfunction\t\n")
+	funcs := make([]*CodeObject, 0, len(cum))
+	for co := range cum {
+		funcs = append(funcs, co)
+	}
+	sort.Slice(funcs, func(a, b int) bool {
+		if flat[funcs[a]] != flat[funcs[b]] {
+			return flat[funcs[a]] > flat[funcs[b]]
+		}
+		return funcs[a].Entry < funcs[b].Entry
+	})
+	for _, co := range funcs[:min(top, len(funcs))] {
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%s\t\n", flat[co], pct(flat[co], samples), cum[co], pct(cum[co], samples), co.Name)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,350 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+
+	"quark/parser"
+)
+
+/* ---------- Sessions ---------- */
+
+// Session compiles and runs a program a piece at a time, for `quark repl`.
+// Each piece is compiled against the names the earlier ones defined and
+// appended to one program, which keeps running in the same VM, so globals
+// and functions live for the whole session. A let of an existing name
+// makes a new variable and a func of an existing name replaces the
+// function for code compiled after it. Fibers spawned by a piece carry on
+// while later pieces run.
+type Session struct {
+	m      *VM
+	c      *Compiler
+	failed bool // the last piece stopped with an error, in its running fiber
+}
+
+// NewSession starts a session in m, which must not have a program loaded.
+func NewSession(m *VM) *Session {
+	return &Session{m: m, c: NewCompiler()}
+}
+
+// VM is the machine the session runs in.
+func (s *Session) VM() *VM { return s.m }
+
+// Eval compiles and runs a piece of source. When its last statement is an
+// expression, the expression's value is returned with ok set. A piece that
+// does not compile leaves the session as it was; one that fails while
+// running keeps what it defined before the error.
+func (s *Session) Eval(ctx context.Context, f *parser.File) (v Value, ok bool, err error) {
+	saved := s.c.checkpoint()
+	k, ok, err := s.c.compilePiece(f)
+	if err != nil {
+		s.c.rollback(saved)
+		return nil, false, err
+	}
+	if err := s.run(ctx, k, saved); err != nil {
+		return nil, false, err
+	}
+	if ok {
+		v = s.m.stack[len(s.m.stack)-1]
+	}
+	return v, ok, nil
+}
+
+// Load adds an executable, such as a Gluon's program, to the session and
+// runs its initialiser. Its globals and functions can then be used by name
+// where the program has a name table.
+func (s *Session) Load(ctx context.Context, name string, p *Program) error {
+	if !p.Executable() {
+		return fmt.Errorf("%w: %s is an unlinked object, link it with `quark glue` first", ErrNotBytecode, name)
+	}
+	saved := s.c.checkpoint()
+	k, err := s.c.appendExecutable(name, p)
+	if err != nil {
+		s.c.rollback(saved)
+		return err
+	}
+	return s.run(ctx, k, saved)
+}
+
+// run installs the compiled program and runs piece k's initialiser. The
+// compiler goes back to saved if the program is rejected.
+func (s *Session) run(ctx context.Context, k int, saved checkpoint) error {
+	p := s.c.sessionProgram()
+	var err error
+	if s.m.prog == nil {
+		err = s.m.LoadProgram(p)
+	} else {
+		err = s.m.extend(p, k, s.failed)
+	}
+	if err != nil {
+		s.c.rollback(saved)
+		return err
+	}
+	err = s.m.RunContext(ctx)
+	s.failed = err != nil && !errors.Is(err, ErrCanceled)
+	return err
+}
+
+/* ---------- Incremental compilation ---------- */
+
+// checkpoint is the compiler's state before a piece, to go back to if
+// the piece is rejected. Slices that are only appended to are kept by
+// length; the rest are copied.
+type checkpoint struct {
+	code, consts, codeObjs, builtins, relocs, globalNames int
+	nextGlobal                                            int
+	lines                                                 []LineInfo
+	symbols                                               []Symbol
+	globals, funcs, builtinIdx, symIdx, constIndex        map[string]int
+}
+
+func (c *Compiler) checkpoint() checkpoint {
+	return checkpoint{
+		code: len(c.code), consts: len(c.consts.values), codeObjs: len(c.codeObjs),
+		builtins: len(c.builtins), relocs: len(c.relocs), globalNames: len(c.globalNames),
+		nextGlobal: c.nextGlobal,
+		lines:      append([]LineInfo(nil), c.lines...),
+		symbols:    append([]Symbol(nil), c.symbols...),
+		globals:    maps.Clone(c.globals), funcs: maps.Clone(c.funcs),
+		builtinIdx: maps.Clone(c.builtinIdx), symIdx: maps.Clone(c.symIdx),
+		constIndex: maps.Clone(c.consts.index),
+	}
+}
+
+func (c *Compiler) rollback(m checkpoint) {
+	c.code = c.code[:m.code]
+	c.consts.values = c.consts.values[:m.consts]
+	c.consts.index = m.constIndex
+	c.codeObjs = c.codeObjs[:m.codeObjs]
+	c.builtins = c.builtins[:m.builtins]
+	c.relocs = c.relocs[:m.relocs]
+	c.globalNames = c.globalNames[:m.globalNames]
+	c.nextGlobal = m.nextGlobal
+	c.lines, c.symbols = m.lines, m.symbols
+	c.globals, c.funcs, c.builtinIdx, c.symIdx = m.globals, m.funcs, m.builtinIdx, m.symIdx
+	c.scope = nil
+}
+
+// compilePiece appends f to the session's code: its top level statements
+// as a new module initialiser ending in HALT, then its functions. When the
+// last statement is an expression, its value is left on the stack and
+// value is set. k is the initialiser's code object.
+func (c *Compiler) compilePiece(f *parser.File) (k int, value bool, err error) {
+	c.file = f
+	symbols := len(c.symbols)
+	k = len(c.codeObjs)
+	c.codeObjs = append(c.codeObjs, CodeObject{Name: "<main>", Kind: CodeModule, Entry: len(c.code)})
+	for _, s := range f.Stmts {
+		if fn, ok := s.(*parser.FuncDecl); ok {
+			delete(c.funcs, fn.Name.Name)
+		}
+	}
+	if err := c.declareFuncs(f); err != nil {
+		return 0, false, err
+	}
+	stmts := f.Stmts
+	last, value := lastStmt(stmts).(*parser.ExprStmt)
+	if value {
+		stmts = stmts[:len(stmts)-1]
+	}
+	for _, s := range stmts {
+		if err := c.compileStmt(s); err != nil {
+			return 0, false, err
+		}
+	}
+	if value {
+		c.mark(last)
+		if err := c.compileExpr(last.X); err != nil {
+			return 0, false, err
+		}
+	}
+	c.emit(OpHalt)
+	c.codeObjs[k].Size = len(c.code) - c.codeObjs[k].Entry
+	for _, s := range f.Stmts {
+		if fn, ok := s.(*parser.FuncDecl); ok {
+			if err := c.compileFunc(fn); err != nil {
+				return 0, false, err
+			}
+		}
+	}
+	// there are no other files to find a name in
+	for _, sym := range c.symbols[symbols:] {
+		if sym.Kind == SymUndefined {
+			return 0, false, fmt.Errorf("undefined: %s", sym.Name)
+		}
+	}
+	return k, value, nil
+}
+
+// appendExecutable relocates an executable onto the session's code, as
+// the linker would, with its initialiser as a new piece ending in HALT.
+// Its named globals and its functions become visible by name.
+func (c *Compiler) appendExecutable(name string, p *Program) (int, error) {
+	l := &linker{objs: []Object{{Name: name, Prog: p}}, defs: map[string][]int{}}
+	l.constMap = [][]int{make([]int, len(p.Consts))}
+	for i, v := range p.Consts {
+		l.constMap[0][i] = c.addConst(v)
+	}
+	l.builtinMap = [][]int{make([]int, len(p.Builtins))}
+	for i, b := range p.Builtins {
+		idx, ok := c.builtinIdx[b]
+		if !ok {
+			if len(c.builtins) > 255 {
+				return 0, &LinkError{name, "more than 256 distinct builtins used"}
+			}
+			idx = len(c.builtins)
+			c.builtins = append(c.builtins, b)
+			c.builtinIdx[b] = idx
+		}
+		l.builtinMap[0][i] = idx
+	}
+	l.globalBase = []int{c.nextGlobal}
+	k := len(c.codeObjs)
+	c.codeObjs = append(c.codeObjs, CodeObject{Name: "<main>", Kind: CodeModule})
+	l.funcIndex = [][]int{make([]int, len(p.Funcs))}
+	for i, co := range p.Funcs {
+		if co.Kind == CodeModule {
+			l.funcIndex[0][i] = -1
+			continue
+		}
+		l.funcIndex[0][i] = len(c.codeObjs)
+		c.codeObjs = append(c.codeObjs, CodeObject{Name: co.Name, Kind: co.Kind, Arity: co.Arity, NumLocals: co.NumLocals, Locals: co.Locals})
+	}
+	d, err := decodeObject(p)
+	if err != nil {
+		return 0, &LinkError{name, err.Error()}
+	}
+	for i, co := range p.Funcs {
+		if co.Kind == CodeModule {
+			if _, _, err := l.appendCode(0, i, d.instrs[i], d.relocAt); err != nil {
+				return 0, err
+			}
+		}
+	}
+	l.stream = append(l.stream, linkInstr{op: OpHalt})
+	mainEnd := len(l.stream)
+	spans := make([][2]int, len(p.Funcs))
+	for i, co := range p.Funcs {
+		if co.Kind != CodeModule {
+			start, end, err := l.appendCode(0, i, d.instrs[i], d.relocAt)
+			if err != nil {
+				return 0, err
+			}
+			spans[i] = [2]int{start, end}
+		}
+	}
+	base := len(c.code)
+	code, addrs, err := layout(base, l.stream)
+	if err != nil {
+		return 0, err
+	}
+	c.code = append(c.code, code...)
+	for j, li := range l.stream {
+		c.lines = appendLine(c.lines, addrs[j], li.file, li.line)
+	}
+	c.codeObjs[k].Entry = base
+	c.codeObjs[k].Size = addrs[mainEnd] - base
+	for i, co := range p.Funcs {
+		if co.Kind == CodeModule {
+			continue
+		}
+		fn := &c.codeObjs[l.funcIndex[0][i]]
+		fn.Entry = addrs[spans[i][0]]
+		fn.Size = addrs[spans[i][1]] - fn.Entry
+		c.funcs[co.Name] = l.funcIndex[0][i]
+	}
+	for i := 0; i < p.Globals; i++ {
+		g := p.GlobalName(i)
+		if g != "" {
+			c.globals[g] = c.nextGlobal + i
+		}
+		c.globalNames = append(c.globalNames, g)
+	}
+	c.nextGlobal += p.Globals
+	return k, nil
+}
+
+// sessionProgram is the executable made of every piece so far. Pieces are
+// only ever appended, so code addresses and indices stay valid from one
+// program to the next.
+func (c *Compiler) sessionProgram() *Program {
+	p := &Program{
+		Flags:       FlagExecutable,
+		Code:        c.code,
+		Consts:      c.consts.values,
+		Globals:     c.nextGlobal,
+		Funcs:       c.codeObjs,
+		Builtins:    c.builtins,
+		Lines:       c.lines,
+		GlobalNames: c.globalNames,
+	}
+	fillCodeInfo(p)
+	return p
+}
+
+/* ---------- Growing a loaded program ---------- */
+
+// extend replaces the loaded program with p, which must begin with it,
+// and readies the initialiser k to run in the main fiber. The globals,
+// the other fibers and the channels carry over. With dropCur, the fiber
+// that was running is removed, as it stopped with an error.
+func (m *VM) extend(p *Program, k int, dropCur bool) error {
+	if _, err := Verify(p); err != nil {
+		return err
+	}
+	builtins, err := resolveBuiltins(p)
+	if err != nil {
+		return err
+	}
+	index := make(map[*CodeObject]int, len(m.prog.Funcs))
+	for i := range m.prog.Funcs {
+		index[&m.prog.Funcs[i]] = i
+	}
+	m.prog, m.builtins, m.code = p, builtins, predecode(p)
+	for len(m.globals) < p.Globals {
+		m.globals = append(m.globals, unset)
+	}
+
+	m.save()
+	var main *fiber
+	for _, f := range m.fibers {
+		if f.id == 0 {
+			main = f
+		}
+		for i := range f.frames {
+			f.frames[i].fn = &p.Funcs[index[f.frames[i].fn]]
+		}
+	}
+	if cur := m.cur; cur != main {
+		if dropCur {
+			m.detach(cur)
+			m.fibers = removeFiber(m.fibers, cur)
+		} else if cur.state == fiberRunnable {
+			m.runq = append(m.runq, cur)
+		}
+	}
+	// whatever the main fiber was doing is abandoned
+	m.detach(main)
+	main.state = fiberRunnable
+	main.ip = p.Funcs[k].Entry
+	main.stack = make([]Value, 0, p.Funcs[k].MaxStack)
+	main.frames = []frame{{fn: &p.Funcs[k]}}
+	m.restore(main)
+	m.halted = false
+	m.heap = m.liveBytes()
+	return nil
+}
+
+// detach takes f out of the run queue and any channel queues, and drops
+// the result of a builtin it was blocked in.
+func (m *VM) detach(f *fiber) {
+	for _, ch := range f.waiting {
+		ch.recvq = removeFiber(ch.recvq, f)
+		ch.sendq = removeFiber(ch.sendq, f)
+	}
+	m.runq = removeFiber(m.runq, f)
+	f.waiting, f.sending, f.blockedIn = nil, nil, ""
+	f.resume, f.result, f.err = false, nil, nil
+}
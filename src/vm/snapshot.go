@@ -0,0 +1,632 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/* ---------- Snapshots ---------- */
+
+// A snapshot is a stopped VM, written so it can carry on later or on
+// another machine:
+//
+//	magic    4 bytes  0x7f 'Q' 'S' 'N'
+//	version  u16      SnapshotVersion
+//	program  uvarint length, the executable blob
+//	state    see appendState
+//	crc32    u32      of everything before it
+//
+// Values are encoded as in the constant pool, with two more tags: a
+// channel, by its index in the snapshot's channel table so a channel held
+// in several places is still one channel, and the unset global.
+
+var SnapshotMagic = [4]byte{0x7f, 'Q', 'S', 'N'}
+
+const SnapshotVersion uint16 = 1
+
+const (
+	tagChan  byte = 0x80 + iota // uvarint channel index
+	tagUnset                    // a global whose let has not run
+)
+
+// Snapshot encodes the VM's state: the program, the globals, every
+// fiber's stack, frames and ip, the channels and the scheduler, including
+// its position in the random sequence, and how much of Stdin it has read.
+// LoadSnapshot puts it back, in this VM or another, and Run then carries
+// on from the same instruction. The host's settings are not part of it:
+// Stdout, Stdin itself, Limits and Profile. Given the same input, the
+// resumed program reads on from where it was, see openStdin.
+// Limits.MaxSteps still counts from the original Load, since the step
+// count is.
+func (m *VM) Snapshot() ([]byte, error) {
+	if m.prog == nil {
+		return nil, errors.New("no program loaded")
+	}
+	if m.halted {
+		return nil, ErrHalted
+	}
+	blob, err := EncodeProgram(m.prog)
+	if err != nil {
+		return nil, err
+	}
+	b := append([]byte(nil), SnapshotMagic[:]...)
+	b = binary.LittleEndian.AppendUint16(b, SnapshotVersion)
+	b = binary.AppendUvarint(b, uint64(len(blob)))
+	b = append(b, blob...)
+	if b, err = m.appendState(b); err != nil {
+		return nil, fmt.Errorf("snapshot: %w", err)
+	}
+	return binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b)), nil
+}
+
+// snapEncoder numbers the channels and code objects that the state refers
+// to by index.
+type snapEncoder struct {
+	b      []byte
+	chans  map[*Channel]int
+	order  []*Channel
+	fibers map[*fiber]int
+	funcs  map[*CodeObject]int
+}
+
+// appendState writes the VM's registers and memory:
+//
+//	sched    varint seed, uvarint quantum, uvarint random numbers drawn
+//	counters uvarint steps, next fiber id, time slice used
+//	nchans   uvarint
+//	globals  uvarint count, values
+//	fibers   uvarint count, fibers, see fiber
+//	cur      uvarint index of the running fiber
+//	runq     uvarint count, fiber indexes
+//	chans    nchans * { elem u8, uvarint cap, closed u8, uvarint count,
+//	         values, receive and send queues as counts and fiber indexes }
+//	input    uvarint bytes of Stdin read, uvarint length, bytes read ahead
+func (m *VM) appendState(b []byte) ([]byte, error) {
+	m.save()
+	e := &snapEncoder{b: b, chans: map[*Channel]int{}, fibers: map[*fiber]int{}, funcs: map[*CodeObject]int{}}
+	for i := range m.prog.Funcs {
+		e.funcs[&m.prog.Funcs[i]] = i
+	}
+	for i, f := range m.fibers {
+		e.fibers[f] = i
+	}
+	if _, ok := e.fibers[m.cur]; !ok {
+		return nil, errors.New("the running fiber has finished")
+	}
+	// number the channels before anything refers to them
+	for _, v := range m.globals {
+		e.collect(v)
+	}
+	for _, f := range m.fibers {
+		for _, v := range f.stack {
+			e.collect(v)
+		}
+		for _, fr := range f.frames {
+			for _, v := range fr.locals {
+				e.collect(v)
+			}
+		}
+		for _, ch := range f.waiting {
+			e.collect(ch)
+		}
+		e.collect(f.sending)
+		e.collect(f.result)
+	}
+
+	e.b = binary.AppendVarint(e.b, m.Sched.Seed)
+	e.uint(m.Sched.Quantum)
+	drawn := uint64(0)
+	if m.rngSrc != nil {
+		drawn = m.rngSrc.drawn
+	}
+	e.b = binary.AppendUvarint(e.b, drawn)
+	e.b = binary.AppendUvarint(e.b, uint64(m.steps))
+	e.uint(m.nextFiber)
+	e.uint(m.slice)
+	e.uint(len(e.order))
+	if err := e.values(m.globals); err != nil {
+		return nil, err
+	}
+	e.uint(len(m.fibers))
+	for _, f := range m.fibers {
+		if err := e.fiber(f); err != nil {
+			return nil, fmt.Errorf("fiber %d: %w", f.id, err)
+		}
+	}
+	e.uint(e.fibers[m.cur])
+	e.queue(m.runq)
+	for _, ch := range e.order {
+		e.b = append(e.b, byte(ch.Elem))
+		e.uint(ch.Cap)
+		e.bool(ch.closed)
+		if err := e.values(ch.buf); err != nil {
+			return nil, err
+		}
+		e.queue(ch.recvq)
+		e.queue(ch.sendq)
+	}
+	in := m.inputPos()
+	e.b = binary.AppendUvarint(e.b, uint64(in.offset))
+	e.b = appendString(e.b, string(in.ahead))
+	return e.b, nil
+}
+
+// collect numbers v's channel, and those buffered in it, in the order
+// they are found.
+func (e *snapEncoder) collect(v Value) {
+	ch, ok := v.(*Channel)
+	if !ok {
+		return
+	}
+	if _, seen := e.chans[ch]; seen {
+		return
+	}
+	e.chans[ch] = len(e.order)
+	e.order = append(e.order, ch)
+	for _, b := range ch.buf {
+		e.collect(b)
+	}
+}
+
+func (e *snapEncoder) uint(n int) { e.b = binary.AppendUvarint(e.b, uint64(n)) }
+
+func (e *snapEncoder) bool(v bool) {
+	if v {
+		e.b = append(e.b, 1)
+	} else {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *snapEncoder) value(v Value) error {
+	switch x := v.(type) {
+	case *Channel:
+		e.b = append(e.b, tagChan)
+		e.uint(e.chans[x])
+		return nil
+	case unsetGlobal:
+		e.b = append(e.b, tagUnset)
+		return nil
+	}
+	b, err := appendConst(e.b, v)
+	if err != nil {
+		return err
+	}
+	e.b = b
+	return nil
+}
+
+func (e *snapEncoder) values(vs []Value) error {
+	e.uint(len(vs))
+	for _, v := range vs {
+		if err := e.value(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *snapEncoder) queue(q []*fiber) {
+	e.uint(len(q))
+	for _, f := range q {
+		e.uint(e.fibers[f])
+	}
+}
+
+// fiber writes
+//
+//	uvarint id, state u8, uvarint ip, uvarint stack depth, values,
+//	uvarint frame count, frames * { uvarint code object, varint return
+//	address, uvarint base, uvarint local count, values }, blocked in
+//	string, uvarint count and channel indexes waited on, sending value,
+//	resume u8, result value, error u8 and its message if set
+func (e *snapEncoder) fiber(f *fiber) error {
+	e.uint(f.id)
+	e.b = append(e.b, byte(f.state))
+	e.uint(f.ip)
+	if err := e.values(f.stack); err != nil {
+		return err
+	}
+	e.uint(len(f.frames))
+	for _, fr := range f.frames {
+		e.uint(e.funcs[fr.fn])
+		e.b = binary.AppendVarint(e.b, int64(fr.ret))
+		e.uint(fr.base)
+		if err := e.values(fr.locals); err != nil {
+			return err
+		}
+	}
+	e.b = appendString(e.b, f.blockedIn)
+	e.uint(len(f.waiting))
+	for _, ch := range f.waiting {
+		e.uint(e.chans[ch])
+	}
+	if err := e.value(f.sending); err != nil {
+		return err
+	}
+	e.b = binary.AppendVarint(e.b, int64(f.selected))
+	e.bool(f.resume)
+	if err := e.value(f.result); err != nil {
+		return err
+	}
+	e.bool(f.err != nil)
+	if f.err != nil {
+		e.b = appendString(e.b, f.err.Error())
+	}
+	return nil
+}
+
+// LoadSnapshot replaces the VM's program and state with a snapshot's. The
+// program is verified as by Load and the state is checked against it, so
+// every frame is in a code object of the program with the right number of
+// locals, and every ip and return address is an instruction in it. The
+// scheduler settings in m.Sched are replaced by the snapshot's.
+func (m *VM) LoadSnapshot(data []byte) error {
+	if len(data) < len(SnapshotMagic) || !bytes.Equal(data[:len(SnapshotMagic)], SnapshotMagic[:]) {
+		return fmt.Errorf("%w: not a snapshot", ErrNotBytecode)
+	}
+	if len(data) < len(SnapshotMagic)+2+4 {
+		return fmt.Errorf("%w: truncated snapshot", ErrCorrupt)
+	}
+	if v := binary.LittleEndian.Uint16(data[4:6]); v != SnapshotVersion {
+		return fmt.Errorf("%w: snapshot is version %d, this VM reads version %d", ErrVersion, v, SnapshotVersion)
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return fmt.Errorf("%w: snapshot checksum mismatch", ErrCorrupt)
+	}
+	r := &byteReader{what: "snapshot", data: body, pos: 6}
+	blob, err := r.bytes()
+	if err != nil {
+		return err
+	}
+	prog, err := DecodeProgram(blob)
+	if err != nil {
+		return err
+	}
+	if err := m.LoadProgram(prog); err != nil {
+		return err
+	}
+	d := &snapDecoder{byteReader: r, m: m}
+	if err := d.state(); err != nil {
+		// leave the VM at the start of the program rather than half restored
+		m.LoadProgram(prog)
+		return err
+	}
+	if err := r.done(); err != nil {
+		m.LoadProgram(prog)
+		return err
+	}
+	m.heap = m.liveBytes()
+	return nil
+}
+
+type snapDecoder struct {
+	*byteReader
+	m      *VM
+	chans  []*Channel
+	fibers []*fiber
+}
+
+func (d *snapDecoder) state() error {
+	m := d.m
+	seed, err := d.varint()
+	if err != nil {
+		return err
+	}
+	quantum, err := d.int()
+	if err != nil {
+		return err
+	}
+	drawn, err := d.uvarint()
+	if err != nil {
+		return err
+	}
+	if seed == 0 && drawn != 0 {
+		return d.errorf("random numbers drawn without a seed")
+	}
+	steps, err := d.uvarint()
+	if err != nil {
+		return err
+	}
+	nextFiber, err := d.int()
+	if err != nil {
+		return err
+	}
+	slice, err := d.int()
+	if err != nil {
+		return err
+	}
+	nchans, err := d.count()
+	if err != nil {
+		return err
+	}
+	d.chans = make([]*Channel, nchans)
+	for i := range d.chans {
+		d.chans[i] = &Channel{}
+	}
+	globals, err := d.values()
+	if err != nil {
+		return err
+	}
+	if len(globals) != len(m.globals) {
+		return d.errorf("%d globals, the program has %d", len(globals), len(m.globals))
+	}
+	nfibers, err := d.count()
+	if err != nil {
+		return err
+	}
+	if nfibers == 0 {
+		return d.errorf("no fibers")
+	}
+	for i := 0; i < nfibers; i++ {
+		f, err := d.fiber()
+		if err != nil {
+			return err
+		}
+		d.fibers = append(d.fibers, f)
+	}
+	cur, err := d.index(len(d.fibers), "fiber")
+	if err != nil {
+		return err
+	}
+	runq, err := d.queue()
+	if err != nil {
+		return err
+	}
+	for _, ch := range d.chans {
+		elem, err := d.byte()
+		if err != nil {
+			return err
+		}
+		if ch.Elem = Type(elem); ch.Elem > TypeChan {
+			return d.errorf("unknown channel type %d", elem)
+		}
+		if ch.Cap, err = d.int(); err != nil {
+			return err
+		}
+		if ch.closed, err = d.bool(); err != nil {
+			return err
+		}
+		if ch.buf, err = d.values(); err != nil {
+			return err
+		}
+		if ch.recvq, err = d.queue(); err != nil {
+			return err
+		}
+		if ch.sendq, err = d.queue(); err != nil {
+			return err
+		}
+	}
+	offset, err := d.uvarint()
+	if err != nil {
+		return err
+	}
+	if offset > 1<<62 {
+		return d.errorf("input offset %d out of range", offset)
+	}
+	ahead, err := d.bytes()
+	if err != nil {
+		return err
+	}
+
+	m.Sched.Seed, m.Sched.Quantum = seed, quantum
+	m.resetFibers()
+	for ; drawn > 0; drawn-- {
+		m.rngSrc.Int63()
+	}
+	m.globals = globals
+	m.fibers = d.fibers
+	m.runq = runq
+	m.steps = int64(steps)
+	m.nextFiber = nextFiber
+	m.cur = d.fibers[cur]
+	m.ip, m.stack, m.frames = m.cur.ip, m.cur.stack, m.cur.frames
+	m.slice = slice
+	m.resumeIn, m.reading = nil, nil
+	if offset > 0 || len(ahead) > 0 {
+		m.resumeIn = &inputPos{int64(offset), append([]byte(nil), ahead...)}
+	}
+	return nil
+}
+
+func (d *snapDecoder) varint() (int64, error) {
+	v, n := binary.Varint(d.data[d.pos:])
+	if n <= 0 {
+		return 0, d.errorf("bad varint")
+	}
+	d.pos += n
+	return v, nil
+}
+
+// int reads a uvarint that must fit an int.
+func (d *snapDecoder) int() (int, error) {
+	v, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v > 1<<31 {
+		return 0, d.errorf("%d out of range", v)
+	}
+	return int(v), nil
+}
+
+// index reads an index into a table of n entries.
+func (d *snapDecoder) index(n int, what string) (int, error) {
+	i, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if i >= uint64(n) {
+		return 0, d.errorf("%s %d out of range (%d)", what, i, n)
+	}
+	return int(i), nil
+}
+
+func (d *snapDecoder) bool() (bool, error) {
+	c, err := d.byte()
+	if err != nil {
+		return false, err
+	}
+	if c > 1 {
+		return false, d.errorf("bad bool %d", c)
+	}
+	return c == 1, nil
+}
+
+func (d *snapDecoder) value() (Value, error) {
+	if d.pos < len(d.data) {
+		switch d.data[d.pos] {
+		case tagChan:
+			d.pos++
+			i, err := d.index(len(d.chans), "channel")
+			if err != nil {
+				return nil, err
+			}
+			return d.chans[i], nil
+		case tagUnset:
+			d.pos++
+			return unset, nil
+		}
+	}
+	return d.byteReader.value(0)
+}
+
+func (d *snapDecoder) values() ([]Value, error) {
+	n, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	vs := make([]Value, n)
+	for i := range vs {
+		if vs[i], err = d.value(); err != nil {
+			return nil, err
+		}
+	}
+	return vs, nil
+}
+
+// queue reads fiber indexes. The fibers must have been read already.
+func (d *snapDecoder) queue() ([]*fiber, error) {
+	n, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	q := make([]*fiber, 0, n)
+	for i := 0; i < n; i++ {
+		j, err := d.index(len(d.fibers), "fiber")
+		if err != nil {
+			return nil, err
+		}
+		q = append(q, d.fibers[j])
+	}
+	return q, nil
+}
+
+func (d *snapDecoder) fiber() (*fiber, error) {
+	prog := d.m.prog
+	f := &fiber{}
+	var err error
+	if f.id, err = d.int(); err != nil {
+		return nil, err
+	}
+	state, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	if f.state = fiberState(state); f.state > fiberBlocked {
+		return nil, d.errorf("fiber %d has state %d", f.id, state)
+	}
+	if f.ip, err = d.int(); err != nil {
+		return nil, err
+	}
+	if f.stack, err = d.values(); err != nil {
+		return nil, err
+	}
+	nframes, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	if nframes == 0 {
+		return nil, d.errorf("fiber %d has no frames", f.id)
+	}
+	for i := 0; i < nframes; i++ {
+		fi, err := d.index(len(prog.Funcs), "code object")
+		if err != nil {
+			return nil, err
+		}
+		fr := frame{fn: &prog.Funcs[fi]}
+		ret, err := d.varint()
+		if err != nil {
+			return nil, err
+		}
+		fr.ret = int(ret)
+		if fr.base, err = d.int(); err != nil {
+			return nil, err
+		}
+		if fr.locals, err = d.values(); err != nil {
+			return nil, err
+		}
+		if len(fr.locals) != fr.fn.NumLocals {
+			return nil, d.errorf("frame of %s has %d locals, it needs %d", fr.fn.Name, len(fr.locals), fr.fn.NumLocals)
+		}
+		if i > 0 && (fr.base > len(f.stack) || fr.base < f.frames[i-1].base || !d.in(f.frames[i-1].fn, fr.ret)) {
+			return nil, d.errorf("frame of %s does not fit its caller", fr.fn.Name)
+		}
+		f.frames = append(f.frames, fr)
+	}
+	if top := f.frames[len(f.frames)-1]; !d.in(top.fn, f.ip) || len(f.stack)-top.base > top.fn.MaxStack {
+		return nil, d.errorf("fiber %d is not stopped at an instruction of %s", f.id, top.fn.Name)
+	}
+	if f.blockedIn, err = d.string(); err != nil {
+		return nil, err
+	}
+	nwait, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < nwait; i++ {
+		j, err := d.index(len(d.chans), "channel")
+		if err != nil {
+			return nil, err
+		}
+		f.waiting = append(f.waiting, d.chans[j])
+	}
+	if f.sending, err = d.value(); err != nil {
+		return nil, err
+	}
+	sel, err := d.varint()
+	if err != nil {
+		return nil, err
+	}
+	if sel < -1 || sel > 255 {
+		return nil, d.errorf("fiber %d selected channel %d out of range", f.id, sel)
+	}
+	f.selected = int(sel)
+	if f.resume, err = d.bool(); err != nil {
+		return nil, err
+	}
+	if f.result, err = d.value(); err != nil {
+		return nil, err
+	}
+	hasErr, err := d.bool()
+	if err != nil {
+		return nil, err
+	}
+	if hasErr {
+		msg, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		f.err = errors.New(msg)
+	}
+	return f, nil
+}
+
+// in reports whether addr is the start of an instruction of co.
+func (d *snapDecoder) in(co *CodeObject, addr int) bool {
+	return addr >= co.Entry && addr < co.Entry+co.Size && d.m.code[addr].op != opInvalid
+}
@@ -0,0 +1,189 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// stopAt runs p with input until it has executed n instructions and
+// returns what it printed and a snapshot of where it stopped.
+func stopAt(t *testing.T, p *Program, sched SchedConfig, input string, n int64) (string, []byte) {
+	t.Helper()
+	var out bytes.Buffer
+	m := NewVM()
+	m.Stdout = &out
+	m.Stdin = strings.NewReader(input)
+	m.Sched = sched
+	m.Limits.MaxSteps = n
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := m.Run(); !errors.Is(err, ErrStepLimit) {
+		t.Fatalf("stopping after %d steps: %v", n, err)
+	}
+	snap, err := m.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot after %d steps: %v", n, err)
+	}
+	return out.String(), snap
+}
+
+// resume runs a snapshot to the end with stdin as its input.
+func resume(t *testing.T, snap []byte, stdin io.Reader) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	m := NewVM()
+	m.Stdout = &out
+	m.Stdin = stdin
+	if err := m.LoadSnapshot(snap); err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	err := m.Run()
+	return out.String(), err
+}
+
+// full runs p to the end and returns its output and instruction count.
+func full(t *testing.T, p *Program, sched SchedConfig, input string) (string, int64) {
+	t.Helper()
+	var out bytes.Buffer
+	m := NewVM()
+	m.Stdout = &out
+	m.Stdin = strings.NewReader(input)
+	m.Sched = sched
+	if err := m.LoadProgram(p); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := m.Run(); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	return out.String(), m.Steps()
+}
+
+// Stopping anywhere and resuming from the snapshot must print exactly what
+// an uninterrupted run does, fibers, channels and random scheduling
+// included.
+func TestSnapshotResume(t *testing.T) {
+	p, err := Link([]Object{compileObject(t, "t.quark", workersSrc)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sched := range []SchedConfig{{}, {Seed: 7, Quantum: 1}, {Seed: 42, Quantum: 3}} {
+		want, steps := full(t, p, sched, "")
+		for n := int64(1); n < steps; n++ {
+			before, snap := stopAt(t, p, sched, "", n)
+			after, err := resume(t, snap, nil)
+			if err != nil {
+				t.Fatalf("seed %d, resumed after %d steps: %v", sched.Seed, n, err)
+			}
+			if before+after != want {
+				t.Fatalf("seed %d, stopped after %d steps: output %q then %q, want %q", sched.Seed, n, before, after, want)
+			}
+		}
+	}
+}
+
+// A snapshot taken mid-input carries on reading from the same place,
+// whether the input can be seeked or has to be read past again, and does
+// not lose the lines buffered but not yet read.
+func TestSnapshotResumeInput(t *testing.T) {
+	p, err := Link([]Object{compileObject(t, "t.quark", `
+print("first", readLine());
+print("second", readLine());
+print("third", readLine(), readLine());
+`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const input = "l1\nl2\r\nl3"
+	want, steps := full(t, p, SchedConfig{}, input)
+	if want != "first l1\nsecond l2\nthird l3 null\n" {
+		t.Fatalf("uninterrupted output %q", want)
+	}
+	for n := int64(1); n < steps; n++ {
+		before, snap := stopAt(t, p, SchedConfig{}, input, n)
+		inputs := map[string]io.Reader{
+			"seekable": strings.NewReader(input),
+			"a pipe":   io.MultiReader(strings.NewReader(input)),
+		}
+		for name, stdin := range inputs {
+			after, err := resume(t, snap, stdin)
+			if err != nil {
+				t.Fatalf("resumed after %d steps from %s: %v", n, name, err)
+			}
+			if before+after != want {
+				t.Fatalf("stopped after %d steps, resumed from %s: output %q then %q, want %q", n, name, before, after, want)
+			}
+		}
+	}
+}
+
+// A snapshot taken just after the first line was read holds the rest of
+// the input read ahead, and a resumed run must refuse input that differs.
+func TestSnapshotWrongInput(t *testing.T) {
+	p, err := Link([]Object{compileObject(t, "t.quark", `print(readLine()); print(readLine());`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const input = "one\ntwo\n"
+	var snap []byte
+	for n := int64(1); snap == nil; n++ {
+		m := NewVM()
+		m.Stdout = io.Discard
+		m.Stdin = strings.NewReader(input)
+		m.Limits.MaxSteps = n
+		if err := m.LoadProgram(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(); !errors.Is(err, ErrStepLimit) {
+			t.Fatalf("no line read after %d steps: %v", n, err)
+		}
+		if m.stdinPos == 0 {
+			continue
+		}
+		if snap, err = m.Snapshot(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := resume(t, snap, strings.NewReader(input)); err != nil || got != "one\ntwo\n" {
+		t.Fatalf("resumed with the same input: %q, %v", got, err)
+	}
+	for _, wrong := range []string{"one\nTWO\n", "one\n", ""} {
+		if _, err := resume(t, snap, strings.NewReader(wrong)); err == nil {
+			t.Errorf("resumed with input %q", wrong)
+		}
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	p, err := Link([]Object{compileObject(t, "t.quark", workersSrc)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := EncodeProgram(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, snap := stopAt(t, p, SchedConfig{Seed: 1}, "", 40)
+	flipped := append([]byte(nil), snap...)
+	flipped[len(flipped)/2] ^= 0x40
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrNotBytecode},
+		{"a program", blob, ErrNotBytecode},
+		{"truncated", snap[:8], ErrCorrupt},
+		{"flipped bit", flipped, ErrCorrupt},
+		{"newer version", append(append([]byte(nil), snap[:4]...), append([]byte{0xff, 0xff}, snap[6:]...)...), ErrVersion},
+	}
+	for _, tt := range tests {
+		m := NewVM()
+		if err := m.LoadSnapshot(tt.data); !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+/* ---------- Verifier ---------- */
+
+// VerifyError reports malformed code found before execution.
+type VerifyError struct {
+	Addr int
+	Msg  string
+}
+
+func (e *VerifyError) Error() string { return fmt.Sprintf("verify: at %04d: %s", e.Addr, e.Msg) }
+
+// VerifyInfo is what the verifier learned about a program.
+type VerifyInfo struct {
+	MaxStack int // deepest operand stack of any code object
+}
+
+// stackEffect returns how many values in executes pops and pushes.
+func stackEffect(in Instr) (pop, push int) {
+	switch in.Op {
+	case OpLoadConst, OpLoadLocal, OpLoadGlobal:
+		return 0, 1
+	case OpStoreLocal, OpStoreGlobal, OpPop, OpJumpIfFalse, OpReturn:
+		return 1, 0
+	case OpAdd, OpSub, OpMul, OpDiv, OpMod, OpBitAnd, OpBitOr, OpBitXor, OpShl, OpShr, OpUshr:
+		return 2, 1
+	case OpBitNot:
+		return 1, 1
+	case OpCall, OpCallBuiltin:
+		return in.Args[1], 1
+	case OpSpawn:
+		return in.Args[1], 0
+	}
+	return 0, 0
+}
+
+// successors lists the addresses control can reach after in.
+func successors(in Instr) []int {
+	next := in.Addr + in.Size
+	switch in.Op {
+	case OpHalt, OpReturn:
+		return nil
+	case OpJump:
+		return []int{in.Args[0]}
+	case OpJumpIfFalse:
+		return []int{next, in.Args[0]}
+	}
+	return []int{next}
+}
+
+// verifyState is the abstract state on entry to an instruction: the stack
+// depth and the set of locals assigned on every path to it.
+type verifyState struct {
+	depth    int
+	assigned []uint64 // bitset of local slots
+}
+
+func (s verifyState) has(local int) bool {
+	w := local / 64
+	return w < len(s.assigned) && s.assigned[w]&(1<<(local%64)) != 0
+}
+
+func (s verifyState) with(local int) verifyState {
+	w := local / 64
+	a := make([]uint64, max(len(s.assigned), w+1))
+	copy(a, s.assigned)
+	a[w] |= 1 << (local % 64)
+	return verifyState{depth: s.depth, assigned: a}
+}
+
+// meet intersects the assigned sets and reports whether s changed.
+func (s *verifyState) meet(o verifyState) bool {
+	changed := false
+	for i := range s.assigned {
+		var ow uint64
+		if i < len(o.assigned) {
+			ow = o.assigned[i]
+		}
+		if s.assigned[i]&ow != s.assigned[i] {
+			s.assigned[i] &= ow
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Verify checks p's code by abstract interpretation before it runs. The
+// code object table must start with the module initialiser at address 0
+// and its entries must not overlap. Within each code object every
+// reachable instruction decodes, jumps stay inside the object and land on
+// instruction boundaries, the stack never underflows, never exceeds the
+// declared maximum and has the same depth wherever paths merge, constant,
+// global, code object and builtin indices are in range, locals are
+// assigned before they are read, calls pass the callee's arity, and
+// execution cannot run off the end without OpHalt or OpReturn.
+func Verify(p *Program) (*VerifyInfo, error) {
+	if len(p.Funcs) == 0 {
+		return nil, &VerifyError{0, "no code objects"}
+	}
+	if main := p.Funcs[0]; main.Entry != 0 || main.Kind != CodeModule {
+		return nil, &VerifyError{main.Entry, fmt.Sprintf("first code object %s is a %v at %d, expected the module initialiser at 0", main.Name, main.Kind, main.Entry)}
+	}
+	order := make([]int, len(p.Funcs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return p.Funcs[order[a]].Entry < p.Funcs[order[b]].Entry })
+	for k := 1; k < len(order); k++ {
+		prev, co := p.Funcs[order[k-1]], p.Funcs[order[k]]
+		if prev.Entry+prev.Size > co.Entry {
+			return nil, &VerifyError{co.Entry, fmt.Sprintf("code objects %s and %s overlap", prev.Name, co.Name)}
+		}
+	}
+
+	info := &VerifyInfo{}
+	for i := range p.Funcs {
+		co := &p.Funcs[i]
+		maxStack, err := analyze(p, co, true)
+		if err != nil {
+			return nil, err
+		}
+		if maxStack > co.MaxStack {
+			return nil, &VerifyError{co.Entry, fmt.Sprintf("%s needs a stack of %d but declares %d", co.Name, maxStack, co.MaxStack)}
+		}
+		listed := map[int]bool{}
+		for _, c := range co.Consts {
+			listed[c] = true
+		}
+		for _, c := range constRefs(p, co) {
+			if !listed[c] {
+				return nil, &VerifyError{co.Entry, fmt.Sprintf("%s loads constant %d, which is not in its constant list", co.Name, c)}
+			}
+		}
+		info.MaxStack = max(info.MaxStack, co.MaxStack)
+	}
+	return info, nil
+}
+
+// analyze interprets co abstractly and returns its deepest stack. strict is
+// off for unlinked objects, whose global and code object operands are still
+// placeholders and whose module code may run on into the next object.
+func analyze(p *Program, co *CodeObject, strict bool) (int, error) {
+	code := p.Code
+	start, end := co.Entry, co.Entry+co.Size
+	if co.Size == 0 {
+		if strict || co.Kind != CodeModule {
+			return 0, &VerifyError{start, fmt.Sprintf("%s has no code", co.Name)}
+		}
+		return 0, nil
+	}
+	// a linear sweep finds the instruction boundaries; it stops at the first
+	// undecodable byte, which is only an error if control reaches it
+	bounds := map[int]bool{}
+	swept := start
+	for swept < end {
+		in, err := DecodeInstr(code[:end], swept)
+		if err != nil {
+			break
+		}
+		bounds[swept] = true
+		swept += in.Size
+	}
+
+	instrs := map[int]Instr{}
+	states := map[int]*verifyState{}
+	entry := verifyState{}
+	for i := 0; i < co.Arity; i++ {
+		entry = entry.with(i)
+	}
+	states[start] = &entry
+	work := []int{start}
+	maxStack := 0
+
+	for len(work) > 0 {
+		addr := work[len(work)-1]
+		work = work[:len(work)-1]
+		in, ok := instrs[addr]
+		if !ok {
+			var err error
+			in, err = DecodeInstr(code[:end], addr)
+			if err != nil {
+				return 0, &VerifyError{addr, err.Error()}
+			}
+			instrs[addr] = in
+		}
+		st := *states[addr]
+
+		switch in.Op {
+		case OpLoadConst:
+			if in.Args[0] >= len(p.Consts) {
+				return 0, &VerifyError{addr, fmt.Sprintf("constant index %d out of range (%d constants)", in.Args[0], len(p.Consts))}
+			}
+		case OpLoadLocal, OpStoreLocal:
+			if in.Args[0] >= co.NumLocals {
+				return 0, &VerifyError{addr, fmt.Sprintf("local %d out of range, %s has %d", in.Args[0], co.Name, co.NumLocals)}
+			}
+			if in.Op == OpStoreLocal {
+				st = st.with(in.Args[0])
+			} else if !st.has(in.Args[0]) {
+				return 0, &VerifyError{addr, fmt.Sprintf("local %d may be read before it is assigned", in.Args[0])}
+			}
+		case OpLoadGlobal, OpStoreGlobal:
+			if strict && in.Args[0] >= p.Globals {
+				return 0, &VerifyError{addr, fmt.Sprintf("global %d out of range (%d globals)", in.Args[0], p.Globals)}
+			}
+		case OpCall, OpSpawn:
+			if strict {
+				if in.Args[0] >= len(p.Funcs) {
+					return 0, &VerifyError{addr, fmt.Sprintf("code object %d out of range (%d code objects)", in.Args[0], len(p.Funcs))}
+				}
+				callee := &p.Funcs[in.Args[0]]
+				if callee.Kind == CodeModule {
+					return 0, &VerifyError{addr, fmt.Sprintf("call of module initialiser %s", callee.Name)}
+				}
+				if in.Args[1] != callee.Arity {
+					return 0, &VerifyError{addr, fmt.Sprintf("%s takes %d argument(s), called with %d", callee.Name, callee.Arity, in.Args[1])}
+				}
+			}
+		case OpCallBuiltin:
+			if in.Args[0] >= len(p.Builtins) {
+				return 0, &VerifyError{addr, fmt.Sprintf("builtin %d out of range (%d imported)", in.Args[0], len(p.Builtins))}
+			}
+		case OpReturn:
+			if co.Kind == CodeModule {
+				return 0, &VerifyError{addr, "RETURN outside a function"}
+			}
+		}
+
+		pop, push := stackEffect(in)
+		if st.depth < pop {
+			return 0, &VerifyError{addr, fmt.Sprintf("stack underflow: %s needs %d value(s), stack has %d", OpName(in.Op), pop, st.depth)}
+		}
+		st.depth += push - pop
+		maxStack = max(maxStack, st.depth)
+
+		for _, next := range successors(in) {
+			if next == end && next == in.Addr+in.Size {
+				if !strict && co.Kind == CodeModule {
+					continue
+				}
+				if co.Kind == CodeModule {
+					return 0, &VerifyError{addr, "execution can fall off the end of the code without HALT"}
+				}
+				return 0, &VerifyError{addr, fmt.Sprintf("execution can fall off the end of %s without RETURN", co.Name)}
+			}
+			if next < start || next >= end {
+				return 0, &VerifyError{addr, fmt.Sprintf("jump target %d outside %s", next, co.Name)}
+			}
+			if next < swept && !bounds[next] {
+				return 0, &VerifyError{addr, fmt.Sprintf("jump to %d lands in the middle of an instruction", next)}
+			}
+			prev, seen := states[next]
+			if !seen {
+				// copy the bitset, meet updates it in place
+				states[next] = &verifyState{depth: st.depth, assigned: append([]uint64(nil), st.assigned...)}
+				work = append(work, next)
+				continue
+			}
+			if prev.depth != st.depth {
+				return 0, &VerifyError{next, fmt.Sprintf("stack depth %d here but %d on another path", st.depth, prev.depth)}
+			}
+			if prev.meet(st) {
+				work = append(work, next)
+			}
+		}
+	}
+	return maxStack, nil
+}
+
+// constRefs lists, ascending, the valid constant indices loaded by the
+// instructions of co found by a linear sweep.
+func constRefs(p *Program, co *CodeObject) []int {
+	code := p.Code
+	seen := map[int]bool{}
+	var refs []int
+	end := co.Entry + co.Size
+	for addr := co.Entry; addr < end; {
+		in, err := DecodeInstr(code[:end], addr)
+		if err != nil {
+			break
+		}
+		if in.Op == OpLoadConst && in.Args[0] < len(p.Consts) && !seen[in.Args[0]] {
+			seen[in.Args[0]] = true
+			refs = append(refs, in.Args[0])
+		}
+		addr += in.Size
+	}
+	sort.Ints(refs)
+	return refs
+}
+
+// fillCodeInfo sets MaxStack and Consts of every code object in p from its
+// code. Code the verifier would reject gets a MaxStack of 0; Verify reports
+// the real problem when the program is loaded.
+func fillCodeInfo(p *Program) {
+	for i := range p.Funcs {
+		co := &p.Funcs[i]
+		co.MaxStack, _ = analyze(p, co, false)
+		co.Consts = constRefs(p, co)
+	}
+}
+
+func isVerifyError(err error) bool {
+	var ve *VerifyError
+	return errors.As(err, &ve)
+}
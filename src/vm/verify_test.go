@@ -0,0 +1,203 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+)
+
+func assemble(t *testing.T, src string) *Program {
+	t.Helper()
+	p, err := Assemble("t.qasm", src)
+	if err != nil {
+		t.Fatalf("Assemble: %v", err)
+	}
+	return p
+}
+
+func TestVerifyAccepts(t *testing.T) {
+	p := assemble(t, `
+.const
+    one: 1
+.code
+    LOAD_CONST one
+    LOAD_CONST one
+    CALL add 2
+    JUMP_IF_FALSE end
+    LOAD_CONST one
+    POP
+end:
+    HALT
+.func add 2 3
+    LOAD_LOCAL 0
+    LOAD_LOCAL 1
+    ADD
+    STORE_LOCAL 2
+    LOAD_LOCAL 2
+    RETURN
+`)
+	info, err := Verify(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.MaxStack != 2 {
+		t.Errorf("MaxStack = %d, want 2", info.MaxStack)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"jump into an instruction", `
+.const
+    one: 1
+.code
+    LOAD_CONST one
+    JUMP 1
+`, "lands in the middle of an instruction"},
+		{"jump outside the code object", `
+.code
+    JUMP 100
+`, "jump target 100 outside"},
+		{"jump into another code object", `
+.code
+    JUMP 4
+    HALT
+.func f 0 0
+    LOAD_CONST 0
+    RETURN
+`, "outside <main>"},
+		{"stack depth differs where paths merge", `
+.const
+    one: 1
+.code
+    LOAD_CONST one
+    JUMP_IF_FALSE merge
+    LOAD_CONST one
+merge:
+    HALT
+`, "stack depth 1 here but 0 on another path"},
+		{"stack depth differs around a loop", `
+.const
+    one: 1
+.code
+loop:
+    LOAD_CONST one
+    JUMP loop
+`, "stack depth 1 here but 0 on another path"},
+		{"stack underflow", `
+.code
+    ADD
+    HALT
+`, "stack underflow: ADD needs 2 value(s), stack has 0"},
+		{"falls off the end", `
+.const
+    one: 1
+.code
+    LOAD_CONST one
+    POP
+`, "fall off the end of the code without HALT"},
+		{"function falls off the end", `
+.const
+    one: 1
+.code
+    CALL f 0
+    POP
+    HALT
+.func f 0 0
+    LOAD_CONST one
+`, "without RETURN"},
+		{"local read before it is assigned", `
+.code
+    CALL f 0
+    POP
+    HALT
+.func f 0 1
+    LOAD_LOCAL 0
+    RETURN
+`, "local 0 may be read before it is assigned"},
+		{"local assigned on one path only", `
+.const
+    one: 1
+.code
+    LOAD_CONST one
+    CALL f 1
+    POP
+    HALT
+.func f 1 2
+    LOAD_LOCAL 0
+    JUMP_IF_FALSE skip
+    LOAD_LOCAL 0
+    STORE_LOCAL 1
+skip:
+    LOAD_LOCAL 1
+    RETURN
+`, "local 1 may be read before it is assigned"},
+		{"wrong argument count", `
+.const
+    one: 1
+.code
+    LOAD_CONST one
+    CALL f 1
+    POP
+    HALT
+.func f 2 2
+    LOAD_LOCAL 0
+    RETURN
+`, "f takes 2 argument(s), called with 1"},
+		{"constant out of range", `
+.code
+    LOAD_CONST 5
+    POP
+    HALT
+`, "constant index 5 out of range"},
+		{"undecodable byte", `
+.code
+    .byte 250
+`, "at 0000"},
+	}
+	for _, tt := range tests {
+		p, err := Assemble("t.qasm", tt.src)
+		if err != nil {
+			t.Errorf("%s: Assemble: %v", tt.name, err)
+			continue
+		}
+		_, err = Verify(p)
+		if err == nil {
+			t.Errorf("%s: verified", tt.name)
+			continue
+		}
+		if !isVerifyError(err) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want a VerifyError containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyDeclaredStack(t *testing.T) {
+	p := assemble(t, `
+.const
+    one: 1
+.code
+    LOAD_CONST one
+    LOAD_CONST one
+    ADD
+    POP
+    HALT
+`)
+	p.Funcs[0].MaxStack = 1
+	if _, err := Verify(p); err == nil || !strings.Contains(err.Error(), "needs a stack of 2 but declares 1") {
+		t.Errorf("got %v, want the declared stack rejected", err)
+	}
+}
+
+// A program that fails verification must not start running.
+func TestLoadVerifies(t *testing.T) {
+	p := assemble(t, `
+.code
+    POP
+    HALT
+`)
+	if err := NewVM().LoadProgram(p); !isVerifyError(err) {
+		t.Errorf("LoadProgram = %v, want a VerifyError", err)
+	}
+}
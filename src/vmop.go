@@ -6,76 +6,28 @@ import (
 	"path/filepath"
 	"quark/vm"
 	"fmt"
-	"encoding/binary"
+	"time"
 )
 
 func BuildGluon(projectDir string) error {
-	var finishedCode []byte
-	var finishedConsts []interface{}
+	var objects []vm.Object
 	processed := map[string]bool{}
-	remapLoadConstIndices := func(code []byte, offset uint16) ([]byte, error) {
-		out := make([]byte, len(code))
-		copy(out, code)
+	cache := openBuildCache(projectDir)
 
-		i := 0
-		for i < len(out) {
-			op := out[i]
-			i++
-			switch op {
-			case vm.OpHalt:
-				// hello debuggers!
-			case vm.OpLoadConst:
-				if i+2 > len(out) {
-					return nil, fmt.Errorf("malformed code while reading LOAD_CONST operand")
-				}
-				idx := binary.LittleEndian.Uint16(out[i : i+2])
-				newIdx := idx + offset
-				binary.LittleEndian.PutUint16(out[i:i+2], newIdx)
-				i += 2
-			case vm.OpStoreLocal, vm.OpLoadLocal, vm.OpJump, vm.OpJumpIfFalse:
-				// u16 operan
-				if i+2 > len(out) {
-					return nil, fmt.Errorf("malformed code while reading u16 operand for op %d", op)
-				}
-				i += 2
-			case vm.OpCallBuiltin:
-				// single u8 operand (argc)
-				if i+1 > len(out) {
-					return nil, fmt.Errorf("malformed code while reading CALL operand")
-				}
-				i += 1
-			case vm.OpAdd, vm.OpSub, vm.OpMul, vm.OpDiv, vm.OpPop:
-				// no inline operands
-			default:
-				return nil, fmt.Errorf("unknown opcode %d while remapping", op)
-			}
-		}
-		return out, nil
-	}
-
-	processBlob := func(blob []byte) error {
+	processBlob := func(name string, blob []byte, prog *vm.Program) error {
 		chk := Checksum(blob)
 		if processed[chk] {
 			return nil
 		}
 		processed[chk] = true
 
-		code, consts, err := vm.DeserializeBytecode(blob)
-		if err != nil {
-			return fmt.Errorf("deserialize failed: %w", err)
-		}
-
-		offset := uint16(len(finishedConsts))
-
-		remappedCode, err := remapLoadConstIndices(code, offset)
-		if err != nil {
-			return fmt.Errorf("remap error: %w", err)
-		}
-
-		for _, c := range consts {
-			finishedConsts = append(finishedConsts, c)
+		if prog == nil {
+			var err error
+			if prog, err = vm.DecodeProgram(blob); err != nil {
+				return fmt.Errorf("deserialize failed: %w", err)
+			}
 		}
-		finishedCode = append(finishedCode, remappedCode...)
+		objects = append(objects, vm.Object{Name: name, Prog: prog})
 		return nil
 	}
 
@@ -87,6 +39,18 @@ func BuildGluon(projectDir string) error {
 				return err
 			}
 			if !info.IsDir() && strings.HasSuffix(info.Name(), ".gluon") {
+				gluonBytes, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				key := cache.key("gluon", path, gluonBytes)
+				if blob, prog, ok := cache.getProgram(key); ok {
+					Log("Cache hit: " + path)
+					if err := processBlob(path, blob, prog); err != nil {
+						return fmt.Errorf("%s: %w", path, err)
+					}
+					return nil
+				}
 				LoadGluon(path) // mounts to quark--gluon--mount
 				gluonBlobPath := filepath.Join("quark--gluon--mount", "source.glue")
 				if _, err := os.Stat(gluonBlobPath); err == nil {
@@ -94,8 +58,9 @@ func BuildGluon(projectDir string) error {
 					if err != nil {
 						return err
 					}
-					if err := processBlob(blob); err != nil {
-						return err
+					cache.put(key, blob)
+					if err := processBlob(path, blob, nil); err != nil {
+						return fmt.Errorf("%s: %w", path, err)
 					}
 				} else {
 					Log("warning: gluon had no source.glue: " + path)
@@ -122,11 +87,11 @@ func BuildGluon(projectDir string) error {
 			if processed[chk] {
 				return nil
 			}
-			blob, err := vm.CompileSourceToBlob(string(srcBytes))
+			blob, prog, err := cache.compile(path, srcBytes)
 			if err != nil {
 				return err
 			}
-			if err := processBlob(blob); err != nil {
+			if err := processBlob(path, blob, prog); err != nil {
 				return err
 			}
 		}
@@ -135,11 +100,20 @@ func BuildGluon(projectDir string) error {
 		return err
 	}
 
-	// 3) append a single HALT at the end (make sure compiler removed per-file HALT)
-	finishedCode = append(finishedCode, byte(vm.OpHalt))
+	Log(fmt.Sprintf("Build cache: %d hit(s), %d miss(es)", cache.hits, cache.misses))
+	cache.prune(time.Now().Add(-cacheMaxAge))
+
+	// 3) link everything into one program ending in a single HALT
+	prog, err := vm.Link(objects)
+	if err != nil {
+		return err
+	}
 
-	// 4) serialize combined consts + combined code into final blob
-	finalBlob, err := vm.SerializeBytecode(finishedCode, finishedConsts)
+	// 4) verify, then serialize the linked program into the final blob
+	if _, err := vm.Verify(prog); err != nil {
+		return fmt.Errorf("linked program failed verification: %w", err)
+	}
+	finalBlob, err := vm.EncodeProgram(prog)
 	if err != nil {
 		return fmt.Errorf("serialize failed: %w", err)
 	}